@@ -7,17 +7,35 @@ import (
 	"unsafe"
 )
 
-var freeNodeLock sync.Mutex
-var freeNodes *node
+// A Store's free lists of nodes, nodeLocs and rootNodeLocs, which its
+// snapshots share, so that Stores don't contend on each other's locks.
+// With SetAllocPool(), sync.Pool's are used instead.
+type allocator struct {
+	usePool int32 // Atomic protected.
 
-var freeNodeLocLock sync.Mutex
-var freeNodeLocs *nodeLoc
+	freeNodeLock sync.Mutex // Also held while reclaiming nodes.
+	freeNodes    *node
 
-var freeRootNodeLocLock sync.Mutex
-var freeRootNodeLocs *rootNodeLoc
+	freeNodeLocLock sync.Mutex
+	freeNodeLocs    *nodeLoc
 
-var allocStats AllocStats
+	freeRootNodeLocLock sync.Mutex
+	freeRootNodeLocs    *rootNodeLoc
 
+	stats AllocStats // Atomic protected.
+}
+
+// Shared by the Stores that use SetAllocPool(), as sync.Pool's don't
+// contend much.
+var nodePool, nodeLocPool, rootNodeLocPool sync.Pool
+
+// Sentinels for the next field of what's last in a free list or in a
+// sync.Pool, so a double free is detected.
+var freedNode = &node{}
+var freedNodeLoc = &nodeLoc{}
+var freedRootNodeLoc = &rootNodeLoc{}
+
+// Allocation stats, which are atomic protected.
 type AllocStats struct {
 	MkNodes      int64
 	FreeNodes    int64 // Number of invocations of the freeNode() API.
@@ -35,14 +53,57 @@ type AllocStats struct {
 	CurFreeRootNodeLocs int64 // Current length of freeRootNodeLocs list.
 }
 
-func withAllocLocks(cb func()) {
-	freeNodeLock.Lock()
-	freeNodeLocLock.Lock()
-	freeRootNodeLocLock.Lock()
-	defer freeNodeLock.Unlock()
-	defer freeNodeLocLock.Unlock()
-	defer freeRootNodeLocLock.Unlock()
-	cb()
+func (s *AllocStats) load() AllocStats {
+	return AllocStats{
+		MkNodes:      atomic.LoadInt64(&s.MkNodes),
+		FreeNodes:    atomic.LoadInt64(&s.FreeNodes),
+		AllocNodes:   atomic.LoadInt64(&s.AllocNodes),
+		CurFreeNodes: atomic.LoadInt64(&s.CurFreeNodes),
+
+		MkNodeLocs:      atomic.LoadInt64(&s.MkNodeLocs),
+		FreeNodeLocs:    atomic.LoadInt64(&s.FreeNodeLocs),
+		AllocNodeLocs:   atomic.LoadInt64(&s.AllocNodeLocs),
+		CurFreeNodeLocs: atomic.LoadInt64(&s.CurFreeNodeLocs),
+
+		MkRootNodeLocs:      atomic.LoadInt64(&s.MkRootNodeLocs),
+		FreeRootNodeLocs:    atomic.LoadInt64(&s.FreeRootNodeLocs),
+		AllocRootNodeLocs:   atomic.LoadInt64(&s.AllocRootNodeLocs),
+		CurFreeRootNodeLocs: atomic.LoadInt64(&s.CurFreeRootNodeLocs),
+	}
+}
+
+// Has the Store recycle its nodes, nodeLocs and rootNodeLocs through
+// sync.Pool's, shared with other Stores that use them, instead of
+// through its own free lists, which are dropped.  The CurFree stats
+// aren't kept for sync.Pool's, which may drop what's put into them.
+func (s *Store) SetAllocPool(usePool bool) {
+	a := s.alloc
+	if !usePool {
+		atomic.StoreInt32(&a.usePool, 0)
+		return
+	}
+	atomic.StoreInt32(&a.usePool, 1)
+	a.freeNodeLock.Lock()
+	a.freeNodes = nil
+	atomic.StoreInt64(&a.stats.CurFreeNodes, 0)
+	a.freeNodeLock.Unlock()
+	a.freeNodeLocLock.Lock()
+	a.freeNodeLocs = nil
+	atomic.StoreInt64(&a.stats.CurFreeNodeLocs, 0)
+	a.freeNodeLocLock.Unlock()
+	a.freeRootNodeLocLock.Lock()
+	a.freeRootNodeLocs = nil
+	atomic.StoreInt64(&a.stats.CurFreeRootNodeLocs, 0)
+	a.freeRootNodeLocLock.Unlock()
+}
+
+// Returns the allocation stats of the Store and its snapshots.
+func (s *Store) AllocStats() AllocStats {
+	return s.alloc.stats.load()
+}
+
+func (a *allocator) pooled() bool {
+	return atomic.LoadInt32(&a.usePool) != 0
 }
 
 func (t *Collection) markReclaimable(n *node, reclaimMark *node) {
@@ -104,20 +165,29 @@ func (t *Collection) reclaimNodes_unlocked(n *node,
 // Assumes that the caller serializes invocations.
 func (t *Collection) mkNode(itemIn *itemLoc, leftIn *nodeLoc, rightIn *nodeLoc,
 	numNodesIn uint64, numBytesIn uint64) *node {
-	freeNodeLock.Lock()
-	allocStats.MkNodes++
-	t.allocStats.MkNodes++
-	n := freeNodes
+	a := t.store.alloc
+	atomic.AddInt64(&a.stats.MkNodes, 1)
+	atomic.AddInt64(&t.allocStats.MkNodes, 1)
+	var n *node
+	if a.pooled() {
+		n, _ = nodePool.Get().(*node)
+	} else {
+		a.freeNodeLock.Lock()
+		n = a.freeNodes
+		if n != nil {
+			a.freeNodes = n.next
+			if a.freeNodes == freedNode {
+				a.freeNodes = nil
+			}
+			atomic.AddInt64(&a.stats.CurFreeNodes, -1)
+		}
+		a.freeNodeLock.Unlock()
+	}
 	if n == nil {
-		allocStats.AllocNodes++
-		t.allocStats.AllocNodes++
-		freeNodeLock.Unlock()
+		atomic.AddInt64(&a.stats.AllocNodes, 1)
+		atomic.AddInt64(&t.allocStats.AllocNodes, 1)
 		atomic.AddUint64(&t.store.nodeAllocs, 1)
 		n = &node{}
-	} else {
-		freeNodes = n.next
-		allocStats.CurFreeNodes--
-		freeNodeLock.Unlock()
 	}
 	if itemIn != nil {
 		i := itemIn.Item()
@@ -134,6 +204,7 @@ func (t *Collection) mkNode(itemIn *itemLoc, leftIn *nodeLoc, rightIn *nodeLoc,
 	return n
 }
 
+// Assumes that the caller holds the freeNodeLock.
 func (t *Collection) freeNode_unlocked(n *node, reclaimMark *node) {
 	if n == nil || n == reclaimMark {
 		return
@@ -145,33 +216,52 @@ func (t *Collection) freeNode_unlocked(n *node, reclaimMark *node) {
 	if i != nil {
 		t.store.ItemDecRef(t, i)
 	}
-	n.item = *empty_itemLoc
-	n.left = *empty_nodeLoc
-	n.right = *empty_nodeLoc
+	// Cleared atomically, as an evictor may still be looking at them.
+	n.item.Copy(empty_itemLoc)
+	n.left.Copy(empty_nodeLoc)
+	n.right.Copy(empty_nodeLoc)
 	n.numNodes = 0
 	n.numBytes = 0
-	n.next = freeNodes
-	freeNodes = n
-	allocStats.CurFreeNodes++
-	allocStats.FreeNodes++
-	t.allocStats.FreeNodes++
+	a := t.store.alloc
+	atomic.AddInt64(&a.stats.FreeNodes, 1)
+	atomic.AddInt64(&t.allocStats.FreeNodes, 1)
+	if a.pooled() {
+		n.next = freedNode
+		nodePool.Put(n)
+		return
+	}
+	n.next = a.freeNodes
+	if n.next == nil {
+		n.next = freedNode
+	}
+	a.freeNodes = n
+	atomic.AddInt64(&a.stats.CurFreeNodes, 1)
 }
 
 // Assumes that the caller serializes invocations.
 func (t *Collection) mkNodeLoc(n *node) *nodeLoc {
-	freeNodeLocLock.Lock()
-	allocStats.MkNodeLocs++
-	t.allocStats.MkNodeLocs++
-	nloc := freeNodeLocs
+	a := t.store.alloc
+	atomic.AddInt64(&a.stats.MkNodeLocs, 1)
+	atomic.AddInt64(&t.allocStats.MkNodeLocs, 1)
+	var nloc *nodeLoc
+	if a.pooled() {
+		nloc, _ = nodeLocPool.Get().(*nodeLoc)
+	} else {
+		a.freeNodeLocLock.Lock()
+		nloc = a.freeNodeLocs
+		if nloc != nil {
+			a.freeNodeLocs = nloc.next
+			if a.freeNodeLocs == freedNodeLoc {
+				a.freeNodeLocs = nil
+			}
+			atomic.AddInt64(&a.stats.CurFreeNodeLocs, -1)
+		}
+		a.freeNodeLocLock.Unlock()
+	}
 	if nloc == nil {
-		allocStats.AllocNodeLocs++
-		t.allocStats.AllocNodeLocs++
-		freeNodeLocLock.Unlock()
+		atomic.AddInt64(&a.stats.AllocNodeLocs, 1)
+		atomic.AddInt64(&t.allocStats.AllocNodeLocs, 1)
 		nloc = &nodeLoc{}
-	} else {
-		freeNodeLocs = nloc.next
-		allocStats.CurFreeNodeLocs--
-		freeNodeLocLock.Unlock()
 	}
 	nloc.loc = unsafe.Pointer(nil)
 	nloc.node = unsafe.Pointer(n)
@@ -187,32 +277,50 @@ func (t *Collection) freeNodeLoc(nloc *nodeLoc) {
 	if nloc.next != nil {
 		panic("double free nodeLoc")
 	}
-	nloc.loc = unsafe.Pointer(nil)
-	nloc.node = unsafe.Pointer(nil)
-
-	freeNodeLocLock.Lock()
-	nloc.next = freeNodeLocs
-	freeNodeLocs = nloc
-	allocStats.CurFreeNodeLocs++
-	allocStats.FreeNodeLocs++
-	t.allocStats.FreeNodeLocs++
-	freeNodeLocLock.Unlock()
+	atomic.StorePointer(&nloc.loc, unsafe.Pointer(nil))
+	atomic.StorePointer(&nloc.node, unsafe.Pointer(nil))
+
+	a := t.store.alloc
+	atomic.AddInt64(&a.stats.FreeNodeLocs, 1)
+	atomic.AddInt64(&t.allocStats.FreeNodeLocs, 1)
+	if a.pooled() {
+		nloc.next = freedNodeLoc
+		nodeLocPool.Put(nloc)
+		return
+	}
+	a.freeNodeLocLock.Lock()
+	nloc.next = a.freeNodeLocs
+	if nloc.next == nil {
+		nloc.next = freedNodeLoc
+	}
+	a.freeNodeLocs = nloc
+	atomic.AddInt64(&a.stats.CurFreeNodeLocs, 1)
+	a.freeNodeLocLock.Unlock()
 }
 
 func (t *Collection) mkRootNodeLoc(root *nodeLoc) *rootNodeLoc {
-	freeRootNodeLocLock.Lock()
-	allocStats.MkRootNodeLocs++
-	t.allocStats.MkRootNodeLocs++
-	rnl := freeRootNodeLocs
+	a := t.store.alloc
+	atomic.AddInt64(&a.stats.MkRootNodeLocs, 1)
+	atomic.AddInt64(&t.allocStats.MkRootNodeLocs, 1)
+	var rnl *rootNodeLoc
+	if a.pooled() {
+		rnl, _ = rootNodeLocPool.Get().(*rootNodeLoc)
+	} else {
+		a.freeRootNodeLocLock.Lock()
+		rnl = a.freeRootNodeLocs
+		if rnl != nil {
+			a.freeRootNodeLocs = rnl.next
+			if a.freeRootNodeLocs == freedRootNodeLoc {
+				a.freeRootNodeLocs = nil
+			}
+			atomic.AddInt64(&a.stats.CurFreeRootNodeLocs, -1)
+		}
+		a.freeRootNodeLocLock.Unlock()
+	}
 	if rnl == nil {
-		allocStats.AllocRootNodeLocs++
-		t.allocStats.AllocRootNodeLocs++
-		freeRootNodeLocLock.Unlock()
+		atomic.AddInt64(&a.stats.AllocRootNodeLocs, 1)
+		atomic.AddInt64(&t.allocStats.AllocRootNodeLocs, 1)
 		rnl = &rootNodeLoc{}
-	} else {
-		freeRootNodeLocs = rnl.next
-		allocStats.CurFreeRootNodeLocs--
-		freeRootNodeLocLock.Unlock()
 	}
 	rnl.refs = 1
 	rnl.root = root
@@ -242,11 +350,20 @@ func (t *Collection) freeRootNodeLoc(rnl *rootNodeLoc) {
 				i, rnl.reclaimLater[i]))
 		}
 	}
-	freeRootNodeLocLock.Lock()
-	rnl.next = freeRootNodeLocs
-	freeRootNodeLocs = rnl
-	allocStats.CurFreeRootNodeLocs++
-	allocStats.FreeRootNodeLocs++
-	t.allocStats.FreeRootNodeLocs++
-	freeRootNodeLocLock.Unlock()
+	a := t.store.alloc
+	atomic.AddInt64(&a.stats.FreeRootNodeLocs, 1)
+	atomic.AddInt64(&t.allocStats.FreeRootNodeLocs, 1)
+	if a.pooled() {
+		rnl.next = freedRootNodeLoc
+		rootNodeLocPool.Put(rnl)
+		return
+	}
+	a.freeRootNodeLocLock.Lock()
+	rnl.next = a.freeRootNodeLocs
+	if rnl.next == nil {
+		rnl.next = freedRootNodeLoc
+	}
+	a.freeRootNodeLocs = rnl
+	atomic.AddInt64(&a.stats.CurFreeRootNodeLocs, 1)
+	a.freeRootNodeLocLock.Unlock()
 }
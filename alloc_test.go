@@ -0,0 +1,129 @@
+package gkvlite
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+func TestAllocStatsPerStore(t *testing.T) {
+	s, _ := NewStore(nil)
+	s2, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	s2.SetCollection("x", nil)
+	for i := 0; i < 100; i++ {
+		x.Set([]byte(strconv.Itoa(i)), []byte("v"))
+	}
+	for i := 0; i < 100; i += 2 {
+		x.Delete([]byte(strconv.Itoa(i)))
+	}
+	a, a2 := s.AllocStats(), s2.AllocStats()
+	if a.MkNodes == 0 || a.FreeNodes == 0 || a.CurFreeNodes == 0 {
+		t.Errorf("expected the store's allocations, got: %#v", a)
+	}
+	if a2.MkNodes != 0 || a2.FreeNodes != 0 || a2.CurFreeNodes != 0 {
+		t.Errorf("expected no allocations by the other store, got: %#v", a2)
+	}
+
+	// Snapshots share their Store's free lists.
+	ss := s.Snapshot()
+	x.Set([]byte("a"), []byte("A"))
+	if ss.alloc != s.alloc {
+		t.Errorf("expected a snapshot to share its store's allocator")
+	}
+	ss.Close()
+	if s.AllocStats().MkNodes <= a.MkNodes {
+		t.Errorf("expected more allocations")
+	}
+}
+
+func TestAllocPool(t *testing.T) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 100; i++ {
+		x.Set([]byte(strconv.Itoa(i)), []byte("v"))
+	}
+	x.Delete([]byte("0"))
+	if s.AllocStats().CurFreeNodes == 0 {
+		t.Errorf("expected free nodes")
+	}
+	s.SetAllocPool(true)
+	a := s.AllocStats()
+	if a.CurFreeNodes != 0 || a.CurFreeNodeLocs != 0 || a.CurFreeRootNodeLocs != 0 {
+		t.Errorf("expected the free lists to be dropped, got: %#v", a)
+	}
+	for j := 0; j < 3; j++ {
+		for i := 0; i < 100; i++ {
+			x.Set([]byte(strconv.Itoa(i)), []byte(fmt.Sprintf("v%d", j)))
+		}
+		for i := 0; i < 100; i += 3 {
+			x.Delete([]byte(strconv.Itoa(i)))
+		}
+	}
+	n := 0
+	x.VisitItemsAscend(nil, true, func(i *Item) bool {
+		k, _ := strconv.Atoi(string(i.Key))
+		if k%3 == 0 || string(i.Val) != "v2" {
+			t.Errorf("unexpected item: %q, %q", i.Key, i.Val)
+		}
+		n++
+		return true
+	})
+	if n != 66 {
+		t.Errorf("expected 66 items, got: %v", n)
+	}
+	a = s.AllocStats()
+	if a.FreeNodes == 0 || a.CurFreeNodes != 0 {
+		t.Errorf("expected nodes freed into the pool, got: %#v", a)
+	}
+
+	s.SetAllocPool(false)
+	x.Delete([]byte("1"))
+	if s.AllocStats().CurFreeNodes == 0 {
+		t.Errorf("expected free nodes again")
+	}
+}
+
+func TestDoubleFreeNodePool(t *testing.T) {
+	s, _ := NewStore(nil)
+	s.SetAllocPool(true)
+	x := s.SetCollection("x", bytes.Compare)
+	n := x.mkNode(nil, nil, nil, 1, 0)
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("expected panic with double free")
+		}
+	}()
+	s.alloc.freeNodeLock.Lock()
+	defer s.alloc.freeNodeLock.Unlock()
+	x.freeNode_unlocked(n, nil)
+	x.freeNode_unlocked(n, nil)
+}
+
+// Sets and deletes on a memory-only Store per goroutine, which used
+// to contend on the global free lists.
+func benchmarkConcurrentStores(b *testing.B, usePool bool) {
+	keys := perm(1000)
+	b.RunParallel(func(pb *testing.PB) {
+		s, _ := NewStore(nil)
+		s.SetAllocPool(usePool)
+		x := s.SetCollection("x", nil)
+		for i := 0; pb.Next(); i++ {
+			k := keys[i%len(keys)]
+			if (i/len(keys))%2 == 0 {
+				x.Set(k, k)
+			} else {
+				x.Delete(k)
+			}
+		}
+	})
+}
+
+func BenchmarkConcurrentStoresFreeLists(b *testing.B) {
+	benchmarkConcurrentStores(b, false)
+}
+
+func BenchmarkConcurrentStoresPool(b *testing.B) {
+	benchmarkConcurrentStores(b, true)
+}
@@ -0,0 +1,178 @@
+package gkvlite
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Configures when and how an AutoCompactor compacts a Store.
+type AutoCompactOptions struct {
+	// Path of the Store's file.  Compaction writes into a sibling
+	// file at Path + ".compact", which is then renamed onto Path.
+	Path string
+
+	// A compaction is needed when the fraction of dead bytes reaches
+	// DeadRatio (if > 0) and the file has at least MinFileSize bytes,
+	// or when the file reaches MaxFileSize bytes (if > 0).
+	DeadRatio   float64
+	MinFileSize int64
+	MaxFileSize int64
+
+	MinInterval   time.Duration // Min time between compactions.
+	CheckInterval time.Duration // Defaults to 1 minute.
+	Exact         bool          // Use exact, not estimated, SpaceUsage().
+
+	// Optional; creates the empty file at a path for the compacted
+	// Store, so it can be the same kind of StoreFile as the Store's,
+	// such as from OpenFile() or OpenMmapFile().  Defaults to an
+	// *os.File.
+	OpenFile func(path string) (StoreFile, error)
+
+	// Optional callbacks.  OnProgress is invoked after every
+	// compaction round with the number of changes copied in that
+	// round.  OnCompacted hands over the original file, which the app
+	// should close once its readers and snapshots are done with it.
+	// Without OnCompacted, the original file is closed right after the
+	// compaction, if it's an io.Closer, so apps with snapshots or
+	// readers that may span a compaction should use OnCompacted.
+	OnStart     func(before *SpaceUsage)
+	OnProgress  func(round, changes int)
+	OnCompacted func(oldFile StoreFile, before, after *SpaceUsage)
+	OnError     func(err error)
+}
+
+// An AutoCompactor runs Compact() in the background according to its
+// AutoCompactOptions thresholds.
+type AutoCompactor struct {
+	s    *Store
+	opts AutoCompactOptions
+	m    sync.Mutex // Serializes compactions.
+	last time.Time  // When the last compaction finished.
+	stop chan struct{}
+	done chan struct{}
+
+	stopOnce sync.Once
+}
+
+// Starts a goroutine that periodically checks whether the Store needs
+// a compaction.  Use AutoCompactor.Stop() to stop it.
+func (s *Store) StartAutoCompact(opts AutoCompactOptions) (*AutoCompactor, error) {
+	if s.readOnly {
+		return nil, errors.New("readonly, so cannot StartAutoCompact()")
+	}
+	if s.file() == nil {
+		return nil, errors.New("no file / in-memory only, so cannot StartAutoCompact()")
+	}
+	if opts.Path == "" {
+		return nil, errors.New("AutoCompactOptions.Path is required")
+	}
+	if opts.CheckInterval <= 0 {
+		opts.CheckInterval = time.Minute
+	}
+	a := &AutoCompactor{s: s, opts: opts,
+		stop: make(chan struct{}), done: make(chan struct{})}
+	go a.run()
+	return a, nil
+}
+
+func (a *AutoCompactor) run() {
+	defer close(a.done)
+	ticker := time.NewTicker(a.opts.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+			if _, err := a.Check(); err != nil && a.opts.OnError != nil {
+				a.opts.OnError(err)
+			}
+		}
+	}
+}
+
+// Stops the background goroutine, waiting for any in-flight compaction.
+// Later calls do nothing.
+func (a *AutoCompactor) Stop() {
+	a.stopOnce.Do(func() {
+		close(a.stop)
+		<-a.done
+	})
+}
+
+// Compacts the Store now if the thresholds are reached, returning
+// whether a compaction was done.
+func (a *AutoCompactor) Check() (compacted bool, err error) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if !a.last.IsZero() && time.Since(a.last) < a.opts.MinInterval {
+		return false, nil
+	}
+	before, err := a.s.SpaceUsage(a.opts.Exact)
+	if err != nil {
+		return false, err
+	}
+	if !a.needed(before) {
+		return false, nil
+	}
+	if a.opts.OnStart != nil {
+		a.opts.OnStart(before)
+	}
+	tmpPath := a.opts.Path + ".compact"
+	os.Remove(tmpPath)
+	dst, err := a.openFile(tmpPath)
+	if err != nil {
+		return false, err
+	}
+	oldFile := a.s.file()
+	if err = a.s.compact(dst, a.opts.OnProgress); err != nil {
+		closeFile(dst)
+		os.Remove(tmpPath)
+		return false, err
+	}
+	a.last = time.Now()
+	// The Store has switched to dst, so a failed rename leaves the
+	// compacted file at tmpPath instead of Path.
+	if err = os.Rename(tmpPath, a.opts.Path); err != nil {
+		return true, err
+	}
+	if a.opts.OnCompacted == nil {
+		return true, closeFile(oldFile)
+	}
+	after, err := a.s.SpaceUsage(a.opts.Exact)
+	if err != nil {
+		return true, err
+	}
+	a.opts.OnCompacted(oldFile, before, after)
+	return true, nil
+}
+
+func (a *AutoCompactor) openFile(path string) (StoreFile, error) {
+	if a.opts.OpenFile != nil {
+		return a.opts.OpenFile(path)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Closes a StoreFile if it's an io.Closer.
+func closeFile(f StoreFile) error {
+	if c, ok := f.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (a *AutoCompactor) needed(u *SpaceUsage) bool {
+	if a.opts.MaxFileSize > 0 && u.FileSize >= a.opts.MaxFileSize {
+		return true
+	}
+	return a.opts.DeadRatio > 0 && u.DeadRatio() >= a.opts.DeadRatio &&
+		u.FileSize >= a.opts.MinFileSize
+}
@@ -0,0 +1,163 @@
+package gkvlite
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func loadGarbage(s *Store, x *Collection, rounds int) {
+	for j := 0; j < rounds; j++ {
+		for i := 0; i < 100; i++ {
+			x.Set([]byte(fmt.Sprintf("%03d", i)), []byte(fmt.Sprintf("%d", j)))
+		}
+		s.Flush()
+	}
+}
+
+func TestAutoCompactCheck(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	defer os.Remove(fname + ".compact")
+	f, _ := os.Create(fname)
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	loadGarbage(s, x, 1)
+
+	mem, _ := NewStore(nil)
+	if _, err := mem.StartAutoCompact(AutoCompactOptions{Path: fname}); err == nil {
+		t.Errorf("expected memory-only StartAutoCompact to fail")
+	}
+	if _, err := s.StartAutoCompact(AutoCompactOptions{}); err == nil {
+		t.Errorf("expected StartAutoCompact without Path to fail")
+	}
+
+	var oldFile StoreFile
+	var before, after *SpaceUsage
+	rounds := 0
+	a, err := s.StartAutoCompact(AutoCompactOptions{
+		Path:          fname,
+		DeadRatio:     0.5,
+		MinInterval:   time.Hour,
+		CheckInterval: time.Hour,
+		OnProgress:    func(round, changes int) { rounds++ },
+		OnCompacted: func(o StoreFile, b, a *SpaceUsage) {
+			oldFile, before, after = o, b, a
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected StartAutoCompact to work, err: %v", err)
+	}
+	defer a.Stop()
+	compacted, err := a.Check()
+	if err != nil || compacted {
+		t.Errorf("expected no compaction without garbage, err: %v", err)
+	}
+	loadGarbage(s, x, 4)
+	compacted, err = a.Check()
+	if err != nil || !compacted {
+		t.Fatalf("expected compaction with garbage, err: %v", err)
+	}
+	if oldFile != f || rounds < 2 {
+		t.Errorf("expected OnCompacted with the old file, rounds: %v", rounds)
+	}
+	if before.DeadRatio() < 0.5 || after.DeadRatio() > 0.1 ||
+		after.FileSize >= before.FileSize {
+		t.Errorf("unexpected before: %#v, after: %#v", before, after)
+	}
+	f.Close()
+	loadGarbage(s, x, 4)
+	compacted, err = a.Check()
+	if err != nil || compacted {
+		t.Errorf("expected no compaction within MinInterval, err: %v", err)
+	}
+
+	f2, _ := os.Open(fname)
+	defer f2.Close()
+	s2, err := NewStore(f2)
+	if err != nil {
+		t.Fatalf("expected reopen after auto compaction to work, err: %v", err)
+	}
+	v, err := s2.GetCollection("x").Get([]byte("042"))
+	if err != nil || string(v) != "3" {
+		t.Errorf("expected compacted value, got: %s, err: %v", v, err)
+	}
+}
+
+func TestAutoCompactBackground(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	defer os.Remove(fname + ".compact")
+	f, _ := os.Create(fname)
+	defer f.Close()
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	loadGarbage(s, x, 1)
+
+	compacted := make(chan StoreFile, 1)
+	a, _ := s.StartAutoCompact(AutoCompactOptions{
+		Path:          fname,
+		MaxFileSize:   1,
+		MinInterval:   time.Hour,
+		CheckInterval: time.Millisecond,
+		OnCompacted:   func(o StoreFile, b, a *SpaceUsage) { compacted <- o },
+		OnError:       func(err error) { t.Errorf("unexpected error: %v", err) },
+	})
+	select {
+	case o := <-compacted:
+		if o != f {
+			t.Errorf("expected the original file to be handed over")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected a background compaction")
+	}
+	a.Stop()
+	a.Stop()
+	x.Set([]byte("zzz"), []byte("after"))
+	if err := s.Flush(); err != nil {
+		t.Errorf("expected Flush after auto compaction to work, err: %v", err)
+	}
+}
+
+func TestAutoCompactOpenFile(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	defer os.Remove(fname + ".compact")
+	f, _ := OpenFile(fname, OpenOptions{Create: true})
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	loadGarbage(s, x, 5)
+	var opened []string
+	a, _ := s.StartAutoCompact(AutoCompactOptions{
+		Path:          fname,
+		DeadRatio:     0.5,
+		CheckInterval: time.Hour,
+		OpenFile: func(path string) (StoreFile, error) {
+			opened = append(opened, path)
+			return OpenFile(path, OpenOptions{Create: true})
+		},
+	})
+	defer a.Stop()
+	compacted, err := a.Check()
+	if err != nil || !compacted {
+		t.Fatalf("expected compaction with garbage, err: %v", err)
+	}
+	if len(opened) != 1 || opened[0] != fname+".compact" {
+		t.Errorf("expected OpenFile of the compact file, got: %v", opened)
+	}
+	if _, ok := s.file().(*File); !ok || s.file() == f {
+		t.Errorf("expected the Store to switch to an opened *File")
+	}
+	if _, err = f.ReadAt(make([]byte, 1), 0); err == nil {
+		t.Errorf("expected the old file to be closed without OnCompacted")
+	}
+	defer s.file().(*File).Close()
+	v, err := s.GetCollection("x").Get([]byte("042"))
+	if err != nil || string(v) != "4" {
+		t.Errorf("expected compacted value, got: %s, err: %v", v, err)
+	}
+}
@@ -0,0 +1,129 @@
+package gkvlite
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Configures when an AutoFlusher flushes a Store.  A Flush() happens
+// every Interval (if > 0) when there are unflushed mutations, which
+// include SetCollection()'s and RemoveCollection()'s, and as
+// soon as the mutations since the last Flush() reach MaxDirtyItems or
+// their key and value bytes reach MaxDirtyBytes (if > 0), which bounds
+// the data lost on a crash.
+type AutoFlushOptions struct {
+	Interval      time.Duration
+	MaxDirtyBytes int64
+	MaxDirtyItems int64
+	Sync          bool // Flush with FlushOptions.Sync.
+	OnError       func(err error)
+}
+
+// An AutoFlusher runs Flush() in the background according to its
+// AutoFlushOptions thresholds.  The AutoFlusher's goroutine is then
+// the Store's flusher, so apps shouldn't also Flush() on their own.
+type AutoFlusher struct {
+	s    *Store
+	opts AutoFlushOptions
+	kick chan struct{} // Signaled when a threshold is reached.
+	stop chan struct{}
+	done chan struct{}
+
+	stopOnce sync.Once
+	stopErr  error // The result of the first Stop().
+}
+
+// Starts a goroutine that flushes the Store according to the options.
+// Use AutoFlusher.Stop() to stop it.  A Store has at most one
+// AutoFlusher at a time.
+func (s *Store) StartAutoFlush(opts AutoFlushOptions) (*AutoFlusher, error) {
+	if s.readOnly {
+		return nil, errors.New("readonly, so cannot StartAutoFlush()")
+	}
+	if opts.Interval <= 0 && opts.MaxDirtyBytes <= 0 && opts.MaxDirtyItems <= 0 {
+		return nil, errors.New("AutoFlushOptions needs an Interval or max dirty threshold")
+	}
+	s.flushLock.Lock() // Before the file, which Compact() may switch.
+	file := s.file()
+	s.flushLock.Unlock()
+	if file == nil {
+		return nil, errors.New("no file / in-memory only, so cannot StartAutoFlush()")
+	}
+	if opts.Sync {
+		if _, ok := file.(Syncer); !ok {
+			return nil, errors.New("StoreFile is not a Syncer, so cannot Sync")
+		}
+	}
+	a := &AutoFlusher{s: s, opts: opts, kick: make(chan struct{}, 1),
+		stop: make(chan struct{}), done: make(chan struct{})}
+	if !atomic.CompareAndSwapPointer(&s.autoFlusher, nil, unsafe.Pointer(a)) {
+		return nil, errors.New("AutoFlusher already started")
+	}
+	go a.run()
+	return a, nil
+}
+
+func (a *AutoFlusher) run() {
+	defer close(a.done)
+	var tick <-chan time.Time
+	if a.opts.Interval > 0 {
+		ticker := time.NewTicker(a.opts.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-tick:
+		case <-a.kick:
+		}
+		if err := a.flush(); err != nil && a.opts.OnError != nil {
+			a.opts.OnError(err)
+		}
+	}
+}
+
+// Stops the background goroutine, then does a final Flush() of any
+// unflushed mutations.  Later calls return the first call's result.
+func (a *AutoFlusher) Stop() error {
+	a.stopOnce.Do(func() {
+		close(a.stop)
+		<-a.done
+		atomic.CompareAndSwapPointer(&a.s.autoFlusher, unsafe.Pointer(a), nil)
+		a.stopErr = a.flush()
+	})
+	return a.stopErr
+}
+
+func (a *AutoFlusher) flush() error {
+	if atomic.LoadInt64(&a.s.dirtyItems) <= 0 &&
+		atomic.LoadInt32(&a.s.dirtyColls) == 0 {
+		return nil
+	}
+	return a.s.FlushEx(FlushOptions{Sync: a.opts.Sync})
+}
+
+// Wakes the AutoFlusher's goroutine if a threshold is reached.
+func (a *AutoFlusher) noteDirty(dirtyItems, dirtyBytes int64) {
+	if a.opts.MaxDirtyItems > 0 && dirtyItems >= a.opts.MaxDirtyItems ||
+		a.opts.MaxDirtyBytes > 0 && dirtyBytes >= a.opts.MaxDirtyBytes {
+		select {
+		case a.kick <- struct{}{}:
+		default: // Already signaled.
+		}
+	}
+}
+
+// Counts a mutation of numBytes key and value bytes towards the
+// AutoFlusher's thresholds.
+func (s *Store) noteDirty(numBytes int64) {
+	dirtyItems := atomic.AddInt64(&s.dirtyItems, 1)
+	dirtyBytes := atomic.AddInt64(&s.dirtyBytes, numBytes)
+	if a := (*AutoFlusher)(atomic.LoadPointer(&s.autoFlusher)); a != nil {
+		a.noteDirty(dirtyItems, dirtyBytes)
+	}
+}
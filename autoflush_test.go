@@ -0,0 +1,138 @@
+package gkvlite
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// Waits for the Store's commit seq to reach seq.
+func waitForSeq(s *Store, seq uint64) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if ci := s.LastCommitInfo(); ci != nil && ci.Seq >= seq {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+func TestAutoFlushThresholds(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	s, _ := NewStore(f)
+
+	mem, _ := NewStore(nil)
+	if _, err := mem.StartAutoFlush(AutoFlushOptions{Interval: time.Hour}); err == nil {
+		t.Errorf("expected memory-only StartAutoFlush to fail")
+	}
+	if _, err := s.StartAutoFlush(AutoFlushOptions{}); err == nil {
+		t.Errorf("expected StartAutoFlush without thresholds to fail")
+	}
+	a, err := s.StartAutoFlush(AutoFlushOptions{Interval: time.Hour, Sync: true})
+	if err != nil {
+		t.Fatalf("expected StartAutoFlush with Sync on an os.File to work")
+	}
+	if _, err = s.StartAutoFlush(AutoFlushOptions{Interval: time.Hour}); err == nil {
+		t.Errorf("expected a second StartAutoFlush to fail")
+	}
+	if err = a.Stop(); err != nil || s.LastCommitInfo() != nil {
+		t.Errorf("expected Stop without mutations not to flush, err: %v", err)
+	}
+
+	x := s.SetCollection("x", nil)
+	a, err = s.StartAutoFlush(AutoFlushOptions{MaxDirtyItems: 10,
+		MaxDirtyBytes: 1000})
+	if err != nil {
+		t.Fatalf("expected StartAutoFlush to work, err: %v", err)
+	}
+	for i := 0; i < 9; i++ {
+		x.Set([]byte(fmt.Sprintf("%d", i)), []byte("v"))
+	}
+	time.Sleep(10 * time.Millisecond)
+	if s.LastCommitInfo() != nil {
+		t.Errorf("expected no flush below MaxDirtyItems")
+	}
+	x.Delete([]byte("0"))
+	if !waitForSeq(s, 0) {
+		t.Fatalf("expected a flush at MaxDirtyItems")
+	}
+	x.Set([]byte("big"), make([]byte, 1000))
+	if !waitForSeq(s, 1) {
+		t.Fatalf("expected a flush at MaxDirtyBytes")
+	}
+	x.Set([]byte("last"), []byte("v"))
+	if err = a.Stop(); err != nil {
+		t.Errorf("expected Stop to work, err: %v", err)
+	}
+	if s.LastCommitInfo().Seq != 2 || s.dirtyItems != 0 || s.dirtyBytes != 0 {
+		t.Errorf("expected a final flush on Stop, seq: %v, dirty: %v/%v",
+			s.LastCommitInfo().Seq, s.dirtyItems, s.dirtyBytes)
+	}
+}
+
+func TestAutoFlushInterval(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	s, _ := NewStore(f)
+	var errs []error
+	a, err := s.StartAutoFlush(AutoFlushOptions{Interval: time.Millisecond,
+		OnError: func(err error) { errs = append(errs, err) }})
+	if err != nil {
+		t.Fatalf("expected StartAutoFlush to work, err: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if s.LastCommitInfo() != nil {
+		t.Errorf("expected no flush without mutations")
+	}
+	x := s.SetCollection("x", nil)
+	x.Set([]byte("a"), []byte("A"))
+	if !waitForSeq(s, 0) {
+		t.Fatalf("expected a flush after the Interval")
+	}
+	if err = a.Stop(); err != nil || len(errs) != 0 {
+		t.Errorf("expected no errors, err: %v, errs: %v", err, errs)
+	}
+	if a, err = s.StartAutoFlush(AutoFlushOptions{Interval: time.Hour}); err != nil {
+		t.Fatalf("expected StartAutoFlush after Stop to work, err: %v", err)
+	}
+	a.Stop()
+}
+
+func TestAutoFlushCollections(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	s, _ := NewStore(f)
+	s.SetCollection("x", nil).Set([]byte("a"), []byte("A"))
+	s.Flush()
+	a, err := s.StartAutoFlush(AutoFlushOptions{Interval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("expected StartAutoFlush to work, err: %v", err)
+	}
+	s.RemoveCollection("x")
+	s.SetCollection("y", nil)
+	if !waitForSeq(s, 1) {
+		t.Fatalf("expected a flush of the collection changes")
+	}
+	s.RemoveCollection("y")
+	if err = a.Stop(); err != nil {
+		t.Errorf("expected Stop to work, err: %v", err)
+	}
+	if err = a.Stop(); err != nil {
+		t.Errorf("expected a second Stop to work, err: %v", err)
+	}
+	s2, _ := NewStore(f)
+	if names := s2.GetCollectionNames(); len(names) != 0 {
+		t.Errorf("expected no collections after reopen, got: %v", names)
+	}
+}
@@ -0,0 +1,202 @@
+package gkvlite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// An increment is a header followed by a contiguous range of bytes
+// appended to a store file.  The header holds MAGIC_INC, the file
+// offset where the range starts, the length of the range, and the
+// identity of the file, or 0 if unknown.
+var MAGIC_INC []byte = []byte("6i7n8c")
+
+var incHdrLen int = len(MAGIC_INC) + 8 + 8 + 8
+
+// Writes an increment holding all the bytes appended to the store
+// file from lastOffset up to the end of the last root record.  The
+// returned nextOffset should be used as the lastOffset of the next
+// BackupSince().  Use a lastOffset of 0 for a full backup.  The
+// lastOffset must be the end of a root record of the current file, so
+// after a Compact(), which switches files, take a full backup.  In log
+// mode, the log records since the last checkpoint are after the last
+// root record, so they're not backed up until a Flush() with
+// FlushOptions.Checkpoint.
+func (s *Store) BackupSince(lastOffset int64, w io.Writer) (
+	nextOffset int64, err error) {
+	if s.file() == nil {
+		return 0, errors.New("no file / in-memory only, so cannot BackupSince()")
+	}
+	ci := s.LastCommitInfo()
+	nextOffset, err = s.rootsEnd(ci)
+	if err != nil {
+		return 0, err
+	}
+	if lastOffset < 0 || lastOffset > nextOffset {
+		return 0, fmt.Errorf("lastOffset: %v is beyond last root end: %v",
+			lastOffset, nextOffset)
+	}
+	if err = s.checkRootsEndAt(lastOffset); err != nil {
+		return 0, err
+	}
+	if err = s.writeIncrement(w, ci, lastOffset, nextOffset); err != nil {
+		return 0, err
+	}
+	return nextOffset, nil
+}
+
+// Returns the end of the root record of a CommitInfo, which is 0 for
+// a nil CommitInfo.
+func (s *Store) rootsEnd(ci *CommitInfo) (int64, error) {
+	if ci == nil {
+		return 0, nil
+	}
+	data, err := s.readRootsAt(ci.Offset)
+	if err != nil {
+		return 0, err
+	}
+	return ci.Offset + int64(len(data)+rootsEndLen), nil
+}
+
+// Checks that offset is 0 or the end of a root record of the current
+// file, as an offset from before a Compact() is into another file.
+func (s *Store) checkRootsEndAt(offset int64) error {
+	if offset == 0 {
+		return nil
+	}
+	end := int64(-1)
+	var errEnd error
+	err := s.VisitCommits(func(ci *CommitInfo) bool {
+		if ci.Offset >= offset {
+			return true
+		}
+		end, errEnd = s.rootsEnd(ci)
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	if errEnd != nil {
+		return errEnd
+	}
+	if end != offset {
+		return fmt.Errorf("offset: %v is not the end of a root record"+
+			" of the current file", offset)
+	}
+	return nil
+}
+
+// Writes an increment holding the [start, end) bytes of the store
+// file, whose last commit is ci.
+func (s *Store) writeIncrement(w io.Writer, ci *CommitInfo, start, end int64) error {
+	hdr := make([]byte, incHdrLen)
+	copy(hdr, MAGIC_INC)
+	binary.BigEndian.PutUint64(hdr[len(MAGIC_INC):], uint64(start))
+	binary.BigEndian.PutUint64(hdr[len(MAGIC_INC)+8:], uint64(end-start))
+	if ci != nil {
+		binary.BigEndian.PutUint64(hdr[len(MAGIC_INC)+16:], ci.fileID)
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(w, io.NewSectionReader(s.file(), start, end-start))
+	return err
+}
+
+// Appends an increment from BackupSince() to a file, which must have
+// been restored up to exactly the increment's starting offset, from
+// the same store file.  The file is truncated back to its original
+// size if the increment does not end in a valid root record.
+func RestoreIncrement(file StoreFile, r io.Reader) error {
+	_, _, err := restoreIncrement(file, r)
+	return err
+}
+
+// Returns the [start, end) range of the file that was restored.
+func restoreIncrement(file StoreFile, r io.Reader) (start, end int64, err error) {
+	hdr := make([]byte, incHdrLen)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return 0, 0, err
+	}
+	if !bytes.Equal(MAGIC_INC, hdr[:len(MAGIC_INC)]) {
+		return 0, 0, errors.New("not an increment; missing MAGIC_INC")
+	}
+	start = int64(binary.BigEndian.Uint64(hdr[len(MAGIC_INC):]))
+	length := int64(binary.BigEndian.Uint64(hdr[len(MAGIC_INC)+8:]))
+	fileID := binary.BigEndian.Uint64(hdr[len(MAGIC_INC)+16:])
+	finfo, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if finfo.Size() != start {
+		return 0, 0, fmt.Errorf("increment starts at offset: %v,"+
+			" but file size is: %v", start, finfo.Size())
+	}
+	if start > 0 && fileID != 0 {
+		ci, err := checkRootsEnd(file, 0, start)
+		if err != nil {
+			return 0, 0, fmt.Errorf("restored file: %v", err)
+		}
+		if ci.fileID != 0 && ci.fileID != fileID {
+			return 0, 0, fmt.Errorf("increment is from file: %x,"+
+				" but the restored file is: %x", fileID, ci.fileID)
+		}
+	}
+	if length == 0 {
+		return start, start, nil
+	}
+	if length < rootsLen {
+		return 0, 0, fmt.Errorf("increment length: %v is too short"+
+			" for a root record", length)
+	}
+	if _, err = io.CopyN(&offsetWriter{w: file, offset: start}, r, length); err == nil {
+		_, err = checkRootsEnd(file, start, start+length)
+	}
+	if err != nil {
+		if errTruncate := file.Truncate(start); errTruncate != nil {
+			return 0, 0, errTruncate
+		}
+		return 0, 0, err
+	}
+	return start, start + length, nil
+}
+
+// Checks that the bytes in [start, end) of a file end in a valid
+// root record, and returns its CommitInfo.
+func checkRootsEnd(file StoreFile, start, end int64) (*CommitInfo, error) {
+	rootsEnd := make([]byte, rootsEndLen)
+	if _, err := file.ReadAt(rootsEnd, end-int64(rootsEndLen)); err != nil {
+		return nil, err
+	}
+	offset := int64(binary.BigEndian.Uint64(rootsEnd[:8]))
+	if offset < start || offset > end-rootsLen {
+		return nil, fmt.Errorf("increment does not end in a root record,"+
+			" root offset: %v", offset)
+	}
+	s := &Store{files: newFileGens(file, VERSION)}
+	data, err := s.readRootsAt(offset)
+	if err != nil {
+		return nil, err
+	}
+	if offset+int64(len(data)+rootsEndLen) != end {
+		return nil, fmt.Errorf("increment does not end in a root record,"+
+			" root offset: %v", offset)
+	}
+	_, ci, _, err := s.parseRoots(offset, data, false)
+	return ci, err
+}
+
+// Adapts a WriterAt into a Writer that writes sequentially from an offset.
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) Write(p []byte) (n int, err error) {
+	n, err = o.w.WriteAt(p, o.offset)
+	o.offset += int64(n)
+	return n, err
+}
@@ -0,0 +1,206 @@
+package gkvlite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestBackupSince(t *testing.T) {
+	fname := "tmp.test"
+	bname := "tmp-backup.test"
+	os.Remove(fname)
+	os.Remove(bname)
+	defer os.Remove(fname)
+	defer os.Remove(bname)
+	f, _ := os.Create(fname)
+	s, _ := NewStore(f)
+	b, _ := os.Create(bname)
+
+	var inc bytes.Buffer
+	next, err := s.BackupSince(0, &inc)
+	if err != nil || next != 0 {
+		t.Errorf("expected empty backup to work, next: %v, err: %v", next, err)
+	}
+	if err = RestoreIncrement(b, &inc); err != nil {
+		t.Errorf("expected empty restore to work, err: %v", err)
+	}
+
+	x := s.SetCollection("x", nil)
+	last := int64(0)
+	for _, k := range []string{"a", "b", "c"} {
+		x.Set([]byte(k), []byte(k))
+		s.Flush()
+		x.Set([]byte(k+k), []byte(k)) // Unflushed, so not backed up.
+		inc.Reset()
+		next, err = s.BackupSince(last, &inc)
+		if err != nil || next <= last {
+			t.Errorf("expected backup to work, next: %v, err: %v", next, err)
+		}
+		if int64(inc.Len()) != int64(incHdrLen)+next-last {
+			t.Errorf("unexpected increment length: %v", inc.Len())
+		}
+		if err = RestoreIncrement(b, &inc); err != nil {
+			t.Errorf("expected restore to work, err: %v", err)
+		}
+		last = next
+	}
+
+	bs, err := NewStore(b)
+	if err != nil {
+		t.Errorf("expected restored store to open, err: %v", err)
+	}
+	numItems, _, err := bs.GetCollection("x").GetTotals()
+	if err != nil || numItems != 5 {
+		t.Errorf("expected 5 restored items, got: %v, err: %v", numItems, err)
+	}
+	if bs.LastCommitInfo().Seq != 2 {
+		t.Errorf("expected restored seq 2, got: %#v", bs.LastCommitInfo())
+	}
+
+	// An increment that doesn't start at the end of the file.
+	inc.Reset()
+	s.BackupSince(0, &inc)
+	if err = RestoreIncrement(b, &inc); err == nil {
+		t.Errorf("expected non-contiguous restore to fail")
+	}
+	if _, err = s.BackupSince(last+1, &inc); err == nil {
+		t.Errorf("expected backup beyond last root to fail")
+	}
+
+	// An increment that doesn't end in a root record.
+	x.Set([]byte("d"), []byte("d"))
+	s.Flush()
+	inc.Reset()
+	s.BackupSince(last, &inc)
+	inc.Truncate(inc.Len() - 1)
+	binfo, _ := b.Stat()
+	if err = RestoreIncrement(b, &inc); err == nil {
+		t.Errorf("expected torn increment restore to fail")
+	}
+	binfo2, _ := b.Stat()
+	if binfo2.Size() != binfo.Size() {
+		t.Errorf("expected failed restore to truncate, got: %v vs %v",
+			binfo2.Size(), binfo.Size())
+	}
+	if err = RestoreIncrement(b, bytes.NewBufferString("not an increment...")); err == nil {
+		t.Errorf("expected restore of garbage to fail")
+	}
+}
+
+func TestBackupSinceCompact(t *testing.T) {
+	fname, cname, bname := "tmp.test", "tmp-compact.test", "tmp-backup.test"
+	defer os.Remove(fname)
+	defer os.Remove(cname)
+	defer os.Remove(bname)
+	// With 1 flush, the compacted file's first root record may end at
+	// the lastOffset too, which only the file ids tell apart.
+	for _, flushes := range []int{1, 5} {
+		os.Remove(fname)
+		os.Remove(cname)
+		os.Remove(bname)
+		f, _ := os.Create(fname)
+		c, _ := os.Create(cname)
+		b, _ := os.Create(bname)
+		s, _ := NewStore(f)
+		x := s.SetCollection("x", nil)
+		for i := 0; i < flushes; i++ {
+			x.Set([]byte("a"), []byte(strconv.Itoa(i)))
+			s.Flush()
+		}
+		var inc bytes.Buffer
+		last, err := s.BackupSince(0, &inc)
+		if err != nil {
+			t.Fatalf("expected backup to work, err: %v", err)
+		}
+		RestoreIncrement(b, &inc)
+		binfo, _ := b.Stat()
+		if _, err = s.BackupSince(last-1, &inc); err == nil {
+			t.Errorf("expected backup since a non root end to fail")
+		}
+
+		// After a Compact(), the lastOffset is into the old file, where
+		// a root record of the new file may end too, so either
+		// BackupSince() or RestoreIncrement() rejects it.
+		if err = s.Compact(c); err != nil {
+			t.Fatalf("expected Compact to work, err: %v", err)
+		}
+		if _, err = s.BackupSince(last, &inc); flushes > 1 && err == nil {
+			t.Errorf("expected backup since an offset of the old file to fail")
+		}
+		for i := 0; i < 200; i++ {
+			s.GetCollection("x").Set([]byte(strconv.Itoa(i)), []byte("v"))
+			s.Flush()
+		}
+		inc.Reset()
+		_, err = s.BackupSince(last, &inc)
+		if err == nil {
+			if err = RestoreIncrement(b, &inc); err == nil {
+				t.Errorf("expected restore of the compacted file's increment to fail")
+			}
+		}
+		if binfo2, _ := b.Stat(); binfo2.Size() != binfo.Size() {
+			t.Errorf("expected no change to the restored file")
+		}
+		bs, _ := NewStore(b)
+		v, err := bs.GetCollection("x").Get([]byte("a"))
+		if err != nil || string(v) != strconv.Itoa(flushes-1) {
+			t.Errorf("expected the restored item, got: %q, err: %v", v, err)
+		}
+	}
+}
+
+func TestRestoreIncrementFileID(t *testing.T) {
+	fname, f2name, bname := "tmp.test", "tmp-2.test", "tmp-backup.test"
+	for _, n := range []string{fname, f2name, bname} {
+		os.Remove(n)
+		defer os.Remove(n)
+	}
+	f, _ := os.Create(fname)
+	f2, _ := os.Create(f2name)
+	b, _ := os.Create(bname)
+	s, _ := NewStore(f)
+	s2, _ := NewStore(f2)
+	for _, st := range []*Store{s, s2} {
+		st.SetCollection("x", nil).Set([]byte("a"), []byte("a"))
+		st.Flush()
+	}
+	id := s.LastCommitInfo().fileID
+	if id == 0 || id == s2.LastCommitInfo().fileID {
+		t.Errorf("expected distinct file ids")
+	}
+	var inc bytes.Buffer
+	last, _ := s.BackupSince(0, &inc)
+	if err := RestoreIncrement(b, &inc); err != nil {
+		t.Fatalf("expected restore to work, err: %v", err)
+	}
+	s.GetCollection("x").Set([]byte("b"), []byte("b"))
+	s.Flush()
+	if s.LastCommitInfo().fileID != id {
+		t.Errorf("expected the file id to carry over")
+	}
+	inc.Reset()
+	if _, err := s.BackupSince(last, &inc); err != nil {
+		t.Fatalf("expected backup to work, err: %v", err)
+	}
+
+	// The increment of another file, at the same offsets.
+	other := append([]byte(nil), inc.Bytes()...)
+	binary.BigEndian.PutUint64(other[len(MAGIC_INC)+16:], id+1)
+	binfo, _ := b.Stat()
+	if err := RestoreIncrement(b, bytes.NewReader(other)); err == nil {
+		t.Errorf("expected restore of another file's increment to fail")
+	}
+	if binfo2, _ := b.Stat(); binfo2.Size() != binfo.Size() {
+		t.Errorf("expected no change to the restored file")
+	}
+	if err := RestoreIncrement(b, &inc); err != nil {
+		t.Errorf("expected restore to work, err: %v", err)
+	}
+	bs, _ := NewStore(b)
+	if bs.LastCommitInfo().fileID != id {
+		t.Errorf("expected the restored file id")
+	}
+}
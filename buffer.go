@@ -0,0 +1,222 @@
+package gkvlite
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Buffers the item and node writes of a Flush(), so they reach the
+// StoreFile in a few large writes instead of a write per record (and a
+// second write per item value).  As the buffered bytes are past the
+// file's end, the buffer also serves reads of them, by standing in for
+// the current file generation while it's in use.
+type writeBuffer struct {
+	StoreFile // The Store's file, for Stat() and Truncate().
+
+	m     sync.Mutex // Protects the fields below.
+	buf   []byte     // Bytes for the file region starting at start.
+	start int64
+	size  int // The buffer size, where regions end at multiples of size.
+}
+
+// Sets the size of the buffer that a Flush() serializes its item and
+// node records into, so a Flush() issues one WriteAt per size bytes
+// instead of one or two per record, or disables buffering when size
+// is 0, which is the default.  ItemValWrite callbacks still work, and
+// may write anywhere in their value's place.
+func (s *Store) SetFlushBufferSize(size int) error {
+	if size < 0 {
+		return errors.New("flush buffer size must be non-negative")
+	}
+	s.flushLock.Lock()
+	s.bufferSize = size
+	s.flushLock.Unlock()
+	return nil
+}
+
+// Returns where item and node records are written; the flushLock must
+// be held.
+func (s *Store) writer() StoreFile {
+	if s.wbuf != nil {
+		return s.wbuf
+	}
+	return s.file()
+}
+
+// Where item and node records are appended, at the atomic pos.
+type recWriter struct {
+	w   StoreFile
+	pos *int64
+}
+
+// Returns a recWriter that appends to the Store's file; the flushLock
+// must be held.
+func (s *Store) recWriter() *recWriter {
+	return &recWriter{w: s.writer(), pos: &s.size}
+}
+
+// Starts buffering the writes, if configured; the flushLock must be
+// held.  The returned func stops buffering, writing out the buffer.
+func (s *Store) startBuffer() func() error {
+	if s.bufferSize <= 0 || s.wbuf != nil {
+		return func() error { return nil }
+	}
+	b := &writeBuffer{StoreFile: s.file(), size: s.bufferSize,
+		start: atomic.LoadInt64(&s.size)}
+	s.wbuf = b
+	s.setFileOfGen(b)
+	return func() error {
+		err := b.flush()
+		s.wbuf = nil
+		s.setFileOfGen(s.file())
+		return err
+	}
+}
+
+// Writes out any buffered writes; the flushLock must be held.
+func (s *Store) flushBuffer() error {
+	if s.wbuf != nil {
+		return s.wbuf.flush()
+	}
+	return nil
+}
+
+// Sets what reads of the current file generation go to.
+func (s *Store) setFileOfGen(file StoreFile) {
+	files := append([]fileGen(nil), *(*[]fileGen)(atomic.LoadPointer(&s.files))...)
+	files[len(files)-1].file = file
+	atomic.StorePointer(&s.files, unsafe.Pointer(&files))
+}
+
+// Returns the end of the region that starts at start, so that later
+// regions are aligned to the buffer size.
+func (b *writeBuffer) regionEnd(start int64) int64 {
+	return start + int64(b.size) - start%int64(b.size)
+}
+
+// The buffer holds up to two regions, as an item's header is written
+// after its value, so writes are not always in order.  Writes before
+// the buffered bytes, such as the header of an item whose value
+// started a new region, go directly to the file.
+func (b *writeBuffer) WriteAt(p []byte, off int64) (int, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	n := len(p)
+	if off < b.start {
+		k := len(p)
+		if off+int64(k) > b.start {
+			k = int(b.start - off)
+		}
+		if _, err := b.StoreFile.WriteAt(p[:k], off); err != nil {
+			return 0, err
+		}
+		p, off = p[k:], b.start
+		if len(p) == 0 {
+			return n, nil
+		}
+	}
+	end := off + int64(len(p))
+	if len(p) > b.size { // Too large to buffer.
+		if err := b.flushLocked(); err != nil {
+			return 0, err
+		}
+		if _, err := b.StoreFile.WriteAt(p, off); err != nil {
+			return 0, err
+		}
+		if end > b.start {
+			b.start = end
+		}
+		return n, nil
+	}
+	if off > b.start+int64(len(b.buf)+b.size) { // Far ahead.
+		if err := b.flushLocked(); err != nil {
+			return 0, err
+		}
+		b.start = off
+	}
+	for end > b.regionEnd(b.start)+int64(b.size) {
+		if err := b.flushRegion(); err != nil {
+			return 0, err
+		}
+	}
+	if m := int(end - b.start); m > len(b.buf) {
+		if m > cap(b.buf) {
+			buf := make([]byte, len(b.buf), 2*b.size)
+			copy(buf, b.buf)
+			b.buf = buf
+		}
+		k := len(b.buf)
+		b.buf = b.buf[:m]
+		for i := k; i < m; i++ {
+			b.buf[i] = 0 // Any gap is written by a later write.
+		}
+	}
+	copy(b.buf[off-b.start:], p)
+	return n, nil
+}
+
+// Writes out the first region of the buffer.
+func (b *writeBuffer) flushRegion() error {
+	re := b.regionEnd(b.start)
+	k := len(b.buf)
+	if int64(k) > re-b.start {
+		k = int(re - b.start)
+	}
+	if k > 0 {
+		if _, err := b.StoreFile.WriteAt(b.buf[:k], b.start); err != nil {
+			return err
+		}
+	}
+	b.buf = b.buf[:copy(b.buf, b.buf[k:])]
+	b.start = re
+	return nil
+}
+
+func (b *writeBuffer) ReadAt(p []byte, off int64) (int, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	bufEnd := b.start + int64(len(b.buf))
+	end := off + int64(len(p))
+	if end <= b.start || off >= bufEnd {
+		return b.StoreFile.ReadAt(p, off)
+	}
+	if off < b.start {
+		if _, err := b.StoreFile.ReadAt(p[:b.start-off], off); err != nil {
+			return 0, err
+		}
+	}
+	from, to := off, end
+	if from < b.start {
+		from = b.start
+	}
+	if to > bufEnd {
+		to = bufEnd
+	}
+	copy(p[from-off:to-off], b.buf[from-b.start:to-b.start])
+	if end > bufEnd {
+		if _, err := b.StoreFile.ReadAt(p[bufEnd-off:], bufEnd); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (b *writeBuffer) flush() error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.flushLocked()
+}
+
+func (b *writeBuffer) flushLocked() error {
+	if len(b.buf) == 0 {
+		return nil
+	}
+	if _, err := b.StoreFile.WriteAt(b.buf, b.start); err != nil {
+		return err
+	}
+	b.start += int64(len(b.buf))
+	b.buf = b.buf[:0]
+	return nil
+}
@@ -0,0 +1,131 @@
+package gkvlite
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+)
+
+func bufferedFlushes(t *testing.T, bufferSize int,
+	callbacks StoreCallbacks) (*mockfile, []int64) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	f, _ := os.Create(fname)
+	var offsets []int64
+	m := &mockfile{f: f}
+	m.writeat = func(p []byte, off int64) (int, error) {
+		offsets = append(offsets, off)
+		return f.WriteAt(p, off)
+	}
+	s, _ := NewStoreEx(m, callbacks)
+	if err := s.SetFlushBufferSize(bufferSize); err != nil {
+		t.Fatalf("expected SetFlushBufferSize to work, err: %v", err)
+	}
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 1000; i++ {
+		x.Set([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("v%d", i)))
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, err: %v", err)
+	}
+	s2, err := NewStoreEx(f, callbacks)
+	if err != nil {
+		t.Fatalf("expected reopen to work, err: %v", err)
+	}
+	for i := 0; i < 1000; i += 99 {
+		v, err := s2.GetCollection("x").Get([]byte(fmt.Sprintf("%04d", i)))
+		if err != nil || string(v) != fmt.Sprintf("v%d", i) {
+			t.Errorf("expected value %d, got: %q, err: %v", i, v, err)
+		}
+	}
+	if rep, err := s2.Verify(VerifyOptions{Values: true}); err != nil || !rep.OK() {
+		t.Errorf("expected no problems, got: %v, err: %v", rep.Problems, err)
+	}
+	return m, offsets
+}
+
+func TestFlushBuffer(t *testing.T) {
+	defer os.Remove("tmp.test")
+	m, _ := bufferedFlushes(t, 0, StoreCallbacks{})
+	if m.numWriteAt < 2000 {
+		t.Errorf("expected a write per record without a buffer, got: %v", m.numWriteAt)
+	}
+	size := 16 * 1024
+	m, offsets := bufferedFlushes(t, size, StoreCallbacks{})
+	if m.numWriteAt > 10 {
+		t.Errorf("expected few writes with a buffer, got: %v", m.numWriteAt)
+	}
+	for _, off := range offsets[1 : len(offsets)-1] { // But the roots.
+		if off%int64(size) != 0 {
+			t.Errorf("expected aligned writes, got offsets: %v", offsets)
+		}
+	}
+
+	// An ItemValWrite callback that writes its value backwards.
+	m, _ = bufferedFlushes(t, size, StoreCallbacks{
+		ItemValWrite: func(c *Collection, i *Item, w io.WriterAt, offset int64) error {
+			for j := len(i.Val) - 1; j >= 0; j-- {
+				if _, err := w.WriteAt(i.Val[j:j+1], offset+int64(j)); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+	if m.numWriteAt > 10 {
+		t.Errorf("expected few writes with an ItemValWrite callback, got: %v",
+			m.numWriteAt)
+	}
+
+	s, _ := NewStore(nil)
+	if err := s.SetFlushBufferSize(-1); err == nil {
+		t.Errorf("expected a negative buffer size to fail")
+	}
+}
+
+func TestFlushBufferConcurrentReads(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	s, _ := NewStore(f)
+	s.SetFlushBufferSize(4096)
+	x := s.SetCollection("x", nil)
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			// Evicted items that were just written are read back,
+			// maybe from the buffer.
+			x.EvictSomeItems()
+			x.VisitItemsAscend(nil, true, func(i *Item) bool {
+				if string(i.Val) != "v"+string(i.Key) {
+					t.Errorf("unexpected item: %q, %q", i.Key, i.Val)
+					return false
+				}
+				return true
+			})
+		}
+	}()
+	for j := 0; j < 20; j++ {
+		for i := 0; i < 100; i++ {
+			k := fmt.Sprintf("%d-%d", j, i)
+			x.Set([]byte(k), []byte("v"+k))
+		}
+		if err := s.Flush(); err != nil {
+			t.Errorf("expected Flush to work, err: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,235 @@
+package gkvlite
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// A StoreFile that caches the blocks read from another StoreFile in
+// memory, evicting the least recently used blocks when over capacity.
+// Writes and truncates go straight to the other StoreFile, and drop the
+// cached blocks they change.  A CachedFile is as safe for concurrent
+// readers and a single writer as the StoreFile it wraps.
+type CachedFile struct {
+	file      StoreFile
+	blockSize int64
+	capacity  int // In blocks.
+
+	m      sync.Mutex // Protects the fields below.
+	blocks map[int64]*list.Element
+	lru    *list.List // Of *cachedBlock, most recently used first.
+	fills  map[int64]*blockFill
+	writes uint64 // Number of WriteAt()'s and Truncate()'s.
+	short  int64  // The cached block shorter than the blockSize, or -1.
+
+	numHits          uint64
+	numMisses        uint64
+	numEvictions     uint64
+	numInvalidations uint64
+}
+
+type cachedBlock struct {
+	idx int64
+	buf []byte // Shorter than the blockSize at the end of the file.
+}
+
+// A block being read from the file, which readers of the same block
+// wait for instead of reading it too.
+type blockFill struct {
+	done   chan struct{}
+	stale  bool   // Whether a write changed the block during the read.
+	writes uint64 // The CachedFile's writes when the read started.
+}
+
+// Returns a CachedFile that caches up to capacityBytes of file, in
+// blocks of blockSize bytes.
+func NewCachedFile(file StoreFile, capacityBytes, blockSize int) (*CachedFile, error) {
+	if blockSize <= 0 {
+		return nil, errors.New("block size must be positive")
+	}
+	if capacityBytes < blockSize {
+		return nil, errors.New("cache capacity must be at least the block size")
+	}
+	return &CachedFile{file: file, blockSize: int64(blockSize),
+		capacity: capacityBytes / blockSize,
+		blocks:   map[int64]*list.Element{},
+		lru:      list.New(),
+		fills:    map[int64]*blockFill{},
+		short:    -1,
+	}, nil
+}
+
+func (f *CachedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if int64(len(p)) > int64(f.capacity)*f.blockSize {
+		return f.file.ReadAt(p, off) // Would only evict everything.
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		buf, err := f.block(pos / f.blockSize)
+		if err != nil {
+			return n, err
+		}
+		start := pos % f.blockSize
+		if start >= int64(len(buf)) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], buf[start:])
+		if int64(len(buf)) < f.blockSize && n < len(p) {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// Returns a block from the cache, or else reads it from the file.
+func (f *CachedFile) block(idx int64) ([]byte, error) {
+	f.m.Lock()
+	for {
+		if e, ok := f.blocks[idx]; ok {
+			f.lru.MoveToFront(e)
+			f.numHits++
+			f.m.Unlock()
+			return e.Value.(*cachedBlock).buf, nil
+		}
+		fill, ok := f.fills[idx]
+		if !ok {
+			break
+		}
+		f.m.Unlock()
+		<-fill.done
+		f.m.Lock()
+	}
+	f.numMisses++
+	fill := &blockFill{done: make(chan struct{}), writes: f.writes}
+	f.fills[idx] = fill
+	f.m.Unlock()
+
+	buf := make([]byte, f.blockSize)
+	n, err := f.file.ReadAt(buf, idx*f.blockSize)
+	if err == io.EOF {
+		err = nil
+	}
+
+	f.m.Lock()
+	delete(f.fills, idx)
+	close(fill.done)
+	// A short block may be stale after any write, which may have
+	// extended the file past it, and there's nothing to cache past the
+	// end of the file.
+	if err == nil && !fill.stale && n > 0 &&
+		(int64(n) == f.blockSize || fill.writes == f.writes) {
+		f.add(&cachedBlock{idx: idx, buf: buf[:n]})
+	}
+	f.m.Unlock()
+	return buf[:n], err
+}
+
+// Adds a block, evicting the least recently used block if over
+// capacity; the m must be held.
+func (f *CachedFile) add(b *cachedBlock) {
+	if int64(len(b.buf)) < f.blockSize {
+		if f.short >= 0 {
+			f.drop(f.short)
+		}
+		f.short = b.idx
+	}
+	f.blocks[b.idx] = f.lru.PushFront(b)
+	if f.lru.Len() > f.capacity {
+		f.remove(f.lru.Back())
+		f.numEvictions++
+	}
+}
+
+func (f *CachedFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.file.WriteAt(p, off)
+	if len(p) > 0 {
+		f.invalidate(off/f.blockSize, (off+int64(len(p))-1)/f.blockSize)
+	}
+	return n, err
+}
+
+func (f *CachedFile) Truncate(size int64) error {
+	err := f.file.Truncate(size)
+	f.invalidate(size/f.blockSize, -1)
+	return err
+}
+
+// Drops the cached blocks from the from'th to the to'th block, or to
+// the end when to is negative, and keeps the blocks being read from
+// being cached.  The short block at the end of the file is dropped
+// too, as the file may have grown past it.
+func (f *CachedFile) invalidate(from, to int64) {
+	changed := func(idx int64) bool {
+		return idx >= from && (to < 0 || idx <= to)
+	}
+	f.m.Lock()
+	f.writes++
+	if to < 0 {
+		for idx := range f.blocks {
+			if changed(idx) {
+				f.drop(idx)
+			}
+		}
+	} else {
+		for idx := from; idx <= to; idx++ {
+			f.drop(idx)
+		}
+	}
+	if f.short >= 0 {
+		f.drop(f.short)
+	}
+	for idx, fill := range f.fills {
+		if changed(idx) {
+			fill.stale = true
+		}
+	}
+	f.m.Unlock()
+}
+
+// Drops a cached block, if any; the m must be held.
+func (f *CachedFile) drop(idx int64) {
+	if e, ok := f.blocks[idx]; ok {
+		f.remove(e)
+		f.numInvalidations++
+	}
+}
+
+// Removes a cached block; the m must be held.
+func (f *CachedFile) remove(e *list.Element) {
+	idx := e.Value.(*cachedBlock).idx
+	f.lru.Remove(e)
+	delete(f.blocks, idx)
+	if f.short == idx {
+		f.short = -1
+	}
+}
+
+func (f *CachedFile) Stat() (os.FileInfo, error) {
+	return f.file.Stat()
+}
+
+// Syncs the wrapped StoreFile, which must implement Syncer.
+func (f *CachedFile) Sync() error {
+	if syncer, ok := f.file.(Syncer); ok {
+		return syncer.Sync()
+	}
+	return errors.New("file does not implement Syncer, so cannot Sync()")
+}
+
+// Updates the provided map with the cache's statistics.
+func (f *CachedFile) Stats(out map[string]uint64) {
+	f.m.Lock()
+	out["hits"] = f.numHits
+	out["misses"] = f.numMisses
+	out["evictions"] = f.numEvictions
+	out["invalidations"] = f.numInvalidations
+	out["cachedBlocks"] = uint64(f.lru.Len())
+	f.m.Unlock()
+}
@@ -0,0 +1,135 @@
+package gkvlite
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestCachedFile(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	if _, err := NewCachedFile(f, 100, 0); err == nil {
+		t.Errorf("expected a zero block size to fail")
+	}
+	if _, err := NewCachedFile(f, 10, 100); err == nil {
+		t.Errorf("expected a capacity under the block size to fail")
+	}
+	cf, err := NewCachedFile(f, 1000, 100)
+	if err != nil {
+		t.Fatalf("expected NewCachedFile to work, err: %v", err)
+	}
+
+	// Compare against the bytes that the file should have.
+	exp := []byte{}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		switch op := r.Intn(20); {
+		case op < 5:
+			off := r.Int63n(int64(len(exp)) + 300)
+			p := make([]byte, 1+r.Intn(250)) // Empty writes past the end are no-ops.
+			r.Read(p)
+			cf.WriteAt(p, off)
+			if end := off + int64(len(p)); end > int64(len(exp)) {
+				exp = append(exp, make([]byte, end-int64(len(exp)))...)
+			}
+			copy(exp[off:], p)
+		case op < 6:
+			size := r.Int63n(int64(len(exp)) + 1)
+			cf.Truncate(size)
+			exp = exp[:size]
+		default:
+			off := r.Int63n(int64(len(exp)) + 10)
+			p := make([]byte, r.Intn(350))
+			n, err := cf.ReadAt(p, off)
+			expN := 0
+			if off < int64(len(exp)) {
+				expN = copy(make([]byte, len(p)), exp[off:])
+			}
+			if n != expN || !bytes.Equal(p[:n], exp[off:off+int64(n)]) {
+				t.Fatalf("op: %v, off: %v, len: %v, expected n: %v, got: %v",
+					i, off, len(p), expN, n)
+			}
+			if (n < len(p)) != (err == io.EOF) {
+				t.Fatalf("op: %v, expected EOF only on short reads, n: %v, err: %v",
+					i, n, err)
+			}
+		}
+	}
+
+	stats := map[string]uint64{}
+	cf.Stats(stats)
+	for _, k := range []string{"hits", "misses", "evictions", "invalidations"} {
+		if stats[k] == 0 {
+			t.Errorf("expected some %v, got: %v", k, stats)
+		}
+	}
+	if stats["cachedBlocks"] > 10 {
+		t.Errorf("expected at most 10 cached blocks, got: %v", stats)
+	}
+}
+
+func TestCachedFileStore(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	cf, _ := NewCachedFile(f, 64*1024, 512)
+	s, _ := NewStore(cf)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 100; i++ {
+		x.Set([]byte(fmt.Sprintf("%03d", i)), []byte(fmt.Sprintf("v%d", i)))
+	}
+	s.Flush()
+
+	// Concurrent readers of a reopened store, with a single writer.
+	s1, _ := NewStore(cf)
+	x1 := s1.GetCollection("x")
+	var wg sync.WaitGroup
+	for r := 0; r < 10; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				n := 0
+				x1.VisitItemsAscend(nil, true, func(i *Item) bool {
+					if string(i.Val) != fmt.Sprintf("v%d", n) {
+						t.Errorf("unexpected item: %q, %q", i.Key, i.Val)
+					}
+					n++
+					return true
+				})
+				if n != 100 {
+					t.Errorf("expected 100 items, got: %v", n)
+				}
+			}
+		}()
+	}
+	for j := 0; j < 10; j++ {
+		for i := j; i < 100; i += 10 {
+			x1.Set([]byte(fmt.Sprintf("%03d", i)), []byte(fmt.Sprintf("v%d", i)))
+		}
+		if err := s1.Flush(); err != nil {
+			t.Errorf("expected Flush to work, err: %v", err)
+		}
+	}
+	wg.Wait()
+
+	s2, _ := NewStore(cf)
+	if rep, err := s2.Verify(VerifyOptions{Values: true}); err != nil || !rep.OK() {
+		t.Errorf("expected no problems, got: %v, err: %v", rep.Problems, err)
+	}
+	stats := map[string]uint64{}
+	cf.Stats(stats)
+	if stats["hits"] == 0 {
+		t.Errorf("expected cache hits, got: %v", stats)
+	}
+}
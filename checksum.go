@@ -0,0 +1,44 @@
+package gkvlite
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Since file format version 6, item, node and root records have
+// CRC32C (Castagnoli) checksums.
+const VERSION_CRC = uint32(6)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Returned when a record's bytes don't match its checksum, such as
+// from bit rot or a torn write.
+type ErrChecksum struct {
+	Offset int64  // File offset of the record.
+	Kind   string // "item", "item value", "node", "roots", "record" or "value".
+}
+
+func (e *ErrChecksum) Error() string {
+	return fmt.Sprintf("checksum mismatch, %s record at offset: %v",
+		e.Kind, e.Offset)
+}
+
+// A WriterAt that computes the checksum of the bytes written through
+// it, as long as they're written sequentially from offset next.
+type crcWriterAt struct {
+	w          io.WriterAt
+	next       int64
+	crc        uint32
+	sequential bool
+}
+
+func (c *crcWriterAt) WriteAt(p []byte, offset int64) (n int, err error) {
+	if offset != c.next {
+		c.sequential = false
+	}
+	n, err = c.w.WriteAt(p, offset)
+	c.crc = crc32.Update(c.crc, crcTable, p[:n])
+	c.next = offset + int64(n)
+	return n, err
+}
@@ -0,0 +1,181 @@
+package gkvlite
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+func corruptByte(t *testing.T, fname string, offset int64) {
+	f, err := os.OpenFile(fname, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("expected open to work, err: %v", err)
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	f.ReadAt(b, offset)
+	b[0] ^= 0xff
+	f.WriteAt(b, offset)
+}
+
+func checksumStore(t *testing.T, fname string) *Store {
+	os.Remove(fname)
+	f, _ := os.Create(fname)
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	x.Set([]byte("a"), []byte("hello"))
+	s.Flush()
+	f.Close()
+	return s
+}
+
+func expectErrChecksum(t *testing.T, err error, offset int64, kind string) {
+	e, ok := err.(*ErrChecksum)
+	if !ok || e.Offset != offset || e.Kind != kind {
+		t.Errorf("expected %s checksum error at %v, got: %v", kind, offset, err)
+	}
+}
+
+func TestChecksumItem(t *testing.T) {
+	fname := "tmp.test"
+	defer os.Remove(fname)
+	hdrLength := int64(itemLocHdrLength(VERSION))
+	for _, c := range []struct {
+		offset int64
+		kind   string
+	}{
+		{1, "item"},         // Length.
+		{hdrLength, "item"}, // Key.
+		{hdrLength + 3, "item value"},
+	} {
+		checksumStore(t, fname)
+		corruptByte(t, fname, c.offset)
+		f, _ := os.Open(fname)
+		s, err := NewStore(f)
+		if err != nil {
+			t.Fatalf("expected reopen to work, err: %v", err)
+		}
+		_, err = s.GetCollection("x").Get([]byte("a"))
+		expectErrChecksum(t, err, 0, c.kind)
+		f.Close()
+	}
+}
+
+func TestChecksumNode(t *testing.T) {
+	fname := "tmp.test"
+	defer os.Remove(fname)
+	checksumStore(t, fname)
+	nodeOffset := int64(itemLocHdrLength(VERSION) + 1 + 5)
+	corruptByte(t, fname, nodeOffset+int64(nodeLoc_length)-1)
+	f, _ := os.Open(fname)
+	defer f.Close()
+	s, _ := NewStore(f)
+	_, err := s.GetCollection("x").Get([]byte("a"))
+	expectErrChecksum(t, err, nodeOffset, "node")
+}
+
+func TestChecksumRoots(t *testing.T) {
+	fname := "tmp.test"
+	defer os.Remove(fname)
+	s := checksumStore(t, fname)
+	first := s.LastCommitInfo().Offset
+	f, _ := os.OpenFile(fname, os.O_RDWR, 0666)
+	s, _ = NewStore(f)
+	s.GetCollection("x").Set([]byte("b"), []byte("world"))
+	s.Flush()
+	last := s.LastCommitInfo().Offset
+	f.Close()
+	corruptByte(t, fname, last+int64(2*len(MAGIC_BEG)+4+4+2))
+
+	f, _ = os.Open(fname)
+	defer f.Close()
+	s, err := NewStore(f)
+	if err != nil {
+		t.Fatalf("expected reopen to skip the corrupted roots, err: %v", err)
+	}
+	if s.LastCommitInfo().Offset != first {
+		t.Errorf("expected the previous roots, got: %#v", s.LastCommitInfo())
+	}
+	if v, _ := s.GetCollection("x").Get([]byte("b")); v != nil {
+		t.Errorf("expected b to be missing from the previous roots")
+	}
+	data, err := s.readRootsAt(last)
+	if err != nil {
+		t.Errorf("expected readRootsAt to work, err: %v", err)
+	}
+	_, _, _, err = s.parseRoots(last, data, false)
+	expectErrChecksum(t, err, last, "roots")
+}
+
+func TestChecksumOlderVersions(t *testing.T) {
+	fname := "tmp.test"
+	defer os.Remove(fname)
+	for _, version := range []uint32{4, 5, 6} {
+		os.Remove(fname)
+		f, _ := os.Create(fname)
+		s, _ := NewStore(f)
+		s.setVersion(version)
+		x := s.SetCollection("x", nil)
+		for i := 0; i < 10; i++ {
+			x.Set([]byte(fmt.Sprintf("%d", i)), []byte("v"))
+		}
+		s.Flush()
+		u, _ := s.SpaceUsage(true)
+		if u.Collections["x"].NodeBytes != int64(10*nodeLocLength(version)) ||
+			u.DeadBytes() != 0 {
+			t.Errorf("expected version %v node lengths, got: %#v",
+				version, u.Collections["x"])
+		}
+		f.Close()
+
+		f, _ = os.OpenFile(fname, os.O_RDWR, 0666)
+		s, err := NewStore(f)
+		if err != nil || s.version() != version {
+			t.Errorf("expected version %v reopen to work, err: %v", version, err)
+		}
+		x = s.GetCollection("x")
+		x.Set([]byte("a"), []byte("a"))
+		s.Flush()
+		for _, k := range []string{"0", "9", "a"} {
+			if v, err := x.Get([]byte(k)); err != nil || v == nil {
+				t.Errorf("expected version %v Get(%s) to work, err: %v",
+					version, k, err)
+			}
+		}
+		f.Close()
+	}
+}
+
+func TestChecksumItemValWriteCallback(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	// Writes the value backwards, one byte at a time, so its checksum
+	// has to be computed by reading it back.
+	s, _ := NewStoreEx(f, StoreCallbacks{
+		ItemValWrite: func(c *Collection, i *Item,
+			w io.WriterAt, offset int64) error {
+			for j := len(i.Val) - 1; j >= 0; j-- {
+				if _, err := w.WriteAt(i.Val[j:j+1], offset+int64(j)); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+	x := s.SetCollection("x", nil)
+	x.Set([]byte("a"), []byte("hello"))
+	x.Set([]byte("b"), []byte("world"))
+	s.Flush()
+
+	s2, _ := NewStore(f)
+	for k, exp := range map[string]string{"a": "hello", "b": "world"} {
+		v, err := s2.GetCollection("x").Get([]byte(k))
+		if err != nil || string(v) != exp {
+			t.Errorf("expected %s => %s, got: %s, err: %v", k, exp, v, err)
+		}
+	}
+}
@@ -23,7 +23,7 @@ type Collection struct {
 	rootLock *sync.Mutex
 	root     *rootNodeLoc // Protected by rootLock.
 
-	allocStats AllocStats // User must serialize access (e.g., see locks in alloc.go).
+	allocStats AllocStats // Atomic protected.
 
 	AppData unsafe.Pointer // For app-specific data; atomic CAS recommended.
 }
@@ -133,12 +133,25 @@ func (t *Collection) SetItem(item *Item) (err error) {
 	if item.Priority < 0 {
 		return errors.New("Item.Priority must be non-negative")
 	}
+	numBytes := len(item.Key) + item.NumValBytes(t)
+	if err = t.setItem(item, nil, uint64(numBytes)); err != nil {
+		return err
+	}
+	t.store.noteDirty(int64(numBytes))
+	return nil
+}
+
+// Inserts an item, which might already be persisted at loc.
+func (t *Collection) setItem(item *Item, loc *ploc, numBytes uint64) error {
+	t.store.mutLock.RLock()
+	defer t.store.mutLock.RUnlock()
 	rnl := t.rootAddRef()
 	defer t.rootDecRef(rnl)
 	root := rnl.root
-	n := t.mkNode(nil, nil, nil, 1, uint64(len(item.Key))+uint64(item.NumValBytes(t)))
+	n := t.mkNode(nil, nil, nil, 1, numBytes)
 	t.store.ItemAddRef(t, item)
 	n.item.item = unsafe.Pointer(item) // Avoid garbage via separate init.
+	n.item.loc = unsafe.Pointer(loc)
 	nloc := t.mkNodeLoc(n)
 	defer t.freeNodeLoc(nloc)
 	r, err := t.store.union(t, root, nloc, &rnl.reclaimMark)
@@ -166,6 +179,8 @@ func (t *Collection) Delete(key []byte) (wasDeleted bool, err error) {
 	if t.store.readOnly {
 		return false, errors.New("store is read only")
 	}
+	t.store.mutLock.RLock()
+	defer t.store.mutLock.RUnlock()
 	rnl := t.rootAddRef()
 	defer t.rootDecRef(rnl)
 	root := rnl.root
@@ -201,6 +216,8 @@ func (t *Collection) Delete(key []byte) (wasDeleted bool, err error) {
 		return false, errors.New("concurrent mutation attempted")
 	}
 	t.rootDecRef(rnl)
+	t.store.noteDirty(int64(len(key)))
+	t.store.logDelete(t, key)
 	return true, nil
 }
 
@@ -269,7 +286,11 @@ func (t *Collection) VisitItemsAscendEx(target []byte, withValue bool,
 	visitor ItemVisitorEx) error {
 	rnl := t.rootAddRef()
 	defer t.rootDecRef(rnl)
+	return t.visitItemsAscend(rnl.root, target, withValue, visitor)
+}
 
+func (t *Collection) visitItemsAscend(root *nodeLoc, target []byte,
+	withValue bool, visitor ItemVisitorEx) error {
 	var prevVisitItem *Item
 	var errCheckedVisitor error
 
@@ -277,14 +298,14 @@ func (t *Collection) VisitItemsAscendEx(target []byte, withValue bool,
 		if prevVisitItem != nil && t.compare(prevVisitItem.Key, i.Key) > 0 {
 			errCheckedVisitor = fmt.Errorf("corrupted / out-of-order index"+
 				", key: %s vs %s, coll: %p, collName: %s, store: %p, storeFile: %v",
-				string(prevVisitItem.Key), string(i.Key), t, t.name, t.store, t.store.file)
+				string(prevVisitItem.Key), string(i.Key), t, t.name, t.store, t.store.file())
 			return false
 		}
 		prevVisitItem = i
 		return visitor(i, depth)
 	}
 
-	_, err := t.store.visitNodes(t, rnl.root,
+	_, err := t.store.visitNodes(t, root,
 		target, withValue, checkedVisitor, 0, ascendChoice)
 	if errCheckedVisitor != nil {
 		return errCheckedVisitor
@@ -348,17 +369,16 @@ func (t *Collection) UnmarshalJSON(d []byte) error {
 	if t.rootLock == nil {
 		t.rootLock = &sync.Mutex{}
 	}
-	nloc := t.mkNodeLoc(nil)
-	nloc.loc = unsafe.Pointer(&p)
-	if !t.rootCAS(nil, t.mkRootNodeLoc(nloc)) {
+	// Not from the Store's free lists, as its Store isn't set yet.
+	nloc := &nodeLoc{loc: unsafe.Pointer(&p)}
+	if !t.rootCAS(nil, &rootNodeLoc{refs: 1, root: nloc}) {
 		return errors.New("concurrent mutation during UnmarshalJSON().")
 	}
 	return nil
 }
 
-func (t *Collection) AllocStats() (res AllocStats) {
-	withAllocLocks(func() { res = t.allocStats })
-	return res
+func (t *Collection) AllocStats() AllocStats {
+	return t.allocStats.load()
 }
 
 // Writes dirty items of a collection BUT (WARNING) does NOT write new
@@ -368,22 +388,29 @@ func (t *Collection) Write() error {
 	if t.store.readOnly {
 		return errors.New("store is read only")
 	}
+	t.store.flushLock.Lock()
+	defer t.store.flushLock.Unlock()
 	rnl := t.rootAddRef()
 	defer t.rootDecRef(rnl)
-	return t.write(rnl.root)
+	stopBuffer := t.store.startBuffer()
+	err := t.write(rnl.root, t.store.recWriter())
+	if errBuffer := stopBuffer(); err == nil {
+		err = errBuffer
+	}
+	return err
 }
 
-func (t *Collection) write(nloc *nodeLoc) error {
-	if err := t.writeItems(nloc); err != nil {
+func (t *Collection) write(nloc *nodeLoc, rw *recWriter) error {
+	if err := t.writeItems(nloc, rw); err != nil {
 		return err
 	}
-	if err := t.writeNodes(nloc); err != nil {
+	if err := t.writeNodes(nloc, rw); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (t *Collection) writeItems(nloc *nodeLoc) (err error) {
+func (t *Collection) writeItems(nloc *nodeLoc, rw *recWriter) (err error) {
 	if nloc == nil || !nloc.Loc().isEmpty() {
 		return nil // Write only unpersisted items of non-empty, unpersisted nodes.
 	}
@@ -391,16 +418,16 @@ func (t *Collection) writeItems(nloc *nodeLoc) (err error) {
 	if node == nil {
 		return nil
 	}
-	if err = t.writeItems(&node.left); err != nil {
+	if err = t.writeItems(&node.left, rw); err != nil {
 		return err
 	}
-	if err = node.item.write(t); err != nil { // Write items in key order.
+	if err = node.item.write(t, rw); err != nil { // Write items in key order.
 		return err
 	}
-	return t.writeItems(&node.right)
+	return t.writeItems(&node.right, rw)
 }
 
-func (t *Collection) writeNodes(nloc *nodeLoc) (err error) {
+func (t *Collection) writeNodes(nloc *nodeLoc, rw *recWriter) (err error) {
 	if nloc == nil || !nloc.Loc().isEmpty() {
 		return nil // Write only non-empty, unpersisted nodes.
 	}
@@ -408,13 +435,13 @@ func (t *Collection) writeNodes(nloc *nodeLoc) (err error) {
 	if node == nil {
 		return nil
 	}
-	if err = t.writeNodes(&node.left); err != nil {
+	if err = t.writeNodes(&node.left, rw); err != nil {
 		return err
 	}
-	if err = t.writeNodes(&node.right); err != nil {
+	if err = t.writeNodes(&node.right, rw); err != nil {
 		return err
 	}
-	return nloc.write(t.store) // Write nodes in children-first order.
+	return nloc.write(t.store, rw) // Write nodes in children-first order.
 }
 
 func (t *Collection) rootCAS(prev, next *rootNodeLoc) bool {
@@ -450,9 +477,9 @@ func (t *Collection) rootAddRef() *rootNodeLoc {
 
 func (t *Collection) rootDecRef(r *rootNodeLoc) {
 	t.rootLock.Lock()
-	freeNodeLock.Lock()
+	t.store.alloc.freeNodeLock.Lock()
 	t.rootDecRef_unlocked(r)
-	freeNodeLock.Unlock()
+	t.store.alloc.freeNodeLock.Unlock()
 	t.rootLock.Unlock()
 }
 
@@ -0,0 +1,68 @@
+package gkvlite
+
+import (
+	"errors"
+	"sync"
+)
+
+// Batches the CommitAsync() calls that arrive while a flush is in
+// progress into the next flush.
+type committer struct {
+	m       sync.Mutex
+	waiters []chan error
+	running bool // When true, a flusher goroutine is running.
+}
+
+// Returns a channel that receives the result of a Flush with Sync
+// that includes every mutation made before the call.  Concurrent
+// callers share flushes, where a single flusher goroutine runs while
+// there are waiters, so many callers needing durable writes pay for
+// far fewer Flush()'es and fsync's.  The StoreFile must implement
+// Syncer, or else the channel receives the flush's error, as it does
+// for a memory-only Store.  Mutations still need the usual single
+// mutator discipline, but the waiting on the channel may happen
+// outside of it.
+func (s *Store) CommitAsync() <-chan error {
+	ch := make(chan error, 1)
+	if s.readOnly {
+		ch <- errors.New("readonly, so cannot CommitAsync()")
+		return ch
+	}
+	c := &s.committer
+	c.m.Lock()
+	c.waiters = append(c.waiters, ch)
+	if !c.running {
+		c.running = true
+		go s.runCommitter()
+	}
+	c.m.Unlock()
+	return ch
+}
+
+func (s *Store) runCommitter() {
+	c := &s.committer
+	for {
+		c.m.Lock()
+		waiters := c.waiters
+		c.waiters = nil
+		if len(waiters) == 0 {
+			c.running = false
+			c.m.Unlock()
+			return
+		}
+		c.m.Unlock()
+		err := s.FlushEx(FlushOptions{Sync: true})
+		for _, ch := range waiters {
+			ch <- err
+		}
+	}
+}
+
+// Replace or insert an item of a given key, and wait until it's
+// durable, via CommitAsync().
+func (t *Collection) SetDurable(key []byte, val []byte) error {
+	if err := t.Set(key, val); err != nil {
+		return err
+	}
+	return <-t.store.CommitAsync()
+}
@@ -0,0 +1,94 @@
+package gkvlite
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type syncCountFile struct {
+	*os.File
+	numSync int64
+}
+
+func (f *syncCountFile) Sync() error {
+	atomic.AddInt64(&f.numSync, 1)
+	return f.File.Sync()
+}
+
+func TestCommitAsync(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	sf := &syncCountFile{File: f}
+	s, _ := NewStore(sf)
+	x := s.SetCollection("x", nil)
+	if err := x.SetDurable([]byte("a"), []byte("A")); err != nil {
+		t.Errorf("expected SetDurable to work, err: %v", err)
+	}
+	if atomic.LoadInt64(&sf.numSync) != 2 || s.LastCommitInfo() == nil {
+		t.Errorf("expected one synced flush, numSync: %v", sf.numSync)
+	}
+
+	// Block the flusher so the commits batch up.
+	s.flushLock.Lock()
+	var mut sync.Mutex // The app's single mutator discipline.
+	var wg sync.WaitGroup
+	var enqueued int64
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mut.Lock()
+			x.Set([]byte(fmt.Sprintf("%d", i)), []byte("v"))
+			ch := s.CommitAsync()
+			mut.Unlock()
+			atomic.AddInt64(&enqueued, 1)
+			if err := <-ch; err != nil {
+				t.Errorf("expected CommitAsync to work, err: %v", err)
+			}
+		}(i)
+	}
+	for atomic.LoadInt64(&enqueued) < 20 {
+		time.Sleep(time.Millisecond)
+	}
+	s.flushLock.Unlock()
+	wg.Wait()
+	if n := atomic.LoadInt64(&sf.numSync); n > 2+2*2 {
+		t.Errorf("expected at most two more synced flushes, numSync: %v", n)
+	}
+
+	f2, _ := os.Open(fname)
+	defer f2.Close()
+	s2, _ := NewStore(f2)
+	for i := 0; i < 20; i++ {
+		if v, err := s2.GetCollection("x").Get([]byte(fmt.Sprintf("%d", i))); err != nil || v == nil {
+			t.Errorf("expected committed %d, err: %v", i, err)
+		}
+	}
+}
+
+func TestCommitAsyncErrors(t *testing.T) {
+	mem, _ := NewStore(nil)
+	if err := <-mem.CommitAsync(); err == nil {
+		t.Errorf("expected memory-only CommitAsync to fail")
+	}
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	m := &mockfile{f: f}
+	s, _ := NewStore(m)
+	if err := s.SetCollection("x", nil).SetDurable([]byte("a"), []byte("A")); err == nil {
+		t.Errorf("expected SetDurable with a non-Syncer to fail")
+	}
+	if err := <-s.Snapshot().CommitAsync(); err == nil {
+		t.Errorf("expected readonly CommitAsync to fail")
+	}
+}
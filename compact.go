@@ -0,0 +1,320 @@
+package gkvlite
+
+import (
+	"errors"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Max number of catch-up rounds during Compact() before mutations are
+// blocked for the final catch-up round.
+const compactCatchUpRounds = 4
+
+// Compacts the Store into dstFile, which should be empty, while
+// mutations may continue concurrently.  Compact() copies a snapshot,
+// then catches up on mutations made during the copy by diffing
+// snapshots, and finally blocks mutations briefly to catch up on the
+// last mutations and to switch the Store and its Collections to the
+// dstFile.  Compact() also persists any unflushed mutations.  It may
+// run concurrently with Flush()'es, but not with another Compact().
+//
+// The original file should be kept open until concurrent readers and
+// any earlier snapshots are done, as they will continue reading it.
+// The CommitInfo.Seq's of the compacted file start again from 0.
+func (s *Store) Compact(dstFile StoreFile) error {
+	return s.compact(dstFile, nil)
+}
+
+// The optional progress callback is invoked after every catch-up
+// round with the number of changes copied in that round, where the
+// last round is the one where mutations were blocked.
+func (s *Store) compact(dstFile StoreFile, progress func(round, n int)) error {
+	if s.readOnly {
+		return errors.New("readonly, so cannot Compact()")
+	}
+	if s.file() == nil {
+		return errors.New("no file / in-memory only, so cannot Compact()")
+	}
+	newStore := NewStoreEx
+	if s.header {
+		newStore = NewStoreWithHeader
+	}
+	dst, err := newStore(dstFile, s.callbacks)
+	if err != nil {
+		return err
+	}
+	if atomic.LoadInt64(&dst.size) != dst.dataStart() {
+		return errors.New("Compact() needs an empty dstFile")
+	}
+	files := *(*[]fileGen)(atomic.LoadPointer(&s.files))
+	dstFiles := append(files[:len(files):len(files)],
+		fileGen{file: dstFile, base: dstFile, version: dst.version()})
+	dst.files = unsafe.Pointer(&dstFiles)
+
+	// The snapshots are not Close()'ed, as they share their roots with
+	// the Store, and are left instead for GC.
+	var prev *Store
+	for i := 0; i < compactCatchUpRounds; i++ {
+		next := s.Snapshot()
+		n, err := compactDiff(prev, next, dst)
+		if err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(i, n)
+		}
+		prev = next
+		if n == 0 {
+			break
+		}
+		if err = dst.Flush(); err != nil {
+			return err
+		}
+	}
+
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+	s.mutLock.Lock()
+	defer s.mutLock.Unlock()
+	next := s.Snapshot()
+	n, err := compactDiff(prev, next, dst)
+	if err != nil {
+		return err
+	}
+	if progress != nil {
+		progress(compactCatchUpRounds, n)
+	}
+	if err = dst.Flush(); err != nil {
+		return err
+	}
+	coll := *(*map[string]*Collection)(atomic.LoadPointer(&s.coll))
+	for name, c := range coll {
+		dc := dst.GetCollection(name)
+		drnl := dc.rootAddRef()
+		rnl := c.mkRootNodeLoc(c.mkNodeLoc(nil).Copy(drnl.root))
+		dc.rootDecRef(drnl)
+		c.rootLock.Lock()
+		old := c.root
+		c.root = rnl
+		c.rootLock.Unlock()
+		c.rootDecRef(old)
+	}
+	s.headerSeq = dst.headerSeq
+	atomic.StorePointer(&s.files, dst.files)
+	atomic.StoreInt64(&s.size, atomic.LoadInt64(&dst.size))
+	atomic.StorePointer(&s.lastCommit, atomic.LoadPointer(&dst.lastCommit))
+	return nil
+}
+
+// Applies the differences between the collections of snapshots a and
+// b to dst, returning the number of changes.  When a is nil, all of
+// b is copied.
+func compactDiff(a, b, dst *Store) (n int, err error) {
+	acoll := map[string]*Collection{}
+	if a != nil {
+		acoll = *(*map[string]*Collection)(atomic.LoadPointer(&a.coll))
+	}
+	bcoll := *(*map[string]*Collection)(atomic.LoadPointer(&b.coll))
+	for _, name := range collNames(acoll) {
+		if bcoll[name] == nil {
+			dst.RemoveCollection(name)
+			n++
+		}
+	}
+	for _, name := range collNames(bcoll) {
+		d := &collDiff{a: acoll[name], b: bcoll[name],
+			dst: dst.GetCollection(name)}
+		if d.dst == nil {
+			d.dst = dst.SetCollection(name, d.b.compare)
+		}
+		if err = d.diffRoots(); err != nil {
+			return 0, err
+		}
+		n += d.n
+	}
+	return n, nil
+}
+
+// Tracks the changes from collection a (which may be nil) to
+// collection b, applying them to collection dst.
+type collDiff struct {
+	a, b *Collection
+	dst  *Collection
+	n    int // Number of changes applied to dst.
+}
+
+func (d *collDiff) diffRoots() error {
+	aroot := empty_nodeLoc
+	if d.a != nil {
+		arnl := d.a.rootAddRef()
+		defer d.a.rootDecRef(arnl)
+		aroot = arnl.root
+	}
+	brnl := d.b.rootAddRef()
+	defer d.b.rootDecRef(brnl)
+	return d.diff(aroot, brnl.root)
+}
+
+// Diffs two subtrees, skipping shared subtrees.  When both subtrees
+// have the same key at their tops, their left and right subtrees
+// hold the same key ranges and are diffed recursively.  Otherwise,
+// the subtrees are merged by walking them in key order.
+func (d *collDiff) diff(an, bn *nodeLoc) error {
+	if sameNodeLoc(an, bn) {
+		return nil
+	}
+	if an.isEmpty() || bn.isEmpty() {
+		return d.merge(an, bn)
+	}
+	anNode, err := an.read(d.a.store)
+	if err != nil {
+		return err
+	}
+	bnNode, err := bn.read(d.b.store)
+	if err != nil {
+		return err
+	}
+	aItem, err := anNode.item.read(d.a, false)
+	if err != nil {
+		return err
+	}
+	bItem, err := bnNode.item.read(d.b, false)
+	if err != nil {
+		return err
+	}
+	if d.b.compare(aItem.Key, bItem.Key) != 0 {
+		return d.merge(an, bn)
+	}
+	if err = d.diff(&anNode.left, &bnNode.left); err != nil {
+		return err
+	}
+	if !sameItemLoc(&anNode.item, &bnNode.item) {
+		if err = d.set(&bnNode.item); err != nil {
+			return err
+		}
+	}
+	return d.diff(&anNode.right, &bnNode.right)
+}
+
+func (d *collDiff) merge(an, bn *nodeLoc) error {
+	ai := &nodeIter{c: d.a}
+	bi := &nodeIter{c: d.b}
+	aNode, aItem, err := ai.start(an)
+	if err != nil {
+		return err
+	}
+	bNode, bItem, err := bi.start(bn)
+	if err != nil {
+		return err
+	}
+	for aNode != nil || bNode != nil {
+		c := 0
+		if aNode == nil {
+			c = 1
+		} else if bNode == nil {
+			c = -1
+		} else {
+			c = d.b.compare(aItem.Key, bItem.Key)
+		}
+		if c < 0 {
+			if _, err = d.dst.Delete(aItem.Key); err != nil {
+				return err
+			}
+			d.n++
+		} else if c > 0 || !sameItemLoc(&aNode.item, &bNode.item) {
+			if err = d.set(&bNode.item); err != nil {
+				return err
+			}
+		}
+		if c <= 0 {
+			if aNode, aItem, err = ai.next(); err != nil {
+				return err
+			}
+		}
+		if c >= 0 {
+			if bNode, bItem, err = bi.next(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *collDiff) set(iloc *itemLoc) error {
+	i, err := iloc.read(d.b, true)
+	if err != nil {
+		return err
+	}
+	if err = d.dst.SetItem(i); err != nil {
+		return err
+	}
+	d.n++
+	return nil
+}
+
+func sameNodeLoc(a, b *nodeLoc) bool {
+	if a.isEmpty() || b.isEmpty() {
+		return a.isEmpty() && b.isEmpty()
+	}
+	if n := a.Node(); n != nil && n == b.Node() {
+		return true
+	}
+	return sameLoc(a.Loc(), b.Loc())
+}
+
+func sameItemLoc(a, b *itemLoc) bool {
+	if i := a.Item(); i != nil && i == b.Item() {
+		return true
+	}
+	return sameLoc(a.Loc(), b.Loc())
+}
+
+func sameLoc(a, b *ploc) bool {
+	return !a.isEmpty() && !b.isEmpty() && *a == *b
+}
+
+// An in-order iterator over the nodes of a subtree.
+type nodeIter struct {
+	c     *Collection
+	stack []*node
+}
+
+func (it *nodeIter) start(nloc *nodeLoc) (*node, *Item, error) {
+	if err := it.pushLeft(nloc); err != nil {
+		return nil, nil, err
+	}
+	return it.next()
+}
+
+func (it *nodeIter) pushLeft(nloc *nodeLoc) error {
+	for !nloc.isEmpty() {
+		n, err := nloc.read(it.c.store)
+		if err != nil {
+			return err
+		}
+		if n == nil {
+			return nil
+		}
+		it.stack = append(it.stack, n)
+		nloc = &n.left
+	}
+	return nil
+}
+
+// Returns the next node and its item (possibly without its value),
+// or a nil node when done.
+func (it *nodeIter) next() (*node, *Item, error) {
+	if len(it.stack) <= 0 {
+		return nil, nil, nil
+	}
+	n := it.stack[len(it.stack)-1]
+	it.stack = it.stack[:len(it.stack)-1]
+	if err := it.pushLeft(&n.right); err != nil {
+		return nil, nil, err
+	}
+	i, err := n.item.read(it.c, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return n, i, nil
+}
@@ -0,0 +1,219 @@
+package gkvlite
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestCompact(t *testing.T) {
+	fname := "tmp.test"
+	cname := "tmp-compact.test"
+	os.Remove(fname)
+	os.Remove(cname)
+	defer os.Remove(fname)
+	defer os.Remove(cname)
+	f, _ := os.Create(fname)
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	y := s.SetCollection("y", nil)
+	for j := 0; j < 5; j++ {
+		for i := 0; i < 100; i++ {
+			x.Set([]byte(fmt.Sprintf("%03d", i)), []byte(fmt.Sprintf("%d", j)))
+		}
+		s.Flush()
+	}
+	y.Set([]byte("a"), []byte("unflushed"))
+	snap := s.Snapshot()
+
+	mem, _ := NewStore(nil)
+	if err := mem.Compact(nil); err == nil {
+		t.Errorf("expected memory-only Compact to fail")
+	}
+	if err := snap.Compact(nil); err == nil {
+		t.Errorf("expected readonly Compact to fail")
+	}
+	if err := s.Compact(f); err == nil {
+		t.Errorf("expected Compact into non-empty file to fail")
+	}
+
+	c, _ := os.Create(cname)
+	if err := s.Compact(c); err != nil {
+		t.Fatalf("expected Compact to work, err: %v", err)
+	}
+	finfo, _ := f.Stat()
+	cinfo, _ := c.Stat()
+	if cinfo.Size() >= finfo.Size() {
+		t.Errorf("expected compacted file to be smaller, got: %v vs %v",
+			cinfo.Size(), finfo.Size())
+	}
+	if s.LastCommitInfo().Seq > compactCatchUpRounds {
+		t.Errorf("expected compacted seq to restart, got: %#v", s.LastCommitInfo())
+	}
+	for _, cc := range []*Collection{x, snap.GetCollection("x")} {
+		v, err := cc.Get([]byte("042"))
+		if err != nil || string(v) != "4" {
+			t.Errorf("expected Get to work after Compact, got: %s, err: %v", v, err)
+		}
+	}
+	v, err := y.Get([]byte("a"))
+	if err != nil || string(v) != "unflushed" {
+		t.Errorf("expected unflushed item after Compact, got: %s, err: %v", v, err)
+	}
+
+	x.Set([]byte("100"), []byte("new"))
+	s.Flush()
+	finfo2, _ := f.Stat()
+	if finfo2.Size() != finfo.Size() {
+		t.Errorf("expected no more writes to the original file")
+	}
+	c.Close()
+	c, _ = os.OpenFile(cname, os.O_RDWR, 0666)
+	s2, err := NewStore(c)
+	if err != nil {
+		t.Fatalf("expected reopen of compacted file to work, err: %v", err)
+	}
+	numItems, _, err := s2.GetCollection("x").GetTotals()
+	if err != nil || numItems != 101 {
+		t.Errorf("expected 101 items, got: %v, err: %v", numItems, err)
+	}
+	visitExpectCollection(t, s2.GetCollection("y"), "a", []string{"a"}, nil)
+}
+
+func TestCompactConcurrentMutations(t *testing.T) {
+	fname := "tmp.test"
+	cname := "tmp-compact.test"
+	os.Remove(fname)
+	os.Remove(cname)
+	defer os.Remove(fname)
+	defer os.Remove(cname)
+	f, _ := os.Create(fname)
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 1000; i++ {
+		x.Set([]byte(fmt.Sprintf("%04d", i)), []byte("0"))
+	}
+	s.Flush()
+
+	stop := make(chan bool)
+	done := make(chan int)
+	go func() {
+		n := 0
+		for {
+			select {
+			case <-stop:
+				done <- n
+				return
+			default:
+			}
+			k := []byte(fmt.Sprintf("%04d", n%2000))
+			if n%3 == 0 {
+				x.Delete(k)
+			} else if err := x.Set(k, []byte(fmt.Sprintf("%d", n))); err != nil {
+				t.Errorf("expected Set during Compact to work, err: %v", err)
+			}
+			n++
+		}
+	}()
+	c, _ := os.Create(cname)
+	if err := s.Compact(c); err != nil {
+		t.Errorf("expected Compact to work, err: %v", err)
+	}
+	close(stop)
+	n := <-done
+	s.Flush()
+
+	expect := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		expect[fmt.Sprintf("%04d", i)] = "0"
+	}
+	for i := 0; i < n; i++ {
+		k := fmt.Sprintf("%04d", i%2000)
+		if i%3 == 0 {
+			delete(expect, k)
+		} else {
+			expect[k] = fmt.Sprintf("%d", i)
+		}
+	}
+	c.Close()
+	c, _ = os.Open(cname)
+	s2, err := NewStore(c)
+	if err != nil {
+		t.Fatalf("expected reopen of compacted file to work, err: %v", err)
+	}
+	got := map[string]string{}
+	s2.GetCollection("x").VisitItemsAscend(nil, true, func(i *Item) bool {
+		got[string(i.Key)] = string(i.Val)
+		return true
+	})
+	if len(got) != len(expect) {
+		t.Errorf("expected %v items, got: %v", len(expect), len(got))
+	}
+	for k, v := range expect {
+		if got[k] != v {
+			t.Errorf("expected %s => %s, got: %s", k, v, got[k])
+			break
+		}
+	}
+}
+
+func TestCompactConcurrentSnapshotsAndFlushes(t *testing.T) {
+	fname := "tmp.test"
+	cname := "tmp-compact.test"
+	os.Remove(fname)
+	os.Remove(cname)
+	defer os.Remove(fname)
+	defer os.Remove(cname)
+	f, _ := os.Create(fname)
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 1000; i++ {
+		x.Set([]byte(fmt.Sprintf("%04d", i)), []byte("0"))
+	}
+	s.Flush()
+
+	// Readers may take snapshots and a flusher may flush while a
+	// Compact() switches the Store's file.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, fn := range []func(){
+		func() {
+			v, err := s.Snapshot().GetCollection("x").Get([]byte("0042"))
+			if err != nil || string(v) != "0" {
+				t.Errorf("expected snapshot Get to work, got: %s, err: %v", v, err)
+			}
+		},
+		func() {
+			if err := s.Flush(); err != nil {
+				t.Errorf("expected Flush during Compact to work, err: %v", err)
+			}
+		},
+	} {
+		wg.Add(1)
+		go func(fn func()) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				fn()
+			}
+		}(fn)
+	}
+	c, _ := os.Create(cname)
+	defer c.Close()
+	if err := s.Compact(c); err != nil {
+		t.Errorf("expected Compact to work, err: %v", err)
+	}
+	close(stop)
+	wg.Wait()
+	if s.file() != c || s.version() != VERSION || s.gen() != 1 {
+		t.Errorf("expected the compacted file, got gen: %v", s.gen())
+	}
+	if rep, err := s.Verify(VerifyOptions{Values: true}); err != nil || !rep.OK() {
+		t.Errorf("expected no problems, got: %v, err: %v", rep.Problems, err)
+	}
+}
@@ -0,0 +1,161 @@
+package gkvlite
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Tracks the clean nodes and items that a Store caches in memory, to
+// evict them when they're over the memory budget, where a CLOCK gives
+// the recently used ones a second chance.
+type memCache struct {
+	m       sync.Mutex // Protects the fields below.
+	budget  int64
+	bytes   int64 // Of the entries.
+	entries []cacheEntry
+	hand    int  // The CLOCK hand, an index into entries.
+	running bool // Whether an evictor goroutine is running.
+
+	numEvictedNodes uint64
+	numEvictedItems uint64
+}
+
+// A cached node (nloc and n) or item (c, iloc and i), which is stale
+// once the nodeLoc or itemLoc no longer holds it.
+type cacheEntry struct {
+	nloc *nodeLoc
+	n    *node
+	c    *Collection
+	iloc *itemLoc
+	i    *Item
+	size int64
+}
+
+var nodeMemSize = int64(unsafe.Sizeof(node{}))
+var itemMemSize = int64(unsafe.Sizeof(Item{}))
+
+// Sets a budget for the memory of the nodes and items that the Store
+// caches, in bytes, or removes the budget when it's 0, which is the
+// default.  The nodes and items read from or written to the file after
+// the budget's set are tracked, and when they're over budget, a
+// goroutine evicts the least recently used ones, which will be read
+// again if needed.  Dirty nodes and items are never evicted.  The
+// evictor excludes mutations, like Compact(), and the freeing of
+// nodes, but not readers, and like EvictSomeItems(), it uses the
+// ItemDecRef callback on evicted items.
+func (s *Store) SetMemoryBudget(budget int64) error {
+	if budget < 0 {
+		return errors.New("memory budget must be non-negative")
+	}
+	if budget == 0 {
+		atomic.StorePointer(&s.cache, nil)
+		return nil
+	}
+	if mc := (*memCache)(atomic.LoadPointer(&s.cache)); mc != nil {
+		mc.m.Lock()
+		mc.budget = budget
+		mc.m.Unlock()
+		return nil
+	}
+	atomic.StorePointer(&s.cache, unsafe.Pointer(&memCache{budget: budget}))
+	return nil
+}
+
+// Marks a cached node or item as recently used.
+func (s *Store) touch(hot *uint32) {
+	if atomic.LoadPointer(&s.cache) != nil && atomic.LoadUint32(hot) == 0 {
+		atomic.StoreUint32(hot, 1)
+	}
+}
+
+func (s *Store) cacheNode(nloc *nodeLoc, n *node) {
+	if mc := (*memCache)(atomic.LoadPointer(&s.cache)); mc != nil {
+		s.cacheEntry(mc, cacheEntry{nloc: nloc, n: n, size: nodeMemSize})
+	}
+}
+
+func (s *Store) cacheItem(c *Collection, iloc *itemLoc, i *Item) {
+	if mc := (*memCache)(atomic.LoadPointer(&s.cache)); mc != nil && i != nil {
+		s.cacheEntry(mc, cacheEntry{c: c, iloc: iloc, i: i,
+			size: itemMemSize + int64(len(i.Key)+len(i.Val))})
+	}
+}
+
+func (s *Store) cacheEntry(mc *memCache, e cacheEntry) {
+	mc.m.Lock()
+	mc.entries = append(mc.entries, e)
+	mc.bytes += e.size
+	if mc.bytes > mc.budget && !mc.running {
+		mc.running = true
+		go s.runEvictor(mc)
+	}
+	mc.m.Unlock()
+}
+
+// Evicts down to 90% of the budget, so the evictor doesn't run again
+// right away, and exits once under budget.
+func (s *Store) runEvictor(mc *memCache) {
+	for {
+		s.mutLock.Lock()
+		mc.m.Lock()
+		s.alloc.freeNodeLock.Lock()
+		mc.evict(s, mc.budget-mc.budget/10)
+		s.alloc.freeNodeLock.Unlock()
+		done := mc.bytes <= mc.budget
+		if done {
+			mc.running = false
+		}
+		mc.m.Unlock()
+		s.mutLock.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+// Sweeps the CLOCK hand over the entries until they're down to target
+// bytes, dropping stale entries and evicting the ones that weren't
+// used since the last sweep.  Holding the mutLock means no node is
+// being mutated or reused by a mutation, and holding the freeNodeLock
+// means no node is being freed, such as by a reader's rootDecRef(),
+// so a nodeLoc or itemLoc that still holds its entry's node or item,
+// and its location, holds a clean copy, whose item isn't also decref'ed
+// by a freeNode.  The locks are taken in the order of mutLock, m, then
+// freeNodeLock.
+func (mc *memCache) evict(s *Store, target int64) {
+	for steps := 2 * len(mc.entries); mc.bytes > target && steps > 0; steps-- {
+		if mc.hand >= len(mc.entries) {
+			mc.hand = 0
+		}
+		e := &mc.entries[mc.hand]
+		if e.nloc != nil {
+			if e.nloc.Node() == e.n && !e.nloc.Loc().isEmpty() {
+				if atomic.SwapUint32(&e.n.hot, 0) != 0 {
+					mc.hand++
+					continue
+				}
+				if atomic.CompareAndSwapPointer(&e.nloc.node,
+					unsafe.Pointer(e.n), unsafe.Pointer(nil)) {
+					mc.numEvictedNodes++
+				}
+			}
+		} else if e.iloc.Item() == e.i && !e.iloc.Loc().isEmpty() {
+			if atomic.SwapUint32(&e.iloc.hot, 0) != 0 {
+				mc.hand++
+				continue
+			}
+			if atomic.CompareAndSwapPointer(&e.iloc.item,
+				unsafe.Pointer(e.i), unsafe.Pointer(nil)) {
+				s.ItemDecRef(e.c, e.i)
+				mc.numEvictedItems++
+			}
+		}
+		mc.bytes -= e.size
+		last := len(mc.entries) - 1
+		mc.entries[mc.hand] = mc.entries[last]
+		mc.entries[last] = cacheEntry{}
+		mc.entries = mc.entries[:last]
+	}
+}
@@ -0,0 +1,181 @@
+package gkvlite
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Waits for the evictor to get the cached bytes within the budget.
+func waitForBudget(t *testing.T, s *Store, budget uint64) map[string]uint64 {
+	stats := map[string]uint64{}
+	for start := time.Now(); time.Since(start) < 5*time.Second; {
+		s.Stats(stats)
+		if stats["cachedBytes"] <= budget {
+			return stats
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected cached bytes within budget: %v, got: %v",
+		budget, stats["cachedBytes"])
+	return nil
+}
+
+func TestMemoryBudget(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 1000; i++ {
+		x.Set([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("v%d", i)))
+	}
+	s.Flush()
+
+	s, _ = NewStore(f)
+	budget := int64(20000)
+	if err := s.SetMemoryBudget(budget); err != nil {
+		t.Fatalf("expected SetMemoryBudget to work, err: %v", err)
+	}
+	x = s.GetCollection("x")
+	visit := func() {
+		n := 0
+		err := x.VisitItemsAscend(nil, true, func(i *Item) bool {
+			if string(i.Val) != fmt.Sprintf("v%d", n) {
+				t.Errorf("unexpected item: %q, %q", i.Key, i.Val)
+			}
+			n++
+			return true
+		})
+		if err != nil || n != 1000 {
+			t.Errorf("expected to visit 1000 items, got: %v, err: %v", n, err)
+		}
+	}
+	visit()
+	stats := waitForBudget(t, s, uint64(budget))
+	if stats["evictedNodes"] == 0 || stats["evictedItems"] == 0 {
+		t.Errorf("expected evictions, got: %v", stats)
+	}
+	visit()
+
+	// Mutations and flushes of partly evicted trees.
+	for i := 0; i < 1000; i += 3 {
+		x.Set([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("v%d", i)))
+	}
+	x.Delete([]byte("0001"))
+	x.Set([]byte("0001"), []byte("v1"))
+	if err := s.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, err: %v", err)
+	}
+	visit()
+	waitForBudget(t, s, uint64(budget))
+	if rep, err := s.Verify(VerifyOptions{Values: true}); err != nil || !rep.OK() {
+		t.Errorf("expected no problems, got: %v, err: %v", rep.Problems, err)
+	}
+
+	if err := s.SetMemoryBudget(-1); err == nil {
+		t.Errorf("expected a negative budget to fail")
+	}
+	s.SetMemoryBudget(0)
+	visit()
+	stats = map[string]uint64{}
+	s.Stats(stats)
+	if _, ok := stats["cachedBytes"]; ok {
+		t.Errorf("expected no cache stats without a budget, got: %v", stats)
+	}
+}
+
+func TestMemoryBudgetConcurrent(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	s, _ := NewStore(f)
+	s.SetMemoryBudget(10000)
+	x := s.SetCollection("x", nil)
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for r := 0; r < 2; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				x.VisitItemsAscend(nil, true, func(i *Item) bool {
+					if string(i.Val) != "v"+string(i.Key) {
+						t.Errorf("unexpected item: %q, %q", i.Key, i.Val)
+						return false
+					}
+					return true
+				})
+			}
+		}()
+	}
+	for j := 0; j < 20; j++ {
+		for i := 0; i < 100; i++ {
+			k := fmt.Sprintf("%d-%d", i, j%5)
+			x.Set([]byte(k), []byte("v"+k))
+		}
+		x.Delete([]byte(fmt.Sprintf("%d-%d", j, (j+1)%5)))
+		if err := s.Flush(); err != nil {
+			t.Errorf("expected Flush to work, err: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	if stats := waitForBudget(t, s, 10000); stats["evictedNodes"] == 0 {
+		t.Errorf("expected evictions, got: %v", stats)
+	}
+	if rep, err := s.Verify(VerifyOptions{Values: true}); err != nil || !rep.OK() {
+		t.Errorf("expected no problems, got: %v, err: %v", rep.Problems, err)
+	}
+}
+
+// The evictor excludes the freeing of nodes, such as by a reader's
+// rootDecRef(), which would also decref the items it evicts.
+func TestMemoryBudgetExcludesFreeNode(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	s, _ := NewStore(f)
+	s.SetMemoryBudget(1 << 30)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 100; i++ {
+		x.Set([]byte(fmt.Sprintf("%03d", i)), []byte("v"))
+	}
+	s.Flush()
+	s.SetMemoryBudget(1000)
+	mc := (*memCache)(atomic.LoadPointer(&s.cache))
+	mc.m.Lock()
+	mc.running = true
+	mc.m.Unlock()
+
+	s.alloc.freeNodeLock.Lock()
+	done := make(chan struct{})
+	go func() {
+		s.runEvictor(mc)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Errorf("expected the evictor to wait while nodes are being freed")
+	case <-time.After(10 * time.Millisecond):
+	}
+	s.alloc.freeNodeLock.Unlock()
+	<-done
+	if stats := waitForBudget(t, s, 1000); stats["evictedNodes"] == 0 {
+		t.Errorf("expected evictions, got: %v", stats)
+	}
+}
@@ -0,0 +1,84 @@
+package gkvlite
+
+import (
+	"errors"
+	"os"
+	"sync"
+)
+
+// Options for OpenFile().
+type OpenOptions struct {
+	ReadOnly bool
+	Create   bool        // Create the file if it doesn't exist.
+	Perm     os.FileMode // Of a created file, default 0666.
+}
+
+// A StoreFile over an os.File that's safe for concurrent readers and a
+// single writer.  Reads and writes run concurrently, while Stat() and
+// Truncate() wait for the writes in flight, so that Stat() sees the
+// size after them, and they don't extend the file after a Truncate().
+type File struct {
+	m    sync.RWMutex // Read-held by ReadAt() and WriteAt().
+	file *os.File
+}
+
+// Opens the file at path as a StoreFile, which is a *File.
+func OpenFile(path string, opts OpenOptions) (StoreFile, error) {
+	flag := os.O_RDWR
+	if opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	if opts.Create {
+		if opts.ReadOnly {
+			return nil, errors.New("cannot create a readonly file")
+		}
+		flag |= os.O_CREATE
+	}
+	perm := opts.Perm
+	if perm == 0 {
+		perm = 0666
+	}
+	f, err := os.OpenFile(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &File{file: f}, nil
+}
+
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	return f.file.ReadAt(p, off)
+}
+
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	return f.file.WriteAt(p, off)
+}
+
+func (f *File) Stat() (os.FileInfo, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.file.Stat()
+}
+
+func (f *File) Truncate(size int64) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.file.Truncate(size)
+}
+
+// Syncs the writes that have completed.
+func (f *File) Sync() error {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	return f.file.Sync()
+}
+
+// Closes the file, after waiting for the reads and writes in flight.
+func (f *File) Close() error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,152 @@
+package gkvlite
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestOpenFile(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	if _, err := OpenFile(fname, OpenOptions{}); err == nil {
+		t.Errorf("expected OpenFile of a missing file to fail")
+	}
+	if _, err := OpenFile(fname, OpenOptions{ReadOnly: true, Create: true}); err == nil {
+		t.Errorf("expected OpenFile to fail to create a readonly file")
+	}
+	f, err := OpenFile(fname, OpenOptions{Create: true})
+	if err != nil {
+		t.Fatalf("expected OpenFile to work, err: %v", err)
+	}
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	loadCollection(x, []string{"e", "d", "a", "c", "b", "c", "a"})
+	if err := s.FlushEx(FlushOptions{Sync: true}); err != nil {
+		t.Errorf("expected Flush with Sync to work, err: %v", err)
+	}
+	if err := f.(*File).Close(); err != nil {
+		t.Errorf("expected Close to work, err: %v", err)
+	}
+
+	f, err = OpenFile(fname, OpenOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("expected OpenFile to work, err: %v", err)
+	}
+	defer f.(*File).Close()
+	s, _ = NewStore(f)
+	visitExpectCollection(t, s.GetCollection("x"), "a",
+		[]string{"a", "b", "c", "d", "e"}, nil)
+	if _, err := f.WriteAt([]byte("x"), 0); err == nil {
+		t.Errorf("expected a write to a readonly file to fail")
+	}
+}
+
+func TestFileConcurrentVisits(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := OpenFile(fname, OpenOptions{Create: true})
+	defer f.(*File).Close()
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	loadCollection(x, []string{"e", "d", "a", "c", "b", "c", "a"})
+	s.Flush()
+
+	s1, _ := NewStore(f)
+	x1 := s1.GetCollection("x")
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := ""
+			x1.VisitItemsAscend([]byte("a"), true, func(i *Item) bool {
+				runtime.Gosched() // Yield to test concurrency.
+				if i.Key[0] >= 'f' {
+					return false
+				}
+				res += string(i.Val)
+				return true
+			})
+			if res != "abcde" {
+				t.Errorf("expected visit of abcde, got: %v", res)
+			}
+		}()
+	}
+	// A single writer, whose sets sort after the visited items.
+	for i := 0; i < 20; i++ {
+		x1.Set([]byte(fmt.Sprintf("f%d", i)), []byte("f"))
+		if err := s1.Flush(); err != nil {
+			t.Errorf("expected Flush to work, err: %v", err)
+		}
+	}
+	wg.Wait()
+	if rep, err := s1.Verify(VerifyOptions{Values: true}); err != nil || !rep.OK() {
+		t.Errorf("expected no problems, got: %v, err: %v", rep.Problems, err)
+	}
+}
+
+func TestFileStatTruncate(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := OpenFile(fname, OpenOptions{Create: true})
+	defer f.(*File).Close()
+	block := bytes.Repeat([]byte("x"), 1000)
+
+	// Stat() sees the sizes between the appends, never within one.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			last := int64(0)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				fi, err := f.Stat()
+				if err != nil {
+					t.Errorf("expected Stat to work, err: %v", err)
+					return
+				}
+				size := fi.Size()
+				if size%int64(len(block)) != 0 || size < last {
+					t.Errorf("unexpected size: %v, last: %v", size, last)
+					return
+				}
+				last = size
+				p := make([]byte, len(block))
+				if size > 0 {
+					if _, err := f.ReadAt(p, size-int64(len(p))); err != nil ||
+						!bytes.Equal(p, block) {
+						t.Errorf("expected to read a block, err: %v", err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	for i := 0; i < 500; i++ {
+		if _, err := f.WriteAt(block, int64(i*len(block))); err != nil {
+			t.Errorf("expected WriteAt to work, err: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if err := f.Truncate(int64(100 * len(block))); err != nil {
+		t.Errorf("expected Truncate to work, err: %v", err)
+	}
+	if fi, _ := f.Stat(); fi.Size() != int64(100*len(block)) {
+		t.Errorf("expected truncated size, got: %v", fi.Size())
+	}
+}
@@ -0,0 +1,146 @@
+package gkvlite
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Writes the bytes appended to the store file since lastOffset as a
+// stream of increments, one per root record, so that a Follower can
+// switch to each root record as it arrives.  The returned nextOffset
+// should be used as the lastOffset of the next ShipSince().  Nothing
+// is written when there are no new root records.  After a Compact(),
+// which switches to a new file, the lastOffset is rejected, and the
+// Follower must be re-seeded from an empty file and a lastOffset of 0.
+// In log mode, like BackupSince(), the log records since the last
+// checkpoint aren't shipped until a Flush() with FlushOptions.Checkpoint.
+func (s *Store) ShipSince(lastOffset int64, w io.Writer) (
+	nextOffset int64, err error) {
+	if s.file() == nil {
+		return 0, errors.New("no file / in-memory only, so cannot ShipSince()")
+	}
+	if err = s.checkRootsEndAt(lastOffset); err != nil {
+		return 0, fmt.Errorf("%v, so re-seed the Follower from an empty file", err)
+	}
+	var cis []*CommitInfo
+	err = s.VisitCommits(func(ci *CommitInfo) bool {
+		if ci.Offset < lastOffset {
+			return false
+		}
+		cis = append(cis, ci)
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	nextOffset = lastOffset
+	for i := len(cis) - 1; i >= 0; i-- { // Oldest root record first.
+		end, err := s.rootsEnd(cis[i])
+		if err != nil {
+			return 0, err
+		}
+		if err = s.writeIncrement(w, cis[i], nextOffset, end); err != nil {
+			return 0, err
+		}
+		nextOffset = end
+	}
+	return nextOffset, nil
+}
+
+// A Follower is a warm standby that applies the increments shipped
+// from a primary Store to its own StoreFile.  Readers should use
+// Follower.Store() for a read-only Store of the latest root record
+// that has been applied.  Increments should be applied by a single
+// goroutine.
+type Follower struct {
+	file      StoreFile
+	callbacks StoreCallbacks
+	m         sync.Mutex     // Serializes Apply()'s.
+	store     unsafe.Pointer // *Store, read-only; swapped on every root record.
+}
+
+// Opens a Follower on a file that's either empty or that holds
+// increments from an earlier Follower.  Any bytes after the file's
+// last good root record, such as from a torn increment, are
+// truncated so shipping can resume from Follower.Offset().
+func NewFollower(file StoreFile, callbacks StoreCallbacks) (*Follower, error) {
+	res := &Follower{file: file, callbacks: callbacks}
+	s, err := res.open()
+	if err != nil {
+		return nil, err
+	}
+	finfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if finfo.Size() != atomic.LoadInt64(&s.size) {
+		if err = file.Truncate(atomic.LoadInt64(&s.size)); err != nil {
+			return nil, err
+		}
+	}
+	atomic.StorePointer(&res.store, unsafe.Pointer(s))
+	return res, nil
+}
+
+func (f *Follower) open() (*Store, error) {
+	coll := make(map[string]*Collection)
+	s := &Store{coll: unsafe.Pointer(&coll),
+		files:     newFileGens(f.file, VERSION),
+		callbacks: f.callbacks, readOnly: true, alloc: &allocator{}}
+	finfo, err := f.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	atomic.StoreInt64(&s.size, finfo.Size())
+	if err = s.readRootsScan(true); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Returns a read-only Store as of the last applied root record.
+func (f *Follower) Store() *Store {
+	return (*Store)(atomic.LoadPointer(&f.store))
+}
+
+// Returns the end offset of the last applied root record, which the
+// primary should use as the lastOffset for its next ShipSince().
+func (f *Follower) Offset() int64 {
+	return atomic.LoadInt64(&f.Store().size)
+}
+
+// Applies a single increment, then switches Follower.Store() to the
+// increment's root record.  An increment of another file than the one
+// the Follower was seeded from, such as after the primary's Compact(),
+// is rejected.
+func (f *Follower) Apply(r io.Reader) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	start, end, err := restoreIncrement(f.file, r)
+	if err != nil || start == end {
+		return err
+	}
+	s, err := f.open()
+	if err != nil {
+		return err
+	}
+	atomic.StorePointer(&f.store, unsafe.Pointer(s))
+	return nil
+}
+
+// Applies increments until the reader reaches io.EOF or an error.
+func (f *Follower) Run(r io.Reader) error {
+	for {
+		err := f.Apply(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package gkvlite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFollowerApply(t *testing.T) {
+	fname := "tmp.test"
+	rname := "tmp-follower.test"
+	os.Remove(fname)
+	os.Remove(rname)
+	defer os.Remove(fname)
+	defer os.Remove(rname)
+	f, _ := os.Create(fname)
+	s, _ := NewStore(f)
+	r, _ := os.Create(rname)
+	fo, err := NewFollower(r, StoreCallbacks{})
+	if err != nil || fo.Offset() != 0 {
+		t.Fatalf("expected NewFollower to work, err: %v", err)
+	}
+
+	x := s.SetCollection("x", nil)
+	x.Set([]byte("a"), []byte("a"))
+	s.Flush()
+	x.Set([]byte("b"), []byte("b"))
+	s.Flush()
+	var buf bytes.Buffer
+	next, err := s.ShipSince(fo.Offset(), &buf)
+	if err != nil {
+		t.Errorf("expected ShipSince to work, err: %v", err)
+	}
+	if err = fo.Apply(&buf); err != nil {
+		t.Errorf("expected first Apply to work, err: %v", err)
+	}
+	first := fo.Store()
+	if first.LastCommitInfo().Seq != 0 {
+		t.Errorf("expected follower at first root, got: %#v",
+			first.LastCommitInfo())
+	}
+	if err = fo.Apply(&buf); err != nil {
+		t.Errorf("expected second Apply to work, err: %v", err)
+	}
+	if fo.Offset() != next {
+		t.Errorf("expected follower offset: %v, got: %v", next, fo.Offset())
+	}
+	if fo.Store().LastCommitInfo().Seq != 1 {
+		t.Errorf("expected follower at second root, got: %#v",
+			fo.Store().LastCommitInfo())
+	}
+	v, err := fo.Store().GetCollection("x").Get([]byte("b"))
+	if err != nil || string(v) != "b" {
+		t.Errorf("expected follower to have b, got: %s, err: %v", v, err)
+	}
+	v, err = first.GetCollection("x").Get([]byte("b"))
+	if err != nil || v != nil {
+		t.Errorf("expected earlier follower store to be isolated, got: %s", v)
+	}
+	if err = fo.Store().GetCollection("x").Set([]byte("c"), []byte("c")); err == nil {
+		t.Errorf("expected follower store to be read only")
+	}
+	if err = fo.Apply(&buf); err != io.EOF {
+		t.Errorf("expected EOF when there's nothing to apply, got: %v", err)
+	}
+	next2, err := s.ShipSince(next, &buf)
+	if err != nil || next2 != next || buf.Len() != 0 {
+		t.Errorf("expected nothing to ship, next2: %v, err: %v", next2, err)
+	}
+
+	// A reopened follower resumes after a torn increment.
+	x.Set([]byte("c"), []byte("c"))
+	s.Flush()
+	s.ShipSince(next, &buf)
+	buf.Truncate(buf.Len() - 10)
+	if err = fo.Apply(&buf); err == nil {
+		t.Errorf("expected torn Apply to fail")
+	}
+	r.WriteAt([]byte("garbage"), next)
+	fo, err = NewFollower(r, StoreCallbacks{})
+	if err != nil || fo.Offset() != next {
+		t.Errorf("expected reopened follower at: %v, got: %v, err: %v",
+			next, fo.Offset(), err)
+	}
+}
+
+func TestFollowerCompact(t *testing.T) {
+	fname, cname := "tmp.test", "tmp-compact.test"
+	rname, r2name := "tmp-follower.test", "tmp-follower2.test"
+	for _, n := range []string{fname, cname, rname, r2name} {
+		os.Remove(n)
+		defer os.Remove(n)
+	}
+	f, _ := os.Create(fname)
+	c, _ := os.Create(cname)
+	r, _ := os.Create(rname)
+	s, _ := NewStore(f)
+	fo, _ := NewFollower(r, StoreCallbacks{})
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 5; i++ {
+		x.Set([]byte("a"), []byte(strconv.Itoa(i)))
+		s.Flush()
+	}
+	var buf bytes.Buffer
+	s.ShipSince(0, &buf)
+	if err := fo.Run(&buf); err != nil {
+		t.Fatalf("expected Run to work, err: %v", err)
+	}
+	last := fo.Offset()
+
+	// An increment of another file, at the follower's offset.
+	x.Set([]byte("b"), []byte("b"))
+	s.Flush()
+	s.ShipSince(last, &buf)
+	binary.BigEndian.PutUint64(buf.Bytes()[len(MAGIC_INC)+16:],
+		s.LastCommitInfo().fileID+1)
+	if err := fo.Apply(&buf); err == nil {
+		t.Errorf("expected Apply of another file's increment to fail")
+	}
+	if fo.Offset() != last {
+		t.Errorf("expected follower to stay at: %v, got: %v", last, fo.Offset())
+	}
+
+	// After a Compact(), the follower's offset is into the old file.
+	if err := s.Compact(c); err != nil {
+		t.Fatalf("expected Compact to work, err: %v", err)
+	}
+	buf.Reset()
+	_, err := s.ShipSince(fo.Offset(), &buf)
+	if err == nil || !strings.Contains(err.Error(), "re-seed") {
+		t.Errorf("expected ShipSince to ask for a re-seed, err: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing shipped")
+	}
+	// Once the new file grows, a root record may end at the offset, so
+	// either ShipSince() or Apply() rejects it.
+	for i := 0; i < 200; i++ {
+		s.GetCollection("x").Set([]byte(strconv.Itoa(i)), []byte("v"))
+		s.Flush()
+	}
+	if _, err = s.ShipSince(fo.Offset(), &buf); err == nil {
+		if err = fo.Run(&buf); err == nil {
+			t.Errorf("expected Apply of the compacted file's increments to fail")
+		}
+	}
+	if fo.Offset() != last {
+		t.Errorf("expected follower to stay at: %v, got: %v", last, fo.Offset())
+	}
+	buf.Reset()
+
+	r2, _ := os.Create(r2name)
+	fo2, _ := NewFollower(r2, StoreCallbacks{})
+	next, err := s.ShipSince(fo2.Offset(), &buf)
+	if err != nil {
+		t.Errorf("expected ShipSince to work, err: %v", err)
+	}
+	if err = fo2.Run(&buf); err != nil || fo2.Offset() != next {
+		t.Errorf("expected re-seeded follower at: %v, got: %v, err: %v",
+			next, fo2.Offset(), err)
+	}
+	v, err := fo2.Store().GetCollection("x").Get([]byte("199"))
+	if err != nil || string(v) != "v" {
+		t.Errorf("expected re-seeded follower to have 199, got: %s, err: %v", v, err)
+	}
+}
+
+func TestFollowerRunPipe(t *testing.T) {
+	fname := "tmp.test"
+	rname := "tmp-follower.test"
+	os.Remove(fname)
+	os.Remove(rname)
+	defer os.Remove(fname)
+	defer os.Remove(rname)
+	f, _ := os.Create(fname)
+	s, _ := NewStore(f)
+	r, _ := os.Create(rname)
+	fo, _ := NewFollower(r, StoreCallbacks{})
+
+	pr, pw := io.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- fo.Run(pr)
+	}()
+	x := s.SetCollection("x", nil)
+	last := fo.Offset()
+	for _, k := range []string{"a", "b", "c", "d"} {
+		x.Set([]byte(k), []byte(k))
+		s.Flush()
+		next, err := s.ShipSince(last, pw)
+		if err != nil {
+			t.Errorf("expected ShipSince to work, err: %v", err)
+		}
+		last = next
+	}
+	pw.Close()
+	if err := <-done; err != nil {
+		t.Errorf("expected Run to work, err: %v", err)
+	}
+	if fo.Offset() != last {
+		t.Errorf("expected follower offset: %v, got: %v", last, fo.Offset())
+	}
+	numItems, _, err := fo.Store().GetCollection("x").GetTotals()
+	if err != nil || numItems != 4 {
+		t.Errorf("expected 4 follower items, got: %v, err: %v", numItems, err)
+	}
+}
@@ -0,0 +1,222 @@
+package gkvlite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"sync/atomic"
+)
+
+// A Store's file can optionally start with a fixed size header of two
+// slots that alternately point to the latest root record, like the
+// meta pages of LMDB, so that opening the file doesn't need to scan
+// backwards for the root record.  The backwards scan remains as the
+// fallback when neither slot is valid.
+var MAGIC_HDR []byte = []byte("7h8d9r")
+
+// Each slot is a sector, so a torn header write damages one slot.
+const headerSlotLength = 512
+
+const headerLength = 2 * headerSlotLength
+
+// A header slot holds MAGIC_HDR, version, seq, the offset and end of
+// the latest root record (an offset of -1 when there are none yet),
+// and a checksum of those.
+type headerSlot struct {
+	seq    uint64
+	offset int64
+	end    int64
+}
+
+// Like NewStoreEx(), but a new, empty file gets a header, which is
+// synced if the file is a Syncer.  Use CopyTo() into a file from
+// NewStoreWithHeader() to add a header to an existing Store.
+// NewStoreEx() detects a file's header, so files with headers can also
+// be opened with NewStore() and NewStoreEx().
+func NewStoreWithHeader(file StoreFile,
+	callbacks StoreCallbacks) (*Store, error) {
+	if file == nil {
+		return nil, errors.New("no file / in-memory only, so cannot have a header")
+	}
+	finfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if finfo.Size() == 0 {
+		b := make([]byte, headerLength)
+		empty := &headerSlot{offset: -1, end: headerLength}
+		empty.write(b[:headerSlotLength])
+		empty.write(b[headerSlotLength:])
+		if _, err = file.WriteAt(b, 0); err != nil {
+			return nil, err
+		}
+		if syncer, ok := file.(Syncer); ok {
+			if err = syncer.Sync(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	s, err := NewStoreEx(file, callbacks)
+	if err != nil {
+		return nil, err
+	}
+	if !s.header {
+		return nil, errors.New("file has no header; use CopyTo() to add one")
+	}
+	return s, nil
+}
+
+func (h *headerSlot) write(b []byte) {
+	copy(b, MAGIC_HDR)
+	pos := len(MAGIC_HDR)
+	binary.BigEndian.PutUint32(b[pos:pos+4], VERSION)
+	pos += 4
+	binary.BigEndian.PutUint64(b[pos:pos+8], h.seq)
+	pos += 8
+	binary.BigEndian.PutUint64(b[pos:pos+8], uint64(h.offset))
+	pos += 8
+	binary.BigEndian.PutUint64(b[pos:pos+8], uint64(h.end))
+	pos += 8
+	binary.BigEndian.PutUint32(b[pos:pos+4], crc32.Checksum(b[:pos], crcTable))
+}
+
+// Returns nil if the slot is invalid, such as from a torn write.
+func readHeaderSlot(b []byte) *headerSlot {
+	pos := len(MAGIC_HDR) + 4 + 8 + 8 + 8
+	if !bytes.Equal(MAGIC_HDR, b[:len(MAGIC_HDR)]) ||
+		binary.BigEndian.Uint32(b[pos:pos+4]) != crc32.Checksum(b[:pos], crcTable) {
+		return nil
+	}
+	pos = len(MAGIC_HDR) + 4
+	h := &headerSlot{}
+	h.seq = binary.BigEndian.Uint64(b[pos : pos+8])
+	pos += 8
+	h.offset = int64(binary.BigEndian.Uint64(b[pos : pos+8]))
+	pos += 8
+	h.end = int64(binary.BigEndian.Uint64(b[pos : pos+8]))
+	return h
+}
+
+// Returns whether the first headerLength bytes of a file are a
+// header, even if a torn write damaged its slots.
+func hasHeader(b []byte) bool {
+	return bytes.Equal(MAGIC_HDR, b[:len(MAGIC_HDR)]) ||
+		readHeaderSlot(b[headerSlotLength:]) != nil
+}
+
+// Returns the offset of the first record of a file of a given size,
+// which is after its header, if any.
+func firstRecord(file StoreFile, size int64) (int64, error) {
+	if size < headerLength {
+		return 0, nil
+	}
+	b := make([]byte, headerLength)
+	if _, err := file.ReadAt(b, 0); err != nil {
+		return 0, err
+	}
+	if hasHeader(b) {
+		return headerLength, nil
+	}
+	return 0, nil
+}
+
+// Returns the offset of the first record, after any header.
+func (o *Store) dataStart() int64 {
+	if o.header {
+		return headerLength
+	}
+	return 0
+}
+
+// Points the next header slot at the latest root record.
+func (o *Store) writeHeader() error {
+	h := &headerSlot{seq: o.headerSeq + 1, offset: -1,
+		end: atomic.LoadInt64(&o.size)}
+	if ci := o.LastCommitInfo(); ci != nil {
+		h.offset = ci.Offset
+	}
+	b := make([]byte, headerSlotLength)
+	h.write(b)
+	if _, err := o.file().WriteAt(b, int64(h.seq%2)*headerSlotLength); err != nil {
+		return err
+	}
+	o.headerSeq = h.seq
+	return nil
+}
+
+// Opens the latest root record from a header, returning false when
+// the file has no header or when no header slot is valid.  Root
+// records after the header's root record, such as from a crash before
+// the header write or from log shipping, are found by checking only
+// the end of the file, so opening takes constant time.
+func (o *Store) readHeader() (bool, error) {
+	size := atomic.LoadInt64(&o.size)
+	if size < headerLength {
+		return false, nil
+	}
+	b := make([]byte, headerLength)
+	if _, err := o.file().ReadAt(b, 0); err != nil {
+		return false, err
+	}
+	slots := []*headerSlot{
+		readHeaderSlot(b[:headerSlotLength]),
+		readHeaderSlot(b[headerSlotLength:]),
+	}
+	if slots[0] == nil && slots[1] == nil {
+		// Perhaps a torn write of both slots when the file was new.
+		o.header = hasHeader(b)
+		return false, nil
+	}
+	o.header = true
+	if slots[0] == nil || (slots[1] != nil && slots[1].seq > slots[0].seq) {
+		slots[0], slots[1] = slots[1], slots[0]
+	}
+	for _, h := range slots {
+		if h == nil || h.end < headerLength || h.end > size {
+			continue
+		}
+		if h.end < size {
+			if ok, err := o.readRootsEnd(h.end, size); ok || err != nil {
+				o.headerSeq = h.seq
+				return ok, err
+			}
+		}
+		if h.offset < 0 {
+			if h.end != headerLength {
+				continue
+			}
+			atomic.StoreInt64(&o.size, headerLength)
+			atomic.StorePointer(&o.lastCommit, nil)
+			o.setVersion(VERSION)
+			o.headerSeq = h.seq
+			return true, nil
+		}
+		if ok, err := o.readRootsEnd(h.offset, h.end); ok || err != nil {
+			o.headerSeq = h.seq
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// Opens the root record that ends exactly at end, if it starts at or
+// after start, returning false if there's no such valid root record.
+func (o *Store) readRootsEnd(start, end int64) (bool, error) {
+	if end-start < rootsLen {
+		return false, nil
+	}
+	rootsEnd := make([]byte, rootsEndLen)
+	if _, err := o.file().ReadAt(rootsEnd, end-int64(rootsEndLen)); err != nil {
+		return false, err
+	}
+	offset := int64(binary.BigEndian.Uint64(rootsEnd[:8]))
+	if offset < start || offset > end-rootsLen {
+		return false, nil
+	}
+	data, err := o.readRootsAt(offset)
+	if err != nil || offset+int64(len(data)+rootsEndLen) != end {
+		return false, nil
+	}
+	return o.useRoots(offset, data) == nil, nil
+}
@@ -0,0 +1,168 @@
+package gkvlite
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func headerStore(t *testing.T, fname string) (*os.File, *Store) {
+	os.Remove(fname)
+	f, _ := os.Create(fname)
+	s, err := NewStoreWithHeader(f, StoreCallbacks{})
+	if err != nil || !s.header || s.size != headerLength {
+		t.Fatalf("expected NewStoreWithHeader to work, err: %v", err)
+	}
+	return f, s
+}
+
+func headerFlushes(s *Store, n int) (commits []int64) {
+	x := s.SetCollection("x", nil)
+	for j := 0; j < n; j++ {
+		x.Set([]byte(fmt.Sprintf("%d", j)), []byte("v"))
+		s.Flush()
+		commits = append(commits, s.LastCommitInfo().Offset)
+	}
+	return commits
+}
+
+func headerReopen(t *testing.T, fname string) (*mockfile, *Store) {
+	f, _ := os.OpenFile(fname, os.O_RDWR, 0666)
+	m := &mockfile{f: f}
+	s, err := NewStore(m)
+	if err != nil || !s.header {
+		t.Fatalf("expected reopen with header to work, err: %v", err)
+	}
+	return m, s
+}
+
+func TestHeaderOpen(t *testing.T) {
+	fname := "tmp.test"
+	defer os.Remove(fname)
+	f, s := headerStore(t, fname)
+	commits := headerFlushes(s, 3)
+	end := s.size
+	f.WriteAt(make([]byte, 100000), end) // A garbage tail.
+	f.Close()
+
+	m, s := headerReopen(t, fname)
+	defer m.f.Close()
+	if s.LastCommitInfo().Offset != commits[2] || s.size != end {
+		t.Errorf("expected header's root, got: %#v", s.LastCommitInfo())
+	}
+	if m.numReadAt > 10 {
+		t.Errorf("expected constant time open, numReadAt: %v", m.numReadAt)
+	}
+	if v, err := s.GetCollection("x").Get([]byte("2")); err != nil || v == nil {
+		t.Errorf("expected Get after reopen to work, err: %v", err)
+	}
+	s.GetCollection("x").Set([]byte("3"), []byte("v"))
+	if err := s.Flush(); err != nil || s.headerSeq != 4 {
+		t.Errorf("expected Flush to write header slot 4, err: %v", err)
+	}
+}
+
+func TestHeaderTornSlots(t *testing.T) {
+	fname := "tmp.test"
+	defer os.Remove(fname)
+	f, s := headerStore(t, fname)
+	commits := headerFlushes(s, 3)
+	// Seq 3 is in slot 1, so the other slot points to the previous root,
+	// and the end of the file still finds the latest root.
+	f.WriteAt([]byte("torn"), headerSlotLength+10)
+	f.Close()
+	m, s := headerReopen(t, fname)
+	if s.LastCommitInfo().Offset != commits[2] || s.headerSeq != 2 {
+		t.Errorf("expected latest root with a torn slot, got: %#v, seq: %v",
+			s.LastCommitInfo(), s.headerSeq)
+	}
+	m.f.WriteAt([]byte("torn"), 10)
+	m.f.WriteAt(make([]byte, 100), s.size)
+	m.f.Close()
+	m, s = headerReopen(t, fname)
+	defer m.f.Close()
+	if s.LastCommitInfo().Offset != commits[2] {
+		t.Errorf("expected backwards scan with torn slots, got: %#v",
+			s.LastCommitInfo())
+	}
+}
+
+func TestHeaderStale(t *testing.T) {
+	fname := "tmp.test"
+	defer os.Remove(fname)
+	f, s := headerStore(t, fname)
+	headerFlushes(s, 1)
+	stale := make([]byte, headerLength)
+	f.ReadAt(stale, 0)
+	commits := headerFlushes(s, 2)
+	// Such as a crash before the header write, or log shipping.
+	f.WriteAt(stale, 0)
+	f.Close()
+	m, s := headerReopen(t, fname)
+	defer m.f.Close()
+	if s.LastCommitInfo().Offset != commits[1] {
+		t.Errorf("expected the root at the end, got: %#v", s.LastCommitInfo())
+	}
+}
+
+func TestHeaderRevertCompact(t *testing.T) {
+	fname := "tmp.test"
+	defer os.Remove(fname)
+	defer os.Remove(fname + ".compact")
+	f, s := headerStore(t, fname)
+	commits := headerFlushes(s, 3)
+	if err := s.FlushRevert(); err != nil || s.LastCommitInfo().Offset != commits[1] {
+		t.Errorf("expected FlushRevert to work, err: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.FlushRevert(); err != nil {
+			t.Errorf("expected FlushRevert to work, err: %v", err)
+		}
+	}
+	if s.LastCommitInfo() != nil || s.size != headerLength {
+		t.Errorf("expected FlushRevert to empty, got: %#v", s.LastCommitInfo())
+	}
+	headerFlushes(s, 2)
+
+	d, _ := os.Create(fname + ".compact")
+	if err := s.Compact(d); err != nil || !s.header {
+		t.Errorf("expected Compact to keep the header, err: %v", err)
+	}
+	f.Close()
+	d.Close()
+	os.Rename(fname+".compact", fname)
+	m, s := headerReopen(t, fname)
+	defer m.f.Close()
+	if v, err := s.GetCollection("x").Get([]byte("1")); err != nil || v == nil {
+		t.Errorf("expected Get after Compact to work, err: %v", err)
+	}
+}
+
+func TestHeaderExistingFile(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	s, _ := NewStore(f)
+	headerFlushes(s, 2)
+	if _, err := NewStoreWithHeader(f, StoreCallbacks{}); err == nil {
+		t.Errorf("expected NewStoreWithHeader on a file without header to fail")
+	}
+	if _, err := NewStoreWithHeader(nil, StoreCallbacks{}); err == nil {
+		t.Errorf("expected NewStoreWithHeader without a file to fail")
+	}
+
+	os.Remove(fname + ".copy")
+	defer os.Remove(fname + ".copy")
+	d, _ := os.Create(fname + ".copy")
+	defer d.Close()
+	NewStoreWithHeader(d, StoreCallbacks{})
+	if _, err := s.CopyTo(d, 1); err != nil {
+		t.Errorf("expected CopyTo a file with header to work, err: %v", err)
+	}
+	s2, err := NewStore(d)
+	if err != nil || !s2.header || s2.GetCollection("x") == nil {
+		t.Errorf("expected CopyTo to add a header, err: %v", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"sync/atomic"
 	"unsafe"
 )
@@ -19,6 +20,7 @@ type Item struct {
 type itemLoc struct {
 	loc  unsafe.Pointer // *ploc - can be nil if item is dirty (not yet persisted).
 	item unsafe.Pointer // *Item - can be nil if item is not fetched into memory yet.
+	hot  uint32         // Atomic protected; see SetMemoryBudget().
 }
 
 var empty_itemLoc = &itemLoc{}
@@ -65,7 +67,20 @@ func (i *itemLoc) Copy(src *itemLoc) {
 
 const itemLoc_hdrLength int = 4 + 2 + 4 + 4
 
-func (i *itemLoc) write(c *Collection) (err error) {
+// Returns the item header length of a file format version, where
+// VERSION_CRC adds value and header checksums, and VERSION_REC
+// replaces the length with a record header.
+func itemLocHdrLength(version uint32) int {
+	if version >= VERSION_REC {
+		return itemLoc_hdrLength - 4 + recHdrLength + 4 + 4
+	}
+	if version >= VERSION_CRC {
+		return itemLoc_hdrLength + 4 + 4
+	}
+	return itemLoc_hdrLength
+}
+
+func (i *itemLoc) write(c *Collection, rw *recWriter) (err error) {
 	if i.Loc().isEmpty() {
 		iItem := i.Item()
 		if iItem == nil {
@@ -77,40 +92,71 @@ func (i *itemLoc) write(c *Collection) (err error) {
 				return err
 			}
 		}
-		offset := atomic.LoadInt64(&c.store.size)
-		hlength := itemLoc_hdrLength + len(iItem.Key)
+		w := rw.w
+		offset := atomic.LoadInt64(rw.pos)
+		hdrLength := itemLocHdrLength(c.store.version())
+		hlength := hdrLength + len(iItem.Key)
 		vlength := iItem.NumValBytes(c)
 		ilength := hlength + vlength
 		b := make([]byte, hlength)
 		pos := 0
-		binary.BigEndian.PutUint32(b[pos:pos+4], uint32(ilength))
-		pos += 4
+		if c.store.version() >= VERSION_REC {
+			pos = putRecHdr(b, RecordItem, uint32(ilength))
+		} else {
+			binary.BigEndian.PutUint32(b[pos:pos+4], uint32(ilength))
+			pos += 4
+		}
 		binary.BigEndian.PutUint16(b[pos:pos+2], uint16(len(iItem.Key)))
 		pos += 2
 		binary.BigEndian.PutUint32(b[pos:pos+4], uint32(vlength))
 		pos += 4
 		binary.BigEndian.PutUint32(b[pos:pos+4], uint32(iItem.Priority))
 		pos += 4
+		if hdrLength > itemLoc_hdrLength {
+			// The value is written first, so its checksum can go into
+			// the header.
+			vcrc, err := c.store.itemValWriteCRC(c, iItem, w, w,
+				offset+int64(hlength), vlength)
+			if err != nil {
+				return err
+			}
+			binary.BigEndian.PutUint32(b[pos:pos+4], vcrc)
+			pos += 4
+			binary.BigEndian.PutUint32(b[pos:pos+4],
+				crc32.Update(itemHdrCRC(b, pos), crcTable, iItem.Key))
+			pos += 4
+		}
 		pos += copy(b[pos:], iItem.Key)
 		if pos != hlength {
 			return fmt.Errorf("itemLoc.write() pos: %v didn't match hlength: %v",
 				pos, hlength)
 		}
-		if _, err := c.store.file.WriteAt(b, offset); err != nil {
+		if _, err := w.WriteAt(b, offset); err != nil {
 			return err
 		}
-		err := c.store.ItemValWrite(c, iItem, c.store.file, offset+int64(pos))
-		if err != nil {
-			return err
+		if hdrLength == itemLoc_hdrLength {
+			err := c.store.ItemValWrite(c, iItem, w, offset+int64(pos))
+			if err != nil {
+				return err
+			}
 		}
-		atomic.StoreInt64(&c.store.size, offset+int64(ilength))
-		atomic.StorePointer(&i.loc,
-			unsafe.Pointer(&ploc{Offset: offset, Length: uint32(ilength)}))
+		atomic.StoreInt64(rw.pos, offset+int64(ilength))
+		atomic.StorePointer(&i.loc, unsafe.Pointer(&ploc{
+			Offset: offset, Length: uint32(ilength), gen: c.store.gen()}))
+		c.store.cacheItem(c, i, i.Item())
 	}
 	return nil
 }
 
 func (iloc *itemLoc) read(c *Collection, withValue bool) (icur *Item, err error) {
+	return iloc.readFrom(c, withValue, nil)
+}
+
+// Reads like read(), but from the given file, when it's not nil, which
+// stands in for the file generation of the item, such as to serve the
+// item from a larger read.
+func (iloc *itemLoc) readFrom(c *Collection, withValue bool,
+	from StoreFile) (icur *Item, err error) {
 	if iloc == nil {
 		return nil, nil
 	}
@@ -120,48 +166,89 @@ func (iloc *itemLoc) read(c *Collection, withValue bool) (icur *Item, err error)
 		if loc.isEmpty() {
 			return nil, nil
 		}
-		if loc.Length < uint32(itemLoc_hdrLength) {
+		fg := c.store.fileAt(loc.gen)
+		file := fg.file
+		if from != nil {
+			file = from
+		}
+		hdrLength := itemLocHdrLength(fg.version)
+		if loc.Length < uint32(hdrLength) {
 			return nil, fmt.Errorf("unexpected item loc.Length: %v < %v",
-				loc.Length, itemLoc_hdrLength)
+				loc.Length, hdrLength)
 		}
-		b := make([]byte, itemLoc_hdrLength)
-		if _, err := c.store.file.ReadAt(b, loc.Offset); err != nil {
+		b := make([]byte, hdrLength)
+		if _, err := file.ReadAt(b, loc.Offset); err != nil {
 			return nil, err
 		}
 		pos := 0
-		length := binary.BigEndian.Uint32(b[pos : pos+4])
-		pos += 4
+		var length uint32
+		if fg.version >= VERSION_REC {
+			length, err = readRecHdr(b, RecordItem, loc.Offset, "item")
+			if err != nil {
+				return nil, err
+			}
+			pos += recHdrLength
+		} else {
+			length = binary.BigEndian.Uint32(b[pos : pos+4])
+			pos += 4
+		}
 		keyLength := binary.BigEndian.Uint16(b[pos : pos+2])
 		pos += 2
 		valLength := binary.BigEndian.Uint32(b[pos : pos+4])
 		pos += 4
-		i := c.store.ItemAlloc(c, keyLength)
+		i, sliced := c.store.itemAllocAt(c, keyLength,
+			file, loc.Offset+int64(hdrLength))
 		if i == nil {
 			return nil, errors.New("ItemAlloc() failed")
 		}
 		i.Priority = int32(binary.BigEndian.Uint32(b[pos : pos+4]))
 		pos += 4
-		if length != uint32(itemLoc_hdrLength)+uint32(keyLength)+valLength {
+		var vcrc, hcrc uint32
+		if hdrLength > itemLoc_hdrLength {
+			vcrc = binary.BigEndian.Uint32(b[pos : pos+4])
+			pos += 4
+			hcrc = binary.BigEndian.Uint32(b[pos : pos+4])
+			pos += 4
+		}
+		if length != uint32(hdrLength)+uint32(keyLength)+valLength {
 			c.store.ItemDecRef(c, i)
+			if hdrLength > itemLoc_hdrLength {
+				return nil, &ErrChecksum{Offset: loc.Offset, Kind: "item"}
+			}
 			return nil, errors.New("mismatched itemLoc lengths")
 		}
-		if pos != itemLoc_hdrLength {
+		if pos != hdrLength {
 			c.store.ItemDecRef(c, i)
 			return nil, fmt.Errorf("read pos != itemLoc_hdrLength, %v != %v",
-				pos, itemLoc_hdrLength)
+				pos, hdrLength)
+		}
+		if !sliced {
+			if _, err := file.ReadAt(i.Key,
+				loc.Offset+int64(hdrLength)); err != nil {
+				c.store.ItemDecRef(c, i)
+				return nil, err
+			}
 		}
-		if _, err := c.store.file.ReadAt(i.Key,
-			loc.Offset+int64(itemLoc_hdrLength)); err != nil {
+		if hdrLength > itemLoc_hdrLength &&
+			hcrc != crc32.Update(itemHdrCRC(b, pos-4), crcTable, i.Key) {
 			c.store.ItemDecRef(c, i)
-			return nil, err
+			return nil, &ErrChecksum{Offset: loc.Offset, Kind: "item"}
 		}
 		if withValue {
-			err := c.store.ItemValRead(c, i, c.store.file,
-				loc.Offset+int64(itemLoc_hdrLength)+int64(keyLength), valLength)
+			err := c.store.ItemValRead(c, i, file,
+				loc.Offset+int64(hdrLength)+int64(keyLength), valLength)
 			if err != nil {
 				c.store.ItemDecRef(c, i)
 				return nil, err
 			}
+			// Values from an ItemValRead callback might be elsewhere,
+			// such as decompressed, so only the default is verified.
+			if hdrLength > itemLoc_hdrLength &&
+				c.store.callbacks.ItemValRead == nil &&
+				vcrc != crc32.Checksum(i.Val, crcTable) {
+				c.store.ItemDecRef(c, i)
+				return nil, &ErrChecksum{Offset: loc.Offset, Kind: "item value"}
+			}
 		}
 		if c.store.callbacks.AfterItemRead != nil {
 			i, err = c.store.callbacks.AfterItemRead(c, i)
@@ -173,13 +260,15 @@ func (iloc *itemLoc) read(c *Collection, withValue bool) (icur *Item, err error)
 		if !atomic.CompareAndSwapPointer(&iloc.item,
 			unsafe.Pointer(icur), unsafe.Pointer(i)) {
 			c.store.ItemDecRef(c, i)
-			return iloc.read(c, withValue)
+			return iloc.readFrom(c, withValue, from)
 		}
 		if icur != nil {
 			c.store.ItemDecRef(c, icur)
 		}
-		icur = i
+		c.store.cacheItem(c, iloc, i)
+		return i, nil
 	}
+	c.store.touch(&iloc.hot)
 	return icur, nil
 }
 
@@ -192,5 +281,11 @@ func (iloc *itemLoc) NumBytes(c *Collection) int {
 		}
 		return i.NumBytes(c)
 	}
-	return int(loc.Length) - itemLoc_hdrLength
+	return int(loc.Length) - itemLocHdrLength(c.store.fileAt(loc.gen).version)
+}
+
+// Returns the checksum of an item header's first n bytes, which
+// covers everything but the header checksum itself and the key.
+func itemHdrCRC(b []byte, n int) uint32 {
+	return crc32.Checksum(b[:n], crcTable)
 }
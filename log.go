@@ -0,0 +1,362 @@
+package gkvlite
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Configures log mode; see Store.SetLogMode().  Besides the other
+// reasons for a checkpoint, a checkpoint is due when the log records
+// since the last checkpoint reach CheckpointBytes or CheckpointFlushes
+// in number (if > 0).
+type LogOptions struct {
+	CheckpointBytes   int64
+	CheckpointFlushes int
+}
+
+type logDelete struct {
+	c   *Collection
+	key []byte
+}
+
+type logSet struct {
+	name   string
+	offset int64
+	length uint32
+}
+
+// Tracks the log records since the last checkpoint.
+type logState struct {
+	checkpoint bool                   // When true, the next Flush() is a checkpoint.
+	colls      map[string]*Collection // The Collections of the last checkpoint.
+	gen        uint32                 // The file generation of the last checkpoint.
+	bytes      int64
+	flushes    int
+}
+
+// Log record entry ops.
+const (
+	logOpSet    = byte('s')
+	logOpDelete = byte('d')
+)
+
+// Switches log mode on, or off when opts is nil.  In log mode, a
+// Flush() appends just the new items and a log record of the set and
+// deleted keys, instead of also rewriting the treap nodes on the paths
+// from the changed items up to the roots, so small, frequent Flush()'es
+// write much less.  The treap nodes and a root record are written at
+// checkpoints, which are a Flush() with FlushOptions.Checkpoint or
+// Meta, when the LogOptions thresholds are reached, or when the
+// Collections were added, removed or re-set.  Until a checkpoint, the
+// unpersisted nodes stay in memory.  Opening a Store replays the log
+// records after its last root record, so Collections with a custom
+// KeyCompare need StoreCallbacks.KeyCompareForCollection.  Log records
+// don't change LastCommitInfo() and a Follower sees them only at the
+// next checkpoint.  Needs file format version >= VERSION_REC.
+func (s *Store) SetLogMode(opts *LogOptions) error {
+	if s.readOnly {
+		return errors.New("readonly, so cannot SetLogMode()")
+	}
+	if s.file() == nil {
+		return errors.New("no file / in-memory only, so cannot SetLogMode()")
+	}
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+	if opts != nil {
+		if s.version() < VERSION_REC {
+			return fmt.Errorf("log mode needs file format version >= %v;"+
+				" use Compact() to upgrade", VERSION_REC)
+		}
+		o := *opts
+		opts = &o
+	}
+	atomic.StorePointer(&s.logOpts, unsafe.Pointer(opts))
+	// Deletes before the switch are covered by the next checkpoint.
+	s.log.checkpoint = true
+	s.takeLogDeletes()
+	return nil
+}
+
+func (s *Store) logDelete(c *Collection, key []byte) {
+	if atomic.LoadPointer(&s.logOpts) == nil {
+		return
+	}
+	s.logLock.Lock()
+	s.logDeletes = append(s.logDeletes, logDelete{c, append([]byte(nil), key...)})
+	s.logLock.Unlock()
+}
+
+func (s *Store) takeLogDeletes() []logDelete {
+	s.logLock.Lock()
+	deletes := s.logDeletes
+	s.logDeletes = nil
+	s.logLock.Unlock()
+	return deletes
+}
+
+func (l *logState) due(s *Store, opts *LogOptions,
+	coll map[string]*Collection) bool {
+	if l.checkpoint || s.LastCommitInfo() == nil || l.gen != s.gen() ||
+		len(coll) != len(l.colls) {
+		return true
+	}
+	for name, c := range coll {
+		if l.colls[name] != c {
+			return true
+		}
+	}
+	return opts.CheckpointBytes > 0 && l.bytes >= opts.CheckpointBytes ||
+		opts.CheckpointFlushes > 0 && l.flushes >= opts.CheckpointFlushes
+}
+
+func (l *logState) checkpointed(s *Store, coll map[string]*Collection) {
+	*l = logState{colls: coll, gen: s.gen()}
+}
+
+// In log mode, writes a log record unless a checkpoint is due,
+// returning true if it did.  Deletes and sets are taken before the
+// roots, so the log record might also hold later mutations, which is
+// harmless as replaying a set or delete twice gives the same result.
+func (s *Store) flushLog(syncer Syncer, opts FlushOptions) (bool, error) {
+	lopts := (*LogOptions)(atomic.LoadPointer(&s.logOpts))
+	if lopts == nil {
+		return false, nil
+	}
+	deletes := s.takeLogDeletes()
+	coll := *(*map[string]*Collection)(atomic.LoadPointer(&s.coll))
+	// Until the log record is written, such as after an error, the
+	// next Flush() is a checkpoint, which covers everything.
+	due := opts.Checkpoint || opts.Meta != nil || s.log.due(s, lopts, coll)
+	s.log.checkpoint = true
+	if due {
+		return false, nil
+	}
+	var err error
+	var sets []logSet
+	rw := s.recWriter()
+	for _, name := range collNames(coll) {
+		c := coll[name]
+		rnl := c.rootAddRef()
+		sets, err = c.writeLogItems(rnl.root, rw, sets)
+		c.rootDecRef(rnl)
+		if err != nil {
+			return true, err
+		}
+	}
+	if err = s.flushBuffer(); err != nil {
+		return true, err
+	}
+	n := recHdrLength + 4 + 4
+	for _, d := range deletes {
+		if coll[d.c.name] == d.c {
+			n += 1 + 2 + len(d.c.name) + 2 + len(d.key)
+		}
+	}
+	for _, set := range sets {
+		n += 1 + 2 + len(set.name) + 8 + 4
+	}
+	b := make([]byte, n)
+	pos := putRecHdr(b, RecordLog, uint32(n))
+	pos += 4 // The number of entries goes here.
+	count := 0
+	for _, d := range deletes {
+		if coll[d.c.name] == d.c {
+			pos = putLogEntry(b, pos, logOpDelete, d.c.name)
+			binary.BigEndian.PutUint16(b[pos:pos+2], uint16(len(d.key)))
+			pos += 2
+			pos += copy(b[pos:], d.key)
+			count++
+		}
+	}
+	for _, set := range sets {
+		pos = putLogEntry(b, pos, logOpSet, set.name)
+		binary.BigEndian.PutUint64(b[pos:pos+8], uint64(set.offset))
+		pos += 8
+		binary.BigEndian.PutUint32(b[pos:pos+4], set.length)
+		pos += 4
+		count++
+	}
+	if count == 0 {
+		s.log.checkpoint = false
+		return true, nil
+	}
+	binary.BigEndian.PutUint32(b[recHdrLength:recHdrLength+4], uint32(count))
+	binary.BigEndian.PutUint32(b[pos:pos+4], crc32.Checksum(b[:pos], crcTable))
+	if syncer != nil { // The items are durable before the log record.
+		if err = s.syncItems(syncer); err != nil {
+			return true, err
+		}
+	}
+	offset := atomic.LoadInt64(&s.size)
+	if _, err = s.file().WriteAt(b, offset); err != nil {
+		return true, err
+	}
+	atomic.StoreInt64(&s.size, offset+int64(len(b)))
+	if syncer != nil {
+		if err = syncer.Sync(); err != nil {
+			return true, err
+		}
+	}
+	s.log.checkpoint = false
+	s.log.bytes += int64(len(b))
+	s.log.flushes++
+	return true, nil
+}
+
+func putLogEntry(b []byte, pos int, op byte, name string) int {
+	b[pos] = op
+	binary.BigEndian.PutUint16(b[pos+1:pos+3], uint16(len(name)))
+	return pos + 3 + copy(b[pos+3:], name)
+}
+
+// Like writeItems(), but also appends the locations of the newly
+// written items.
+func (t *Collection) writeLogItems(nloc *nodeLoc, rw *recWriter,
+	sets []logSet) ([]logSet, error) {
+	if nloc == nil || !nloc.Loc().isEmpty() {
+		return sets, nil
+	}
+	node := nloc.Node()
+	if node == nil {
+		return sets, nil
+	}
+	sets, err := t.writeLogItems(&node.left, rw, sets)
+	if err != nil {
+		return sets, err
+	}
+	if node.item.Loc().isEmpty() {
+		if err = node.item.write(t, rw); err != nil {
+			return sets, err
+		}
+		loc := node.item.Loc()
+		sets = append(sets, logSet{t.name, loc.Offset, loc.Length})
+	}
+	return t.writeLogItems(&node.right, rw, sets)
+}
+
+// Applies the log records after the last root record, up to the file
+// size.  A torn log record, such as from a crash during a Flush(),
+// ends the log, and the next write goes over it.
+func (o *Store) replayLog(size int64) error {
+	if o.version() < VERSION_REC {
+		return nil
+	}
+	end := int64(-1)
+	var err error
+	verr := visitRecords(o.file(), atomic.LoadInt64(&o.size), size, func(r *Record) bool {
+		if r.Type != RecordLog {
+			return true
+		}
+		var ok bool
+		if ok, err = o.replayLogRecord(r); !ok || err != nil {
+			return false
+		}
+		end = r.Offset + int64(r.Length)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if _, ok := verr.(*ErrChecksum); verr != nil && !ok {
+		return verr
+	}
+	if end >= 0 {
+		atomic.StoreInt64(&o.size, end)
+		atomic.StoreInt64(&o.dirtyItems, 0) // The log made them durable.
+		atomic.StoreInt64(&o.dirtyBytes, 0)
+	}
+	return nil
+}
+
+// Returns false if the log record's checksum is wrong.
+func (o *Store) replayLogRecord(r *Record) (bool, error) {
+	return o.parseLogRecord(r, func(name string, key []byte, loc *ploc) error {
+		c := o.GetCollection(name)
+		if c == nil {
+			return fmt.Errorf("log record at offset: %v for missing collection: %q",
+				r.Offset, name)
+		}
+		if loc == nil {
+			_, err := c.Delete(key)
+			return err
+		}
+		iloc := &itemLoc{loc: unsafe.Pointer(loc)}
+		i, err := iloc.read(c, false)
+		if err != nil {
+			return err
+		}
+		err = c.setItem(i, loc, uint64(iloc.NumBytes(c)))
+		o.ItemDecRef(c, i)
+		return err
+	})
+}
+
+// Calls fn for each entry of a log record, in order, with the key of a
+// delete, or the location of a set's item and a nil key.  Returns
+// false if the log record's checksum is wrong.
+func (o *Store) parseLogRecord(r *Record,
+	fn func(name string, key []byte, loc *ploc) error) (bool, error) {
+	b := make([]byte, r.Length)
+	if _, err := o.file().ReadAt(b, r.Offset); err != nil {
+		return false, err
+	}
+	if len(b) < recHdrLength+4+4 ||
+		binary.BigEndian.Uint32(b[len(b)-4:]) != crc32.Checksum(b[:len(b)-4], crcTable) {
+		return false, nil
+	}
+	count := binary.BigEndian.Uint32(b[recHdrLength : recHdrLength+4])
+	pos := recHdrLength + 4
+	end := len(b) - 4
+	errBad := fmt.Errorf("bad log record at offset: %v", r.Offset)
+	for ; count > 0; count-- {
+		if pos+3 > end {
+			return false, errBad
+		}
+		op := b[pos]
+		nameLength := int(binary.BigEndian.Uint16(b[pos+1 : pos+3]))
+		pos += 3
+		if pos+nameLength > end {
+			return false, errBad
+		}
+		name := string(b[pos : pos+nameLength])
+		pos += nameLength
+		switch op {
+		case logOpDelete:
+			if pos+2 > end {
+				return false, errBad
+			}
+			keyLength := int(binary.BigEndian.Uint16(b[pos : pos+2]))
+			pos += 2
+			if pos+keyLength > end {
+				return false, errBad
+			}
+			if err := fn(name, b[pos:pos+keyLength], nil); err != nil {
+				return false, err
+			}
+			pos += keyLength
+		case logOpSet:
+			if pos+12 > end {
+				return false, errBad
+			}
+			loc := &ploc{Offset: int64(binary.BigEndian.Uint64(b[pos : pos+8])),
+				Length: binary.BigEndian.Uint32(b[pos+8 : pos+12]), gen: o.gen()}
+			pos += 12
+			if loc.Offset < o.dataStart() || loc.Offset+int64(loc.Length) > r.Offset {
+				return false, errBad
+			}
+			if err := fn(name, nil, loc); err != nil {
+				return false, err
+			}
+		default:
+			return false, errBad
+		}
+	}
+	if pos != end {
+		return false, errBad
+	}
+	return true, nil
+}
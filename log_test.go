@@ -0,0 +1,231 @@
+package gkvlite
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// Returns the record types written at or after an offset.
+func recordTypes(t *testing.T, f StoreFile, start int64) string {
+	types := ""
+	err := VisitRecords(f, start, func(r *Record) bool {
+		types += string(r.Type)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("expected VisitRecords to work, err: %v", err)
+	}
+	return types
+}
+
+func TestLogMode(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	mem, _ := NewStore(nil)
+	if err := mem.SetLogMode(&LogOptions{}); err == nil {
+		t.Errorf("expected memory-only SetLogMode to fail")
+	}
+	s, _ := NewStore(f)
+	if err := s.SetLogMode(&LogOptions{}); err != nil {
+		t.Fatalf("expected SetLogMode to work, err: %v", err)
+	}
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 10; i++ {
+		x.Set([]byte(fmt.Sprintf("%d", i)), []byte("a"))
+	}
+	s.Flush()
+	if ci := s.LastCommitInfo(); ci == nil || ci.Seq != 0 {
+		t.Fatalf("expected the first Flush to be a checkpoint, got: %#v", ci)
+	}
+	end := s.size
+	x.Set([]byte("0"), []byte("b"))
+	x.Set([]byte("10"), []byte("b"))
+	x.Delete([]byte("1"))
+	x.Delete([]byte("10"))
+	x.Set([]byte("10"), []byte("c"))
+	if err := s.Flush(); err != nil {
+		t.Fatalf("expected a log Flush to work, err: %v", err)
+	}
+	if s.LastCommitInfo().Seq != 0 {
+		t.Errorf("expected a log Flush not to write a root record")
+	}
+	if got := recordTypes(t, f, end); got != "iil" {
+		t.Errorf("expected only items and a log record, got: %q", got)
+	}
+	end = s.size
+	if err := s.Flush(); err != nil || s.size != end {
+		t.Errorf("expected a Flush without mutations to write nothing, err: %v", err)
+	}
+	x.Delete([]byte("2"))
+	s.Flush()
+
+	expect := func(s *Store, step string) {
+		x := s.GetCollection("x")
+		for i := 0; i < 11; i++ {
+			exp := "a"
+			switch i {
+			case 0:
+				exp = "b"
+			case 1, 2:
+				exp = ""
+			case 10:
+				exp = "c"
+			}
+			v, err := x.Get([]byte(fmt.Sprintf("%d", i)))
+			if err != nil || string(v) != exp {
+				t.Errorf("%s: expected %d to be %q, got: %q, err: %v",
+					step, i, exp, v, err)
+			}
+		}
+		rep, err := s.Verify(VerifyOptions{Values: true})
+		if err != nil || !rep.OK() {
+			t.Errorf("%s: expected no problems, got: %v, err: %v",
+				step, rep.Problems, err)
+		}
+	}
+	expect(s, "log")
+	f2, _ := os.Open(fname)
+	defer f2.Close()
+	s2, err := NewStore(f2)
+	if err != nil {
+		t.Fatalf("expected reopen to work, err: %v", err)
+	}
+	expect(s2, "replay")
+	if s2.size != s.size || s2.dirtyItems != 0 {
+		t.Errorf("expected replay to end at the last log record")
+	}
+
+	if err = s.FlushEx(FlushOptions{Checkpoint: true}); err != nil {
+		t.Fatalf("expected a checkpoint to work, err: %v", err)
+	}
+	if s.LastCommitInfo().Seq != 1 {
+		t.Errorf("expected a checkpoint to write a root record")
+	}
+	f3, _ := os.Open(fname)
+	defer f3.Close()
+	s3, _ := NewStore(f3)
+	expect(s3, "checkpoint")
+
+	if err = s.SetLogMode(nil); err != nil {
+		t.Fatalf("expected SetLogMode(nil) to work, err: %v", err)
+	}
+	x.Set([]byte("11"), []byte("d"))
+	s.Flush()
+	if s.LastCommitInfo().Seq != 2 || s.logDeletes != nil {
+		t.Errorf("expected a Flush without log mode to write a root record")
+	}
+}
+
+func TestLogModeCheckpoints(t *testing.T) {
+	f := newFaultFile(nil)
+	s, _ := NewStore(f)
+	s.SetLogMode(&LogOptions{CheckpointFlushes: 2})
+	x := s.SetCollection("x", nil)
+	seqs := ""
+	flush := func(opts FlushOptions) {
+		x.Set([]byte(fmt.Sprintf("%d", len(seqs))), []byte("v"))
+		if err := s.FlushEx(opts); err != nil {
+			t.Fatalf("expected Flush to work, err: %v", err)
+		}
+		seqs += fmt.Sprintf("%d", s.LastCommitInfo().Seq)
+	}
+	for i := 0; i < 5; i++ {
+		flush(FlushOptions{})
+	}
+	flush(FlushOptions{Meta: map[string]string{"a": "b"}})
+	x = s.SetCollection("x", nil) // Re-setting also needs a checkpoint.
+	flush(FlushOptions{})
+	s.SetCollection("y", nil)
+	flush(FlushOptions{})
+	flush(FlushOptions{})
+	if seqs != "000112344" {
+		t.Errorf("unexpected checkpoint seqs: %s", seqs)
+	}
+
+	old := newFaultFile(nil)
+	s, _ = NewStore(old)
+	s.setVersion(VERSION_CRC)
+	if err := s.SetLogMode(&LogOptions{}); err == nil {
+		t.Errorf("expected SetLogMode on an older file version to fail")
+	}
+}
+
+func TestLogModeCustomCompare(t *testing.T) {
+	reverse := func(a, b []byte) int { return -bytes.Compare(a, b) }
+	f := newFaultFile(nil)
+	s, _ := NewStore(f)
+	s.SetLogMode(&LogOptions{})
+	x := s.SetCollection("x", reverse)
+	x.Set([]byte("a"), []byte("A"))
+	s.Flush()
+	x.Set([]byte("b"), []byte("B"))
+	x.Set([]byte("c"), []byte("C"))
+	x.Delete([]byte("a"))
+	s.Flush()
+	s2, err := NewStoreEx(f, StoreCallbacks{
+		KeyCompareForCollection: func(name string) KeyCompare { return reverse },
+	})
+	if err != nil {
+		t.Fatalf("expected reopen to work, err: %v", err)
+	}
+	keys := ""
+	s2.GetCollection("x").VisitItemsAscend([]byte("z"), false, func(i *Item) bool {
+		keys += string(i.Key)
+		return true
+	})
+	if keys != "cb" {
+		t.Errorf("expected replay with the custom compare, got: %q", keys)
+	}
+}
+
+func TestLogModeSyncCrash(t *testing.T) {
+	r := rand.New(rand.NewSource(4321))
+	for writesLeft := 0; writesLeft < 60; writesLeft++ {
+		f := newFaultFile(nil)
+		s, _ := NewStoreWithHeader(f, StoreCallbacks{})
+		s.SetLogMode(&LogOptions{CheckpointFlushes: 3})
+		x := s.SetCollection("x", nil)
+		committed := 0
+		f.writesLeft = writesLeft
+		for j := 0; j < 10; j++ {
+			for i := 0; i < 5; i++ {
+				x.Set([]byte(fmt.Sprintf("%d-%d", j, i)), []byte(fmt.Sprintf("%d", j)))
+			}
+			x.Delete([]byte(fmt.Sprintf("%d-0", j)))
+			if err := s.FlushEx(FlushOptions{Sync: true}); err != nil {
+				break
+			}
+			committed++
+		}
+		s, err := NewStore(f.crash(r))
+		if err != nil {
+			t.Fatalf("expected reopen after crash to work, writesLeft: %v, err: %v",
+				writesLeft, err)
+		}
+		rep, err := s.Verify(VerifyOptions{Values: true})
+		if err != nil || !rep.OK() {
+			t.Errorf("expected no problems after crash, writesLeft: %v,"+
+				" got: %v, err: %v", writesLeft, rep.Problems, err)
+		}
+		for j := 0; j < committed; j++ {
+			for i := 0; i < 5; i++ {
+				k := fmt.Sprintf("%d-%d", j, i)
+				exp := fmt.Sprintf("%d", j)
+				if i == 0 {
+					exp = ""
+				}
+				v, err := s.GetCollection("x").Get([]byte(k))
+				if err != nil || string(v) != exp {
+					t.Errorf("expected committed %s after crash, writesLeft: %v,"+
+						" got: %s, err: %v", k, writesLeft, v, err)
+				}
+			}
+		}
+	}
+}
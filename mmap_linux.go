@@ -0,0 +1,187 @@
+//go:build linux
+
+package gkvlite
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Options for OpenMmapFile().
+type MmapOptions struct {
+	OpenOptions
+
+	// With ZeroCopy, the MmapFile is a Slicer, so the Item.Key's and
+	// Item.Val's read from it are the mapped bytes instead of copies,
+	// which are read-only, and valid until the MmapFile is closed or
+	// truncated below them.  Without ItemAlloc or ItemValRead
+	// callbacks, the Store then doesn't allocate the keys and values
+	// of the items that it reads.
+	ZeroCopy bool
+}
+
+// A StoreFile whose reads are served from a read-only, shared memory
+// mapping of the file, which is remapped when reading what writes,
+// such as by a Flush(), appended past the mapping.  Like the File it wraps,
+// it's safe for concurrent readers and a single writer.
+type MmapFile struct {
+	*File
+	zeroCopy bool
+
+	m    sync.RWMutex // Read-held while using data.
+	data []byte       // The mapping, which may extend past the file's end.
+	size int64        // Atomic protected; the file's size, as last seen.
+	old  [][]byte     // Earlier mappings, which ZeroCopy items may use.
+
+	numMaps uint64 // Atomic protected.
+}
+
+// Opens the file at path as a memory-mapped StoreFile.
+func OpenMmapFile(path string, opts MmapOptions) (*MmapFile, error) {
+	sf, err := OpenFile(path, opts.OpenOptions)
+	if err != nil {
+		return nil, err
+	}
+	f := &MmapFile{File: sf.(*File), zeroCopy: opts.ZeroCopy}
+	f.m.Lock()
+	err = f.remap_locked(0)
+	f.m.Unlock()
+	if err != nil {
+		f.File.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Maps at least the first end bytes of the file, or the whole file if
+// it's larger, with room to grow; the m must be held.
+func (f *MmapFile) remap_locked(end int64) error {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	atomic.StoreInt64(&f.size, size)
+	if end > size {
+		end = size
+	}
+	if end <= int64(len(f.data)) && (size == 0 || f.data != nil) {
+		return nil
+	}
+	length := int64(os.Getpagesize())
+	for length < 2*size {
+		length *= 2
+	}
+	if int64(int(length)) != length {
+		return errors.New("file too large to map")
+	}
+	data, err := syscall.Mmap(int(f.File.file.Fd()), 0, int(length),
+		syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	if f.data != nil {
+		if f.zeroCopy {
+			f.old = append(f.old, f.data)
+		} else if err = syscall.Munmap(f.data); err != nil {
+			syscall.Munmap(data)
+			return err
+		}
+	}
+	f.data = data
+	atomic.AddUint64(&f.numMaps, 1)
+	return nil
+}
+
+// Calls fn with the n mapped bytes at off, first remapping if they're
+// past what was mapped, and returns false if they're past the file's
+// end or can't be mapped.
+func (f *MmapFile) mapped(off int64, n int, fn func(b []byte)) bool {
+	end := off + int64(n)
+	for remapped := false; off >= 0; remapped = true {
+		f.m.RLock()
+		if end <= atomic.LoadInt64(&f.size) && end <= int64(len(f.data)) {
+			fn(f.data[off:end:end])
+			f.m.RUnlock()
+			return true
+		}
+		f.m.RUnlock()
+		if remapped {
+			break
+		}
+		f.m.Lock()
+		err := f.remap_locked(end)
+		f.m.Unlock()
+		if err != nil {
+			break
+		}
+	}
+	return false
+}
+
+func (f *MmapFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if f.mapped(off, len(p), func(b []byte) { n = copy(p, b) }) {
+		return n, nil
+	}
+	return f.File.ReadAt(p, off) // For the errors at the file's end.
+}
+
+// Returns the mapped bytes at off with ZeroCopy, otherwise nil.
+func (f *MmapFile) Slice(off int64, n int) (res []byte) {
+	if f.zeroCopy {
+		f.mapped(off, n, func(b []byte) { res = b })
+	}
+	return res
+}
+
+// Writes to the file, whose mapping sees the written bytes, as it's
+// shared.
+func (f *MmapFile) WriteAt(p []byte, off int64) (int, error) {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	n, err := f.File.WriteAt(p, off)
+	for end := off + int64(n); n > 0; {
+		size := atomic.LoadInt64(&f.size)
+		if end <= size || atomic.CompareAndSwapInt64(&f.size, size, end) {
+			break
+		}
+	}
+	return n, err
+}
+
+// Truncates the file, after waiting for the reads of the mapping in
+// flight, as reading the mapping past the file's end faults.
+func (f *MmapFile) Truncate(size int64) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	err := f.File.Truncate(size)
+	if err == nil && size < atomic.LoadInt64(&f.size) {
+		atomic.StoreInt64(&f.size, size)
+	}
+	return err
+}
+
+// Unmaps and closes the file.
+func (f *MmapFile) Close() error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	for _, data := range append(f.old, f.data) {
+		if data != nil {
+			syscall.Munmap(data)
+		}
+	}
+	f.data, f.old = nil, nil
+	atomic.StoreInt64(&f.size, 0)
+	return f.File.Close()
+}
+
+// Updates the provided map with the mapping's statistics.
+func (f *MmapFile) Stats(out map[string]uint64) {
+	f.m.RLock()
+	out["mappedBytes"] = uint64(len(f.data))
+	f.m.RUnlock()
+	out["maps"] = atomic.LoadUint64(&f.numMaps)
+}
@@ -0,0 +1,182 @@
+//go:build linux
+
+package gkvlite
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"unsafe"
+)
+
+// Whether b is within the MmapFile's current or earlier mappings.
+func inMapping(f *MmapFile, b []byte) bool {
+	p := uintptr(unsafe.Pointer(unsafe.SliceData(b)))
+	f.m.RLock()
+	defer f.m.RUnlock()
+	for _, data := range append([][]byte{f.data}, f.old...) {
+		start := uintptr(unsafe.Pointer(unsafe.SliceData(data)))
+		if len(data) > 0 && p >= start && p < start+uintptr(len(data)) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMmapFile(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	for _, zeroCopy := range []bool{false, true} {
+		os.Remove(fname)
+		f, err := OpenMmapFile(fname,
+			MmapOptions{OpenOptions: OpenOptions{Create: true}, ZeroCopy: zeroCopy})
+		if err != nil {
+			t.Fatalf("expected OpenMmapFile to work, err: %v", err)
+		}
+		s, _ := NewStore(f)
+		x := s.SetCollection("x", nil)
+		for j := 0; j < 5; j++ {
+			for i := j; i < 1000; i += 5 {
+				x.Set([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("v%d", i)))
+			}
+			if err := s.Flush(); err != nil {
+				t.Fatalf("expected Flush to work, err: %v", err)
+			}
+		}
+		s1, _ := NewStore(f)
+		n := 0
+		err = s1.GetCollection("x").VisitItemsAscend(nil, true, func(i *Item) bool {
+			if string(i.Key) != fmt.Sprintf("%04d", n) ||
+				string(i.Val) != fmt.Sprintf("v%d", n) {
+				t.Errorf("unexpected item: %q, %q", i.Key, i.Val)
+			}
+			if inMapping(f, i.Key) != zeroCopy || inMapping(f, i.Val) != zeroCopy {
+				t.Errorf("expected mapped key and val only with zeroCopy: %v",
+					zeroCopy)
+			}
+			n++
+			return true
+		})
+		if err != nil || n != 1000 {
+			t.Errorf("expected 1000 items, got: %v, err: %v", n, err)
+		}
+		stats := map[string]uint64{}
+		f.Stats(stats)
+		if fi, _ := f.Stat(); stats["maps"] == 0 || stats["mappedBytes"] < uint64(fi.Size()) {
+			t.Errorf("expected the file to be mapped, got: %v", stats)
+		}
+
+		// Reads past the file's end fail, and after a truncate too.
+		fi, _ := f.Stat()
+		p := make([]byte, 10)
+		if _, err := f.ReadAt(p, fi.Size()-5); err == nil {
+			t.Errorf("expected a read past the end to fail")
+		}
+		if err := s1.FlushRevert(); err != nil {
+			t.Errorf("expected FlushRevert to work, err: %v", err)
+		}
+		if _, err := f.ReadAt(p, fi.Size()-10); err == nil {
+			t.Errorf("expected a read past the truncated end to fail")
+		}
+		if rep, err := s1.Verify(VerifyOptions{Values: true}); err != nil || !rep.OK() {
+			t.Errorf("expected no problems, got: %v, err: %v", rep.Problems, err)
+		}
+		if err := f.Close(); err != nil {
+			t.Errorf("expected Close to work, err: %v", err)
+		}
+	}
+}
+
+func TestMmapFileConcurrent(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := OpenMmapFile(fname, MmapOptions{OpenOptions: OpenOptions{Create: true}})
+	defer f.Close()
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 100; i++ {
+		x.Set([]byte(fmt.Sprintf("%03d", i)), []byte("v"))
+	}
+	s.Flush()
+
+	// Readers of a reopened store, while a writer's flushes remap.
+	s1, _ := NewStore(f)
+	x1 := s1.GetCollection("x")
+	var wg sync.WaitGroup
+	for r := 0; r < 10; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				n := 0
+				s2, err := NewStore(f)
+				if err != nil {
+					t.Errorf("expected NewStore to work, err: %v", err)
+					return
+				}
+				s2.GetCollection("x").VisitItemsAscend(nil, true, func(i *Item) bool {
+					if len(i.Val) == 0 || i.Val[0] != 'v' {
+						t.Errorf("unexpected item: %q, %q", i.Key, i.Val)
+					}
+					n++
+					return true
+				})
+				if n < 100 {
+					t.Errorf("expected at least 100 items, got: %v", n)
+				}
+			}
+		}()
+	}
+	for j := 0; j < 20; j++ {
+		for i := 0; i < 100; i++ {
+			x1.Set([]byte(fmt.Sprintf("%03d-%d", i, j)), []byte("v"+string(make([]byte, j*10))))
+		}
+		if err := s1.Flush(); err != nil {
+			t.Errorf("expected Flush to work, err: %v", err)
+		}
+	}
+	wg.Wait()
+	if rep, err := s1.Verify(VerifyOptions{Values: true}); err != nil || !rep.OK() {
+		t.Errorf("expected no problems, got: %v, err: %v", rep.Problems, err)
+	}
+	stats := map[string]uint64{}
+	f.Stats(stats)
+	if stats["maps"] < 2 {
+		t.Errorf("expected remaps, got: %v", stats)
+	}
+}
+
+// Visits the items of a just opened Store, whose reads all come from
+// the mapping.
+func benchmarkMmapVisits(b *testing.B, zeroCopy bool) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := OpenMmapFile(fname, MmapOptions{
+		OpenOptions: OpenOptions{Create: true}, ZeroCopy: zeroCopy})
+	defer f.Close()
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 1000; i++ {
+		x.Set([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100))
+	}
+	s.Flush()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s1, _ := NewStore(f)
+		s1.GetCollection("x").VisitItemsAscend(nil, true,
+			func(i *Item) bool { return true })
+	}
+}
+
+func BenchmarkMmapVisits(b *testing.B) {
+	benchmarkMmapVisits(b, false)
+}
+
+func BenchmarkMmapVisitsZeroCopy(b *testing.B) {
+	benchmarkMmapVisits(b, true)
+}
@@ -3,6 +3,7 @@ package gkvlite
 import (
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"sync/atomic"
 	"unsafe"
 )
@@ -12,7 +13,8 @@ type node struct {
 	numNodes, numBytes uint64
 	item               itemLoc
 	left, right        nodeLoc
-	next               *node // For free-list tracking.
+	next               *node  // For free-list tracking.
+	hot                uint32 // Atomic protected; see SetMemoryBudget().
 }
 
 // A persistable node and its persistence location.
@@ -24,6 +26,20 @@ type nodeLoc struct {
 
 var empty_nodeLoc = &nodeLoc{} // Sentinel.
 
+const nodeLoc_length int = ploc_length + ploc_length + ploc_length + 8 + 8
+
+// Returns the node record length of a file format version, where
+// VERSION_CRC adds a checksum, and VERSION_REC adds a record header.
+func nodeLocLength(version uint32) int {
+	if version >= VERSION_REC {
+		return recHdrLength + nodeLoc_length + 4
+	}
+	if version >= VERSION_CRC {
+		return nodeLoc_length + 4
+	}
+	return nodeLoc_length
+}
+
 func (nloc *nodeLoc) Loc() *ploc {
 	return (*ploc)(atomic.LoadPointer(&nloc.loc))
 }
@@ -45,16 +61,19 @@ func (nloc *nodeLoc) isEmpty() bool {
 	return nloc == nil || (nloc.Loc().isEmpty() && nloc.Node() == nil)
 }
 
-func (nloc *nodeLoc) write(o *Store) error {
+func (nloc *nodeLoc) write(o *Store, rw *recWriter) error {
 	if nloc != nil && nloc.Loc().isEmpty() {
 		node := nloc.Node()
 		if node == nil {
 			return nil
 		}
-		offset := atomic.LoadInt64(&o.size)
-		length := ploc_length + ploc_length + ploc_length + 8 + 8
+		offset := atomic.LoadInt64(rw.pos)
+		length := nodeLocLength(o.version())
 		b := make([]byte, length)
 		pos := 0
+		if o.version() >= VERSION_REC {
+			pos = putRecHdr(b, RecordNode, uint32(length))
+		}
 		pos = node.item.Loc().write(b, pos)
 		pos = node.left.Loc().write(b, pos)
 		pos = node.right.Loc().write(b, pos)
@@ -62,16 +81,22 @@ func (nloc *nodeLoc) write(o *Store) error {
 		pos += 8
 		binary.BigEndian.PutUint64(b[pos:pos+8], node.numBytes)
 		pos += 8
+		if o.version() >= VERSION_CRC {
+			binary.BigEndian.PutUint32(b[pos:pos+4],
+				crc32.Checksum(b[:pos], crcTable))
+			pos += 4
+		}
 		if pos != length {
 			return fmt.Errorf("nodeLoc.write() pos: %v didn't match length: %v",
 				pos, length)
 		}
-		if _, err := o.file.WriteAt(b, offset); err != nil {
+		if _, err := rw.w.WriteAt(b, offset); err != nil {
 			return err
 		}
-		atomic.StoreInt64(&o.size, offset+int64(length))
-		atomic.StorePointer(&nloc.loc,
-			unsafe.Pointer(&ploc{Offset: offset, Length: uint32(length)}))
+		atomic.StoreInt64(rw.pos, offset+int64(length))
+		atomic.StorePointer(&nloc.loc, unsafe.Pointer(&ploc{
+			Offset: offset, Length: uint32(length), gen: o.gen()}))
+		o.cacheNode(nloc, node)
 	}
 	return nil
 }
@@ -82,31 +107,47 @@ func (nloc *nodeLoc) read(o *Store) (n *node, err error) {
 	}
 	n = nloc.Node()
 	if n != nil {
+		o.touch(&n.hot)
 		return n, nil
 	}
 	loc := nloc.Loc()
 	if loc.isEmpty() {
 		return nil, nil
 	}
-	if loc.Length != uint32(ploc_length+ploc_length+ploc_length+8+8) {
+	fg := o.fileAt(loc.gen)
+	if loc.Length != uint32(nodeLocLength(fg.version)) {
 		return nil, fmt.Errorf("unexpected node loc.Length: %v != %v",
-			loc.Length, ploc_length+ploc_length+ploc_length+8+8)
+			loc.Length, nodeLocLength(fg.version))
 	}
 	b := make([]byte, loc.Length)
-	if _, err := o.file.ReadAt(b, loc.Offset); err != nil {
+	if _, err := fg.file.ReadAt(b, loc.Offset); err != nil {
 		return nil, err
 	}
 	pos := 0
+	if fg.version >= VERSION_REC {
+		if _, err := readRecHdr(b, RecordNode, loc.Offset, "node"); err != nil {
+			return nil, err
+		}
+		pos += recHdrLength
+	}
+	if fg.version >= VERSION_CRC {
+		end := len(b) - 4
+		if binary.BigEndian.Uint32(b[end:]) !=
+			crc32.Checksum(b[:end], crcTable) {
+			return nil, &ErrChecksum{Offset: loc.Offset, Kind: "node"}
+		}
+		b = b[:end]
+	}
 	atomic.AddUint64(&o.nodeAllocs, 1)
 	n = &node{}
 	var p *ploc
-	p = &ploc{}
+	p = &ploc{gen: loc.gen}
 	p, pos = p.read(b, pos)
 	n.item.loc = unsafe.Pointer(p)
-	p = &ploc{}
+	p = &ploc{gen: loc.gen}
 	p, pos = p.read(b, pos)
 	n.left.loc = unsafe.Pointer(p)
-	p = &ploc{}
+	p = &ploc{gen: loc.gen}
 	p, pos = p.read(b, pos)
 	n.right.loc = unsafe.Pointer(p)
 	n.numNodes = binary.BigEndian.Uint64(b[pos : pos+8])
@@ -118,6 +159,7 @@ func (nloc *nodeLoc) read(o *Store) (n *node, err error) {
 			pos, len(b))
 	}
 	atomic.StorePointer(&nloc.node, unsafe.Pointer(n))
+	o.cacheNode(nloc, n)
 	return n, nil
 }
 
@@ -0,0 +1,178 @@
+package gkvlite
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Sets how many collections a Flush() serializes at once, where each
+// collection's dirty items and nodes are written into a buffer of
+// their own, at a file region reserved in collection name order.  The
+// buffers are then appended in name order, before the root record, so
+// the file looks the same as when collections are written one at a
+// time, keeping the "collections are written in name order"
+// visibility guarantee.  The default of 0 or 1 writes collections one
+// at a time, without the extra buffers.  With parallelism, the
+// ItemValLength and ItemValWrite callbacks may be invoked
+// concurrently, and a BeforeItemWrite callback, which might change an
+// item's size, turns parallelism off.
+func (s *Store) SetFlushParallelism(n int) error {
+	if n < 0 {
+		return errors.New("flush parallelism must be non-negative")
+	}
+	s.flushLock.Lock()
+	s.parallelism = n
+	s.flushLock.Unlock()
+	return nil
+}
+
+// A file region reserved for one collection's records during a
+// parallel Flush().
+type fileRegion struct {
+	StoreFile // The Store's file, for Stat() and Truncate().
+
+	buf  []byte
+	base int64
+	pos  int64 // Atomic protected; where the next record goes.
+}
+
+func (r *fileRegion) WriteAt(p []byte, off int64) (int, error) {
+	if off < r.base || off+int64(len(p)) > r.base+int64(len(r.buf)) {
+		return 0, fmt.Errorf("write at: %v, length: %v, outside of region: %v, length: %v",
+			off, len(p), r.base, len(r.buf))
+	}
+	return copy(r.buf[off-r.base:], p), nil
+}
+
+func (r *fileRegion) ReadAt(p []byte, off int64) (int, error) {
+	if off < r.base || off+int64(len(p)) > r.base+int64(len(r.buf)) {
+		return 0, fmt.Errorf("read at: %v, length: %v, outside of region: %v, length: %v",
+			off, len(p), r.base, len(r.buf))
+	}
+	return copy(p, r.buf[off-r.base:]), nil
+}
+
+// Stands in for the current file generation during a parallel
+// Flush(), so reads of records in the reserved regions see them.
+type regionsFile struct {
+	StoreFile // What reads of the current file generation went to.
+
+	regions []*fileRegion // In offset order.
+}
+
+func (f *regionsFile) ReadAt(p []byte, off int64) (int, error) {
+	i := sort.Search(len(f.regions), func(i int) bool {
+		r := f.regions[i]
+		return off < r.base+int64(len(r.buf))
+	})
+	if i < len(f.regions) && off >= f.regions[i].base {
+		return f.regions[i].ReadAt(p, off)
+	}
+	return f.StoreFile.ReadAt(p, off)
+}
+
+// Writes the dirty items and nodes of the collections, in name order;
+// the flushLock must be held.
+func (s *Store) writeColls(coll map[string]*Collection, cnames []string,
+	rnls map[string]*rootNodeLoc) error {
+	if s.parallelism < 2 || len(cnames) < 2 ||
+		s.callbacks.BeforeItemWrite != nil {
+		for _, name := range cnames {
+			err := coll[name].write(rnls[name].root, s.recWriter())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	offset := atomic.LoadInt64(&s.size)
+	regions := []*fileRegion{}
+	todo := []*Collection{}
+	for _, name := range cnames {
+		n := coll[name].writeLength(rnls[name].root)
+		if n <= 0 {
+			continue
+		}
+		regions = append(regions, &fileRegion{StoreFile: s.file(),
+			buf: make([]byte, n), base: offset, pos: offset})
+		todo = append(todo, coll[name])
+		offset += n
+	}
+	if len(regions) <= 0 {
+		return nil
+	}
+	prev := s.fileAt(s.gen()).file
+	s.setFileOfGen(&regionsFile{StoreFile: prev, regions: regions})
+	defer s.setFileOfGen(prev)
+
+	errs := make([]error, len(regions))
+	next := int64(-1)
+	var wg sync.WaitGroup
+	for w := 0; w < s.parallelism && w < len(regions); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(regions) {
+					return
+				}
+				r, t := regions[i], todo[i]
+				errs[i] = t.writeRegion(rnls[t.name].root, r)
+			}
+		}()
+	}
+	wg.Wait()
+	// The regions are appended even on an error, as the locations of
+	// the records that were written have already been published.
+	w := s.writer()
+	for _, r := range regions {
+		if _, err := w.WriteAt(r.buf, r.base); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt64(&s.size, offset)
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes a collection's dirty items and nodes into its region, which
+// they must fill exactly.
+func (t *Collection) writeRegion(nloc *nodeLoc, r *fileRegion) error {
+	if err := t.write(nloc, &recWriter{w: r, pos: &r.pos}); err != nil {
+		return err
+	}
+	if end := r.base + int64(len(r.buf)); atomic.LoadInt64(&r.pos) != end {
+		return fmt.Errorf("collection: %v wrote to: %v, expected: %v",
+			t.name, atomic.LoadInt64(&r.pos), end)
+	}
+	return nil
+}
+
+// Returns how many bytes writeItems() and writeNodes() append for the
+// dirty items and nodes reachable from nloc.
+func (t *Collection) writeLength(nloc *nodeLoc) int64 {
+	if nloc == nil || !nloc.Loc().isEmpty() {
+		return 0
+	}
+	node := nloc.Node()
+	if node == nil {
+		return 0
+	}
+	n := int64(nodeLocLength(t.store.version())) +
+		t.writeLength(&node.left) + t.writeLength(&node.right)
+	if node.item.Loc().isEmpty() {
+		if i := node.item.Item(); i != nil {
+			n += int64(itemLocHdrLength(t.store.version()) +
+				len(i.Key) + i.NumValBytes(t))
+		}
+	}
+	return n
+}
@@ -0,0 +1,173 @@
+package gkvlite
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// Returns the records of a file, with item records in full, as only
+// the node and root records hold file offsets.
+func recordsOf(t *testing.T, f StoreFile) []string {
+	recs := []string{}
+	err := VisitRecords(f, 0, func(r *Record) bool {
+		if r.Type != RecordItem {
+			recs = append(recs, string(r.Type))
+			return true
+		}
+		b := make([]byte, r.Length)
+		if _, err := f.ReadAt(b, r.Offset); err != nil {
+			t.Fatalf("expected ReadAt to work, err: %v", err)
+		}
+		recs = append(recs, string(b))
+		return true
+	})
+	if err != nil {
+		t.Fatalf("expected VisitRecords to work, err: %v", err)
+	}
+	return recs
+}
+
+func parallelFlushes(t *testing.T, parallelism, bufferSize int) []string {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	s, _ := NewStore(f)
+	if err := s.SetFlushParallelism(parallelism); err != nil {
+		t.Fatalf("expected SetFlushParallelism to work, err: %v", err)
+	}
+	s.SetFlushBufferSize(bufferSize)
+	for c := 0; c < 10; c++ {
+		s.SetCollection(fmt.Sprintf("c%d", c), nil)
+	}
+	for j := 0; j < 3; j++ {
+		for c := 0; c < 10; c++ {
+			x := s.GetCollection(fmt.Sprintf("c%d", c))
+			for i := j; i < 200*c; i += 3 {
+				k := []byte(fmt.Sprintf("%04d", i))
+				x.SetItem(&Item{Key: k, Val: []byte(fmt.Sprintf("v%d-%d-%d", c, j, i)),
+					Priority: int32(i*7919%1000 + 1)})
+			}
+			if c == j {
+				x.Delete([]byte("0000"))
+			}
+		}
+		if err := s.Flush(); err != nil {
+			t.Fatalf("expected Flush to work, err: %v", err)
+		}
+	}
+	s2, err := NewStore(f)
+	if err != nil {
+		t.Fatalf("expected reopen to work, err: %v", err)
+	}
+	if rep, err := s2.Verify(VerifyOptions{Values: true}); err != nil || !rep.OK() {
+		t.Errorf("expected no problems, got: %v, err: %v", rep.Problems, err)
+	}
+	v, err := s2.GetCollection("c9").Get([]byte("1001"))
+	if err != nil || string(v) != "v9-2-1001" {
+		t.Errorf("expected a value, got: %q, err: %v", v, err)
+	}
+	return recordsOf(t, f)
+}
+
+func TestFlushParallel(t *testing.T) {
+	recs := parallelFlushes(t, 0, 0)
+	for _, bufferSize := range []int{0, 4096} {
+		recs2 := parallelFlushes(t, 4, bufferSize)
+		if !reflect.DeepEqual(recs, recs2) {
+			t.Errorf("expected a parallel Flush to write the same records,"+
+				" bufferSize: %v", bufferSize)
+		}
+	}
+
+	s, _ := NewStore(nil)
+	if err := s.SetFlushParallelism(-1); err == nil {
+		t.Errorf("expected a negative parallelism to fail")
+	}
+}
+
+func TestFlushParallelValueLog(t *testing.T) {
+	defer os.Remove("tmp.test")
+	defer os.Remove("tmp.vlog")
+	os.Remove("tmp.test")
+	os.Remove("tmp.vlog")
+	f, _ := os.Create("tmp.test")
+	defer f.Close()
+	vf, _ := os.Create("tmp.vlog")
+	defer vf.Close()
+	vlog, _ := NewValueLog(vf)
+	s, _ := NewStoreEx(f, vlog.Callbacks(StoreCallbacks{}))
+	s.SetFlushParallelism(3)
+	for c := 0; c < 5; c++ {
+		x := s.SetCollection(fmt.Sprintf("c%d", c), nil)
+		for i := 0; i < 100; i++ {
+			x.Set([]byte(fmt.Sprintf("%d", i)), []byte(fmt.Sprintf("v%d-%d", c, i)))
+		}
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, err: %v", err)
+	}
+	s2, _ := NewStoreEx(f, vlog.Callbacks(StoreCallbacks{}))
+	for c := 0; c < 5; c++ {
+		v, err := s2.GetCollection(fmt.Sprintf("c%d", c)).Get([]byte("42"))
+		if err != nil || string(v) != fmt.Sprintf("v%d-42", c) {
+			t.Errorf("expected a value, got: %q, err: %v", v, err)
+		}
+	}
+}
+
+func TestFlushParallelConcurrentReads(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	s, _ := NewStore(f)
+	s.SetFlushParallelism(4)
+	colls := []*Collection{}
+	for c := 0; c < 4; c++ {
+		colls = append(colls, s.SetCollection(fmt.Sprintf("c%d", c), nil))
+	}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for _, x := range colls {
+		wg.Add(1)
+		go func(x *Collection) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// Evicted items that were just written are read back,
+				// maybe from their region.
+				x.EvictSomeItems()
+				x.VisitItemsAscend(nil, true, func(i *Item) bool {
+					if string(i.Val) != "v"+string(i.Key) {
+						t.Errorf("unexpected item: %q, %q", i.Key, i.Val)
+						return false
+					}
+					return true
+				})
+			}
+		}(x)
+	}
+	for j := 0; j < 20; j++ {
+		for _, x := range colls {
+			for i := 0; i < 50; i++ {
+				k := fmt.Sprintf("%d-%d", j, i)
+				x.Set([]byte(k), []byte("v"+k))
+			}
+		}
+		if err := s.Flush(); err != nil {
+			t.Errorf("expected Flush to work, err: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
@@ -8,6 +8,10 @@ import (
 type ploc struct {
 	Offset int64  `json:"o"` // Usable for os.ReadAt/WriteAt() at file offset 0.
 	Length uint32 `json:"l"` // Number of bytes.
+
+	// Generation of the file holding the bytes, as a Store's file
+	// changes on every Compact().  See Store.fileAt().
+	gen uint32
 }
 
 const ploc_length int = 8 + 4
@@ -0,0 +1,100 @@
+package gkvlite
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// Since file format version 7, every record starts with a small
+// header of its record type, the record's length (including the
+// header) and a checksum of the type and length, so a file can be
+// walked front-to-back, such as by VisitRecords().  The rest of a
+// record keeps its own checksums (see VERSION_CRC).
+const VERSION_REC = uint32(7)
+
+const recHdrLength int = 1 + 4 + 4
+
+// Record types.
+const (
+	RecordItem  = byte('i')
+	RecordNode  = byte('n')
+	RecordRoots = byte('r') // The record's roots start after its header.
+	RecordLog   = byte('l') // Written by Flush() in log mode.
+	RecordValue = byte('v') // In a ValueLog.
+)
+
+// Describes a record found by VisitRecords().
+type Record struct {
+	Offset int64  // File offset of the record header.
+	Type   byte   // One of the Record types.
+	Length uint32 // Including the record header.
+}
+
+type RecordVisitor func(r *Record) bool
+
+// Writes a record header into b, returning the position after it.
+func putRecHdr(b []byte, recType byte, length uint32) int {
+	b[0] = recType
+	binary.BigEndian.PutUint32(b[1:5], length)
+	binary.BigEndian.PutUint32(b[5:9], crc32.Checksum(b[:5], crcTable))
+	return recHdrLength
+}
+
+// Returns the length from a record header, which must have the
+// expected record type.  The kind is for the returned ErrChecksum.
+func readRecHdr(b []byte, recType byte, offset int64,
+	kind string) (uint32, error) {
+	if b[0] != recType ||
+		binary.BigEndian.Uint32(b[5:9]) != crc32.Checksum(b[:5], crcTable) {
+		return 0, &ErrChecksum{Offset: offset, Kind: kind}
+	}
+	return binary.BigEndian.Uint32(b[1:5]), nil
+}
+
+// Walks the records of a file front-to-back, starting at the offset
+// of a record, such as the end of an earlier root record, or at 0 for
+// the first record, which is after the header of a file from
+// NewStoreWithHeader().  Only files of version >= VERSION_REC have
+// record headers.  Returns an *ErrChecksum for a bad record header,
+// such as a torn write at the end of the file.
+func VisitRecords(file StoreFile, start int64, visitor RecordVisitor) error {
+	finfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if start == 0 {
+		if start, err = firstRecord(file, finfo.Size()); err != nil {
+			return err
+		}
+	}
+	return visitRecords(file, start, finfo.Size(), visitor)
+}
+
+func visitRecords(file StoreFile, start, size int64, visitor RecordVisitor) error {
+	b := make([]byte, recHdrLength)
+	for offset := start; offset < size; {
+		if offset+int64(recHdrLength) > size {
+			return &ErrChecksum{Offset: offset, Kind: "record"}
+		}
+		if _, err := file.ReadAt(b, offset); err != nil {
+			return err
+		}
+		r := &Record{Offset: offset, Type: b[0]}
+		if r.Type != RecordItem && r.Type != RecordNode &&
+			r.Type != RecordRoots && r.Type != RecordLog && r.Type != RecordValue {
+			return &ErrChecksum{Offset: offset, Kind: "record"}
+		}
+		var err error
+		if r.Length, err = readRecHdr(b, r.Type, offset, "record"); err != nil {
+			return err
+		}
+		if r.Length < uint32(recHdrLength) || offset+int64(r.Length) > size {
+			return &ErrChecksum{Offset: offset, Kind: "record"}
+		}
+		if !visitor(r) {
+			return nil
+		}
+		offset += int64(r.Length)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package gkvlite
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestVisitRecords(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	var commits []int64
+	for j := 0; j < 3; j++ {
+		for i := 0; i < 10; i++ {
+			x.Set([]byte(fmt.Sprintf("%d", i)), []byte(fmt.Sprintf("%d", j)))
+		}
+		s.Flush()
+		commits = append(commits, s.LastCommitInfo().Offset)
+	}
+
+	counts := map[byte]int{}
+	var roots []int64
+	end := int64(0)
+	err := VisitRecords(f, 0, func(r *Record) bool {
+		if r.Offset != end {
+			t.Errorf("expected contiguous records, got: %#v at: %v", r, end)
+		}
+		counts[r.Type]++
+		if r.Type == RecordRoots {
+			roots = append(roots, r.Offset+int64(recHdrLength))
+		}
+		end = r.Offset + int64(r.Length)
+		return true
+	})
+	if err != nil || end != s.size {
+		t.Errorf("expected VisitRecords to the end, err: %v", err)
+	}
+	if counts[RecordItem] != 30 || counts[RecordNode] < 30 ||
+		counts[RecordRoots] != 3 || fmt.Sprint(roots) != fmt.Sprint(commits) {
+		t.Errorf("unexpected records: %v, roots: %v vs %v", counts, roots, commits)
+	}
+
+	n := 0
+	err = VisitRecords(f, commits[1]-int64(recHdrLength), func(r *Record) bool {
+		n++
+		return false
+	})
+	if err != nil || n != 1 {
+		t.Errorf("expected VisitRecords to stop, n: %v, err: %v", n, err)
+	}
+
+	f.WriteAt([]byte("garbage"), s.size)
+	err = VisitRecords(f, 0, func(r *Record) bool { return true })
+	if e, ok := err.(*ErrChecksum); !ok || e.Offset != s.size {
+		t.Errorf("expected ErrChecksum for a garbage tail, got: %v", err)
+	}
+}
+
+func TestVisitRecordsHeader(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	s, _ := NewStoreWithHeader(f, StoreCallbacks{})
+	x := s.SetCollection("x", nil)
+	for j := 0; j < 2; j++ {
+		x.Set([]byte(fmt.Sprintf("%d", j)), []byte("v"))
+		s.Flush()
+	}
+	visit := func() {
+		first, end, roots := int64(-1), int64(0), 0
+		err := VisitRecords(f, 0, func(r *Record) bool {
+			if first < 0 {
+				first = r.Offset
+			}
+			if r.Type == RecordRoots {
+				roots++
+			}
+			end = r.Offset + int64(r.Length)
+			return true
+		})
+		if err != nil || first != headerLength || end != s.size || roots != 2 {
+			t.Errorf("expected records after the header, first: %v, end: %v,"+
+				" roots: %v, err: %v", first, end, roots, err)
+		}
+	}
+	visit()
+	f.WriteAt(make([]byte, headerSlotLength), 0) // A torn first slot.
+	visit()
+}
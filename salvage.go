@@ -0,0 +1,460 @@
+package gkvlite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"sort"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Configures Salvage().
+type SalvageOptions struct {
+	Callbacks StoreCallbacks // Used for both the src and dst Stores.
+
+	// When non-empty, items that couldn't be attributed to a
+	// collection are also rebuilt into this collection, where the
+	// item found last in the file wins for a key.
+	UnattributedCollection string
+}
+
+// The result of Salvage().
+type SalvageReport struct {
+	RootOffset  int64  // Root record the collections came from, or -1.
+	Version     uint32 // File format version of the src file.
+	NumRoots    int    // Readable root records.
+	NumBadRoots int    // Records with the roots magic that couldn't be read.
+	NumBadNodes int    // Unreadable node or item records in treaps.
+	NumScanned  uint64 // Plausible item records found by the forward scan.
+	NumLogs     int    // Log records replayed after the root record.
+
+	// Number of items rebuilt per collection, where an item lost with
+	// an unreadable node in the latest treap is recovered from older
+	// root records, if found there, so a recovered item might have
+	// been deleted or replaced since.
+	Collections map[string]uint64
+
+	// Items found by the forward scan that are not in the treap of any
+	// readable root record, such as from an unfinished Flush().
+	Unattributed []SalvageItem
+}
+
+// An item record found by the forward scan of Salvage().
+type SalvageItem struct {
+	Offset int64
+	Key    []byte
+}
+
+// Size of reads during the forward scans of Salvage().
+const salvageBlockSize = 1024 * 1024
+
+// Number of rebuilt items between dst flushes, to bound memory.
+const salvageFlushItems = 10000
+
+// Recovers what it can from a damaged src file into an empty dst
+// file, for when NewStore() fails or falls back to an older root
+// record.  The src file is scanned forward for root records, and the
+// collections of the latest readable one are rebuilt from their
+// treaps, where items under unreadable nodes are taken from older root
+// records, and the log records after it from log mode are replayed.
+// The src file is then scanned forward for plausible item records,
+// checked by their lengths, and by their checksums in files of
+// version >= VERSION_CRC, to report any items that couldn't be
+// attributed to a collection.  Item records of older file versions
+// have no checksums, so their scan may also find false positives.
+func Salvage(src StoreFile, dst StoreFile,
+	opts SalvageOptions) (*SalvageReport, error) {
+	finfo, err := src.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sv := &salvager{
+		r: &scanReader{file: src, size: finfo.Size()},
+		report: &SalvageReport{RootOffset: -1, Version: VERSION,
+			Collections: map[string]uint64{}},
+		known: map[int64]int64{},
+		items: map[int64]uint32{},
+		colls: map[string]*salvageColl{},
+		source: &Store{callbacks: opts.Callbacks, readOnly: true,
+			files: newFileGens(src, VERSION), alloc: &allocator{}},
+	}
+	sv.source.size = sv.r.size
+	d, err := NewStoreEx(dst, opts.Callbacks)
+	if err != nil {
+		return nil, err
+	}
+	if atomic.LoadInt64(&d.size) != 0 {
+		return nil, errors.New("Salvage() needs an empty dst file")
+	}
+	roots, err := sv.scanRoots()
+	if err != nil {
+		return nil, err
+	}
+	if len(roots) > 0 {
+		sv.report.RootOffset = roots[len(roots)-1].offset
+		sv.report.Version = roots[len(roots)-1].version
+	}
+	sv.source.setVersion(sv.report.Version)
+	for j := len(roots) - 1; j >= 0; j-- { // Latest first.
+		for _, name := range collNames(roots[j].colls) {
+			err = sv.walkColl(name, roots[j].colls[name], j == len(roots)-1)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(roots) > 0 {
+		if err = sv.replayLog(sv.known[sv.report.RootOffset]); err != nil {
+			return nil, err
+		}
+	}
+	if err = sv.scanItems(); err != nil {
+		return nil, err
+	}
+	if err = sv.rebuild(d, opts); err != nil {
+		return nil, err
+	}
+	return sv.report, nil
+}
+
+type salvager struct {
+	r      *scanReader
+	report *SalvageReport
+	known  map[int64]int64  // Node and roots record offsets to their ends.
+	items  map[int64]uint32 // Item record offsets in treaps to lengths.
+	colls  map[string]*salvageColl
+	source *Store // A read-only Store of the src file.
+}
+
+// The items to rebuild for a collection of the latest root record.
+type salvageColl struct {
+	items map[string]*ploc // Keyed by item key.
+	lost  [][2][]byte      // Key ranges under unreadable nodes.
+}
+
+type salvageRoots struct {
+	offset  int64
+	version uint32
+	colls   map[string]*Collection
+}
+
+func (sv *salvager) scanRoots() (res []*salvageRoots, err error) {
+	for p := int64(0); p+rootsLen <= sv.r.size; p++ {
+		b, err := sv.r.bytesAt(p, 2*len(MAGIC_BEG))
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(MAGIC_BEG, b[:len(MAGIC_BEG)]) ||
+			!bytes.Equal(MAGIC_BEG, b[len(MAGIC_BEG):]) {
+			continue
+		}
+		data, err := sv.source.readRootsAt(p)
+		var colls map[string]*Collection
+		var version uint32
+		if err == nil {
+			colls, _, version, err = sv.source.parseRoots(p, data, true)
+		}
+		if err != nil {
+			sv.report.NumBadRoots++
+			continue
+		}
+		sv.report.NumRoots++
+		end := p + int64(len(data)+rootsEndLen)
+		sv.known[p] = end
+		if version >= VERSION_REC {
+			sv.known[p-int64(recHdrLength)] = end
+		}
+		res = append(res, &salvageRoots{offset: p, version: version, colls: colls})
+		p = end - 1
+	}
+	return res, nil
+}
+
+// Walks a collection's treap to attribute its records, where the
+// treap of the latest root record also collects the items to rebuild.
+func (sv *salvager) walkColl(name string, t *Collection, latest bool) error {
+	sc := sv.colls[name]
+	if latest {
+		sc = &salvageColl{items: map[string]*ploc{}}
+		sv.colls[name] = sc
+	}
+	return sv.walk(t, sc, latest, t.root.root, nil, nil)
+}
+
+func (sv *salvager) walk(t *Collection, sc *salvageColl, latest bool,
+	nloc *nodeLoc, lo, hi []byte) error {
+	loc := nloc.Loc()
+	if loc.isEmpty() {
+		return nil
+	}
+	if _, visited := sv.known[loc.Offset]; visited {
+		return nil // Shared with a newer root record's treap.
+	}
+	n, err := nloc.read(sv.source)
+	if err != nil || n == nil {
+		sv.report.NumBadNodes++
+		if latest {
+			sc.lost = append(sc.lost, [2][]byte{lo, hi})
+		}
+		return nil
+	}
+	sv.known[loc.Offset] = loc.Offset + int64(loc.Length)
+	iloc := n.item.Loc()
+	if iloc.isEmpty() {
+		sv.report.NumBadNodes++
+		return nil
+	}
+	// A temporary itemLoc, so the treap doesn't hold onto items.
+	i, err := (&itemLoc{loc: unsafe.Pointer(iloc)}).read(t, false)
+	if err != nil || i == nil {
+		sv.report.NumBadNodes++
+		if latest {
+			sc.lost = append(sc.lost, [2][]byte{lo, hi})
+		}
+		if err = sv.walk(t, sc, latest, &n.left, lo, hi); err != nil {
+			return err
+		}
+		return sv.walk(t, sc, latest, &n.right, lo, hi)
+	}
+	key := append([]byte(nil), i.Key...)
+	t.store.ItemDecRef(t, i)
+	sv.items[iloc.Offset] = iloc.Length
+	if sc != nil && (latest || sc.isLost(t, key)) {
+		if _, exists := sc.items[string(key)]; !exists {
+			sc.items[string(key)] = iloc
+		}
+	}
+	if err = sv.walk(t, sc, latest, &n.left, lo, key); err != nil {
+		return err
+	}
+	return sv.walk(t, sc, latest, &n.right, key, hi)
+}
+
+func (sc *salvageColl) isLost(t *Collection, key []byte) bool {
+	for _, r := range sc.lost {
+		if (r[0] == nil || t.compare(r[0], key) < 0) &&
+			(r[1] == nil || t.compare(key, r[1]) < 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// Applies the log records from an offset, which is the end of the
+// latest root record, to the items to rebuild, where the items they
+// set are attributed.  Like when opening a Store, a torn log record
+// ends the log, as does any log record that can't be parsed.
+func (sv *salvager) replayLog(offset int64) error {
+	if sv.report.Version < VERSION_REC {
+		return nil
+	}
+	t := sv.source.MakePrivateCollection(nil)
+	verr := visitRecords(sv.r.file, offset, sv.r.size, func(r *Record) bool {
+		if r.Type != RecordLog {
+			return true
+		}
+		ok, err := sv.source.parseLogRecord(r, func(name string, key []byte, loc *ploc) error {
+			sc := sv.colls[name]
+			if sc == nil {
+				sc = &salvageColl{items: map[string]*ploc{}}
+				sv.colls[name] = sc
+			}
+			if loc == nil {
+				delete(sc.items, string(key))
+				return nil
+			}
+			// A temporary itemLoc, so only the key is kept.
+			i, err := (&itemLoc{loc: unsafe.Pointer(loc)}).read(t, false)
+			if err != nil || i == nil {
+				sv.report.NumBadNodes++
+				return nil
+			}
+			sc.items[string(i.Key)] = loc
+			t.store.ItemDecRef(t, i)
+			sv.items[loc.Offset] = loc.Length
+			return nil
+		})
+		if !ok || err != nil {
+			return false
+		}
+		sv.report.NumLogs++
+		sv.known[r.Offset] = r.Offset + int64(r.Length)
+		return true
+	})
+	if _, ok := verr.(*ErrChecksum); verr != nil && !ok {
+		return verr
+	}
+	return nil
+}
+
+// Scans forward for plausible item records that aren't in any treap.
+func (sv *salvager) scanItems() error {
+	hdrLength := itemLocHdrLength(sv.report.Version)
+	for p := int64(0); p+int64(hdrLength) <= sv.r.size; {
+		if end, ok := sv.known[p]; ok {
+			p = end
+			continue
+		}
+		if length, ok := sv.items[p]; ok {
+			sv.report.NumScanned++
+			p += int64(length)
+			continue
+		}
+		length, key, err := sv.scanItem(p, hdrLength)
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			p++
+			continue
+		}
+		sv.report.NumScanned++
+		sv.report.Unattributed = append(sv.report.Unattributed,
+			SalvageItem{Offset: p, Key: key})
+		p += int64(length)
+	}
+	return nil
+}
+
+// Returns the length and key of a plausible item record at an offset,
+// or a nil key.
+func (sv *salvager) scanItem(p int64, hdrLength int) (uint32, []byte, error) {
+	b, err := sv.r.bytesAt(p, hdrLength)
+	if err != nil {
+		return 0, nil, err
+	}
+	pos := 4
+	length := binary.BigEndian.Uint32(b[0:4])
+	if sv.report.Version >= VERSION_REC {
+		pos = recHdrLength
+		if length, err = readRecHdr(b, RecordItem, p, "item"); err != nil {
+			return 0, nil, nil
+		}
+	}
+	keyLength := binary.BigEndian.Uint16(b[pos : pos+2])
+	valLength := binary.BigEndian.Uint32(b[pos+2 : pos+6])
+	priority := int32(binary.BigEndian.Uint32(b[pos+6 : pos+10]))
+	if keyLength == 0 || priority < 0 ||
+		uint64(length) != uint64(hdrLength)+uint64(keyLength)+uint64(valLength) ||
+		p+int64(length) > sv.r.size {
+		return 0, nil, nil
+	}
+	hdr := append([]byte(nil), b...)
+	key, err := sv.r.bytesAt(p+int64(hdrLength), int(keyLength))
+	if err != nil {
+		return 0, nil, err
+	}
+	key = append([]byte(nil), key...)
+	if hdrLength > itemLoc_hdrLength {
+		hcrc := binary.BigEndian.Uint32(hdr[hdrLength-4:])
+		if hcrc != crc32.Update(itemHdrCRC(hdr, hdrLength-4), crcTable, key) {
+			return 0, nil, nil
+		}
+		val := make([]byte, valLength)
+		if _, err := sv.r.file.ReadAt(val,
+			p+int64(hdrLength)+int64(keyLength)); err != nil {
+			return 0, nil, err
+		}
+		vcrc := binary.BigEndian.Uint32(hdr[hdrLength-8:])
+		if vcrc != crc32.Checksum(val, crcTable) {
+			return 0, nil, nil
+		}
+	}
+	return length, key, nil
+}
+
+func (sv *salvager) rebuild(d *Store, opts SalvageOptions) error {
+	src := sv.source.MakePrivateCollection(nil)
+	n := 0
+	set := func(x *Collection, loc *ploc) error {
+		i, err := (&itemLoc{loc: unsafe.Pointer(loc)}).read(src, true)
+		if err != nil {
+			sv.report.NumBadNodes++ // Such as a bad value checksum.
+			return nil
+		}
+		err = x.SetItem(&Item{Key: i.Key, Val: i.Val, Priority: i.Priority})
+		if err != nil {
+			return err
+		}
+		sv.report.Collections[x.name]++
+		if n++; n%salvageFlushItems == 0 {
+			return d.Flush()
+		}
+		return nil
+	}
+	for _, name := range salvageCollNames(sv.colls) {
+		sc := sv.colls[name]
+		var compare KeyCompare
+		if opts.Callbacks.KeyCompareForCollection != nil {
+			compare = opts.Callbacks.KeyCompareForCollection(name)
+		}
+		x := d.SetCollection(name, compare)
+		keys := make([]string, 0, len(sc.items))
+		for key := range sc.items {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := set(x, sc.items[key]); err != nil {
+				return err
+			}
+		}
+		sv.report.Collections[name] += 0 // Also report empty ones.
+	}
+	if opts.UnattributedCollection != "" && len(sv.report.Unattributed) > 0 {
+		x := d.SetCollection(opts.UnattributedCollection, nil)
+		for _, u := range sv.report.Unattributed { // Ascending offsets.
+			hdrLength := itemLocHdrLength(sv.report.Version)
+			length, _, err := sv.scanItem(u.Offset, hdrLength)
+			if err != nil {
+				return err
+			}
+			if err = set(x, &ploc{Offset: u.Offset, Length: length}); err != nil {
+				return err
+			}
+		}
+	}
+	return d.Flush()
+}
+
+func salvageCollNames(colls map[string]*salvageColl) []string {
+	res := make([]string, 0, len(colls))
+	for name := range colls {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Reads a file forwards in blocks, for scanning.
+type scanReader struct {
+	file StoreFile
+	size int64
+	buf  []byte
+	off  int64 // File offset of buf.
+}
+
+// Returns n bytes at an offset, which must be within the file.  The
+// bytes are only valid until the next call.
+func (r *scanReader) bytesAt(offset int64, n int) ([]byte, error) {
+	if offset < r.off || offset+int64(n) > r.off+int64(len(r.buf)) {
+		m := int64(salvageBlockSize)
+		if m < int64(n) {
+			m = int64(n)
+		}
+		if m > r.size-offset {
+			m = r.size - offset
+		}
+		if cap(r.buf) < int(m) {
+			r.buf = make([]byte, m)
+		}
+		r.buf = r.buf[:m]
+		if _, err := r.file.ReadAt(r.buf, offset); err != nil {
+			return nil, err
+		}
+		r.off = offset
+	}
+	return r.buf[offset-r.off : offset-r.off+int64(n)], nil
+}
@@ -0,0 +1,190 @@
+package gkvlite
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func salvageFiles(t *testing.T) (src, dst *os.File) {
+	os.Remove("tmp.test")
+	os.Remove("tmp.salvage")
+	src, _ = os.Create("tmp.test")
+	dst, err := os.Create("tmp.salvage")
+	if err != nil {
+		t.Fatalf("expected create to work, err: %v", err)
+	}
+	return src, dst
+}
+
+func salvageCleanup(src, dst *os.File) {
+	src.Close()
+	dst.Close()
+	os.Remove("tmp.test")
+	os.Remove("tmp.salvage")
+}
+
+func expectSalvaged(t *testing.T, dst *os.File, coll string, exp map[string]string) {
+	s, err := NewStore(dst)
+	if err != nil {
+		t.Fatalf("expected salvaged store to open, err: %v", err)
+	}
+	x := s.GetCollection(coll)
+	if x == nil {
+		t.Fatalf("expected salvaged collection: %s", coll)
+	}
+	n := 0
+	x.VisitItemsAscend([]byte{0}, true, func(i *Item) bool {
+		if exp[string(i.Key)] != string(i.Val) {
+			t.Errorf("unexpected salvaged %s => %s", i.Key, i.Val)
+		}
+		n++
+		return true
+	})
+	if n != len(exp) {
+		t.Errorf("expected %v salvaged items in %s, got: %v", len(exp), coll, n)
+	}
+}
+
+func TestSalvageHealthy(t *testing.T) {
+	src, dst := salvageFiles(t)
+	defer salvageCleanup(src, dst)
+	s, _ := NewStore(src)
+	x := s.SetCollection("x", nil)
+	y := s.SetCollection("y", nil)
+	exp := map[string]string{}
+	for j := 0; j < 3; j++ {
+		for i := 0; i < 50; i++ {
+			k, v := fmt.Sprintf("%02d", i), fmt.Sprintf("%d-%d", i, j)
+			x.Set([]byte(k), []byte(v))
+			exp[k] = v
+		}
+		s.Flush()
+	}
+	y.Set([]byte("a"), []byte("A"))
+	x.Delete([]byte("00"))
+	delete(exp, "00")
+	s.Flush()
+
+	r, err := Salvage(src, dst, SalvageOptions{})
+	if err != nil {
+		t.Fatalf("expected Salvage to work, err: %v", err)
+	}
+	if r.NumRoots != 4 || r.NumBadRoots != 0 || r.NumBadNodes != 0 ||
+		r.RootOffset != s.LastCommitInfo().Offset || r.Version != VERSION ||
+		r.NumScanned != 151 || len(r.Unattributed) != 0 ||
+		r.Collections["x"] != 49 || r.Collections["y"] != 1 {
+		t.Errorf("unexpected healthy salvage report: %#v", r)
+	}
+	expectSalvaged(t, dst, "x", exp)
+	expectSalvaged(t, dst, "y", map[string]string{"a": "A"})
+
+	if _, err = Salvage(src, dst, SalvageOptions{}); err == nil {
+		t.Errorf("expected Salvage into a non-empty dst to fail")
+	}
+}
+
+func TestSalvageLogMode(t *testing.T) {
+	src, dst := salvageFiles(t)
+	defer salvageCleanup(src, dst)
+	s, _ := NewStore(src)
+	x := s.SetCollection("x", nil)
+	x.Set([]byte("a"), []byte("1"))
+	s.Flush()
+	s.SetLogMode(&LogOptions{})
+	s.Flush() // The checkpoint.
+	x.Set([]byte("b"), []byte("2"))
+	x.Delete([]byte("a"))
+	s.Flush()
+	x.Set([]byte("c"), []byte("3"))
+	s.Flush()
+	if s.LastCommitInfo().Seq != 1 {
+		t.Fatalf("expected log records after the checkpoint")
+	}
+	finfo, _ := src.Stat()
+	src.Truncate(finfo.Size() - 1) // A torn last log record.
+
+	r, err := Salvage(src, dst, SalvageOptions{})
+	if err != nil {
+		t.Fatalf("expected Salvage to work, err: %v", err)
+	}
+	if r.NumLogs != 1 || r.NumBadNodes != 0 || r.Collections["x"] != 1 ||
+		len(r.Unattributed) != 1 || string(r.Unattributed[0].Key) != "c" {
+		t.Errorf("unexpected log mode salvage report: %#v", r)
+	}
+	expectSalvaged(t, dst, "x", map[string]string{"b": "2"})
+}
+
+func TestSalvageBadRoots(t *testing.T) {
+	src, dst := salvageFiles(t)
+	defer salvageCleanup(src, dst)
+	s, _ := NewStore(src)
+	x := s.SetCollection("x", nil)
+	x.Set([]byte("a"), []byte("A"))
+	s.Flush()
+	first := s.LastCommitInfo().Offset
+	x.Set([]byte("b"), []byte("B"))
+	s.Flush()
+	corruptByte(t, "tmp.test",
+		s.LastCommitInfo().Offset+int64(2*len(MAGIC_BEG)+4+4+2))
+
+	r, err := Salvage(src, dst, SalvageOptions{UnattributedCollection: "lost"})
+	if err != nil {
+		t.Fatalf("expected Salvage to work, err: %v", err)
+	}
+	if r.NumRoots != 1 || r.NumBadRoots != 1 || r.RootOffset != first ||
+		len(r.Unattributed) != 1 || string(r.Unattributed[0].Key) != "b" {
+		t.Errorf("unexpected bad roots salvage report: %#v", r)
+	}
+	expectSalvaged(t, dst, "x", map[string]string{"a": "A"})
+	expectSalvaged(t, dst, "lost", map[string]string{"b": "B"})
+}
+
+func TestSalvageBadNode(t *testing.T) {
+	src, dst := salvageFiles(t)
+	defer salvageCleanup(src, dst)
+	s, _ := NewStore(src)
+	x := s.SetCollection("x", nil)
+	exp := map[string]string{}
+	for i := 0; i < 26; i++ {
+		k := string([]byte{byte('a' + i)})
+		x.Set([]byte(k), []byte(k))
+		exp[k] = k
+	}
+	s.Flush()
+	x.Set([]byte("m"), []byte("new"))
+	s.Flush()
+	rnl := x.rootAddRef()
+	root := rnl.root.Loc().Offset
+	x.rootDecRef(rnl)
+	corruptByte(t, "tmp.test", root+1)
+
+	r, err := Salvage(src, dst, SalvageOptions{})
+	if err != nil {
+		t.Fatalf("expected Salvage to work, err: %v", err)
+	}
+	// The lost latest treap is recovered from the first root record,
+	// so the latest m is unattributed.
+	if r.NumRoots != 2 || r.NumBadNodes != 1 || r.Collections["x"] != 26 ||
+		len(r.Unattributed) != 1 || string(r.Unattributed[0].Key) != "m" {
+		t.Errorf("unexpected bad node salvage report: %#v", r)
+	}
+	expectSalvaged(t, dst, "x", exp)
+}
+
+func TestSalvageVersion5(t *testing.T) {
+	src, dst := salvageFiles(t)
+	defer salvageCleanup(src, dst)
+	s, _ := NewStore(src)
+	s.setVersion(5)
+	x := s.SetCollection("x", nil)
+	x.Set([]byte("a"), []byte("A"))
+	x.Set([]byte("b"), []byte("B"))
+	s.Flush()
+	r, err := Salvage(src, dst, SalvageOptions{})
+	if err != nil || r.Version != 5 || r.NumScanned != 2 ||
+		len(r.Unattributed) != 0 {
+		t.Errorf("unexpected version 5 salvage report: %#v, err: %v", r, err)
+	}
+	expectSalvaged(t, dst, "x", map[string]string{"a": "A", "b": "B"})
+}
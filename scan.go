@@ -0,0 +1,304 @@
+package gkvlite
+
+import (
+	"errors"
+	"sync"
+)
+
+// Options for Collection.Scan().
+type ScanOptions struct {
+	Descend   bool // Visit items less-than the target key, descending.
+	WithValue bool
+
+	// When ReadAhead is positive, up to ReadAhead items past the
+	// visited item, and the nodes leading to them, are read ahead by
+	// a pool of ReadAheadWorkers goroutines (default 4).  Reads of
+	// items that are next to each other in the file, as the items
+	// written by a Flush() are in key order, are coalesced into reads
+	// of up to ReadAheadBytes (default 64KB).
+	ReadAhead        int
+	ReadAheadWorkers int
+	ReadAheadBytes   int
+}
+
+const defaultReadAheadWorkers = 4
+const defaultReadAheadBytes = 64 * 1024
+
+// Visits items like VisitItemsAscend() or, with opts.Descend, like
+// VisitItemsDescend(), optionally reading ahead of the visitor to
+// speed up scans of items that aren't in memory.
+func (t *Collection) Scan(target []byte, opts ScanOptions, visitor ItemVisitor) error {
+	if opts.ReadAhead < 0 || opts.ReadAheadWorkers < 0 || opts.ReadAheadBytes < 0 {
+		return errors.New("scan options must be non-negative")
+	}
+	rnl := t.rootAddRef()
+	defer t.rootDecRef(rnl)
+	choiceFunc := ascendChoice
+	if opts.Descend {
+		choiceFunc = descendChoice
+	}
+	if opts.ReadAhead > 0 && t.store.file() != nil {
+		ra := t.startReadAhead(rnl.root, target, opts, choiceFunc)
+		defer ra.stop()
+		return ra.visit(visitor)
+	}
+	v := func(i *Item, depth uint64) bool { return visitor(i) }
+	if opts.Descend {
+		_, err := t.store.visitNodes(t, rnl.root,
+			target, opts.WithValue, v, 0, choiceFunc)
+		return err
+	}
+	return t.visitItemsAscend(rnl.root, target, opts.WithValue, v)
+}
+
+// Reads ahead of a Scan(), where a walker goroutine follows the scan's
+// path through the treap and queues up to ReadAhead items for the
+// visitor, while a pool of workers reads the items, and the nodes the
+// walker will get to.
+type readAhead struct {
+	t          *Collection
+	opts       ScanOptions
+	choiceFunc func(int, *node) (bool, *nodeLoc, *nodeLoc)
+	items      chan scanItem // To the visitor; closed once walked.
+	reads      chan func()   // To the workers.
+	stopCh     chan struct{} // Closed when the visitor's done.
+	walkerDone chan struct{}
+	workers    sync.WaitGroup
+	err        error // From the walker, valid once items is closed.
+
+	// Items next to each other in the file, not yet handed to the
+	// workers, with a channel that's closed once they're read; only
+	// used by the walker.
+	batch      []*itemLoc
+	batchDone  chan struct{}
+	batchGen   uint32
+	batchStart int64
+	batchEnd   int64
+}
+
+type scanItem struct {
+	iloc *itemLoc
+	read chan struct{} // Closed once the item's read ahead.
+}
+
+var closedCh = make(chan struct{})
+
+func init() {
+	close(closedCh)
+}
+
+func (t *Collection) startReadAhead(root *nodeLoc, target []byte,
+	opts ScanOptions, choiceFunc func(int, *node) (bool, *nodeLoc, *nodeLoc)) *readAhead {
+	if opts.ReadAheadWorkers <= 0 {
+		opts.ReadAheadWorkers = defaultReadAheadWorkers
+	}
+	if opts.ReadAheadBytes <= 0 {
+		opts.ReadAheadBytes = defaultReadAheadBytes
+	}
+	ra := &readAhead{t: t, opts: opts, choiceFunc: choiceFunc,
+		items:      make(chan scanItem, opts.ReadAhead),
+		reads:      make(chan func(), opts.ReadAheadWorkers),
+		stopCh:     make(chan struct{}),
+		walkerDone: make(chan struct{}),
+	}
+	for w := 0; w < opts.ReadAheadWorkers; w++ {
+		ra.workers.Add(1)
+		go ra.work()
+	}
+	go func() {
+		ra.err = ra.walk(root, target, true)
+		ra.readBatch()
+		close(ra.items)
+		close(ra.reads)
+		close(ra.walkerDone)
+	}()
+	return ra
+}
+
+func (ra *readAhead) work() {
+	defer ra.workers.Done()
+	for read := range ra.reads {
+		read()
+	}
+}
+
+// Stops reading ahead, waiting for the walker and workers, which must
+// be done before the scan's root is released.
+func (ra *readAhead) stop() {
+	close(ra.stopCh)
+	<-ra.walkerDone
+	ra.workers.Wait()
+}
+
+func (ra *readAhead) stopped() bool {
+	select {
+	case <-ra.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Visits the walked items, which are read again, in case reading them
+// ahead failed, so the visitor sees the same errors as without reading
+// ahead.
+func (ra *readAhead) visit(visitor ItemVisitor) error {
+	for si := range ra.items {
+		<-si.read
+		i, err := si.iloc.read(ra.t, ra.opts.WithValue)
+		if err != nil {
+			return err
+		}
+		if !visitor(i) {
+			return nil
+		}
+	}
+	return ra.err
+}
+
+var errScanStopped = errors.New("scan stopped")
+
+// Walks the nodes that the scan visits, in the same order, where only
+// the nodes of a bounded subtree need their keys compared to the
+// target.
+func (ra *readAhead) walk(n *nodeLoc, target []byte, bounded bool) error {
+	nNode, err := n.read(ra.t.store)
+	if err != nil {
+		return err
+	}
+	if n.isEmpty() || nNode == nil {
+		return nil
+	}
+	choice, choiceT, choiceF := true, (*nodeLoc)(nil), (*nodeLoc)(nil)
+	if bounded {
+		nItem, err := nNode.item.read(ra.t, false)
+		if err != nil {
+			return err
+		}
+		choice, choiceT, choiceF =
+			ra.choiceFunc(ra.t.compare(target, nItem.Key), nNode)
+	} else {
+		_, choiceT, choiceF = ra.choiceFunc(0, nNode)
+	}
+	if !choice {
+		return ra.walk(choiceF, target, true)
+	}
+	ra.readNode(choiceF) // As the walker will get there later.
+	if err := ra.walk(choiceT, target, bounded); err != nil {
+		return err
+	}
+	if err := ra.walked(&nNode.item); err != nil {
+		return err
+	}
+	return ra.walk(choiceF, target, false)
+}
+
+// Queues an item for the visitor, after adding it to the batch.  When
+// the queue's empty or full, the batch is handed to the workers first,
+// as the visitor may be waiting for it.
+func (ra *readAhead) walked(iloc *itemLoc) error {
+	if ra.stopped() {
+		return errScanStopped
+	}
+	si := scanItem{iloc: iloc, read: ra.readItem(iloc)}
+	if len(ra.items) <= 0 {
+		ra.readBatch()
+	}
+	select {
+	case ra.items <- si:
+		return nil
+	default:
+	}
+	ra.readBatch()
+	select {
+	case ra.items <- si:
+		return nil
+	case <-ra.stopCh:
+		return errScanStopped
+	}
+}
+
+// Reads a node in the background, unless the workers are busy.
+func (ra *readAhead) readNode(nloc *nodeLoc) {
+	if nloc.isEmpty() || nloc.Node() != nil {
+		return
+	}
+	select {
+	case ra.reads <- func() {
+		if !ra.stopped() {
+			nloc.read(ra.t.store)
+		}
+	}:
+	default:
+	}
+}
+
+// Adds an item to the batch, first handing the batch to the workers if
+// the item isn't next to it in the file.  Returns a channel that's
+// closed once the item's read.
+func (ra *readAhead) readItem(iloc *itemLoc) chan struct{} {
+	if i := iloc.Item(); i != nil && (i.Val != nil || !ra.opts.WithValue) {
+		return closedCh
+	}
+	loc := iloc.Loc()
+	if loc.isEmpty() {
+		return closedCh
+	}
+	start, end := loc.Offset, loc.Offset+int64(loc.Length)
+	if len(ra.batch) > 0 {
+		if loc.gen != ra.batchGen ||
+			(start != ra.batchEnd && end != ra.batchStart) ||
+			ra.batchEnd-ra.batchStart+int64(loc.Length) > int64(ra.opts.ReadAheadBytes) {
+			ra.readBatch()
+		}
+	}
+	if len(ra.batch) == 0 {
+		ra.batchDone = make(chan struct{})
+		ra.batchGen, ra.batchStart, ra.batchEnd = loc.gen, start, end
+	} else if start == ra.batchEnd {
+		ra.batchEnd = end
+	} else {
+		ra.batchStart = start // A descending scan.
+	}
+	ra.batch = append(ra.batch, iloc)
+	return ra.batchDone
+}
+
+// Hands the batch to the workers, to read with a single ReadAt.
+func (ra *readAhead) readBatch() {
+	if len(ra.batch) <= 0 {
+		return
+	}
+	batch, done := ra.batch, ra.batchDone
+	gen, start, end := ra.batchGen, ra.batchStart, ra.batchEnd
+	ra.batch, ra.batchDone = nil, nil
+	ra.reads <- func() {
+		defer close(done)
+		if ra.stopped() {
+			return
+		}
+		file := ra.t.store.fileAt(gen).file
+		buf := make([]byte, end-start)
+		if _, err := file.ReadAt(buf, start); err != nil {
+			return
+		}
+		from := &spanFile{StoreFile: file, buf: buf, start: start}
+		for _, iloc := range batch {
+			iloc.readFrom(ra.t, ra.opts.WithValue, from)
+		}
+	}
+}
+
+// Serves the reads within buf, which holds the file's bytes at start.
+type spanFile struct {
+	StoreFile
+	buf   []byte
+	start int64
+}
+
+func (f *spanFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.start && off+int64(len(p)) <= f.start+int64(len(f.buf)) {
+		return copy(p, f.buf[off-f.start:]), nil
+	}
+	return f.StoreFile.ReadAt(p, off)
+}
@@ -0,0 +1,128 @@
+package gkvlite
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type readCountFile struct {
+	*os.File
+	numReadAt int64
+	latency   time.Duration
+	err       atomic.Value // An error for ReadAt's to return.
+}
+
+func (f *readCountFile) ReadAt(p []byte, off int64) (int, error) {
+	atomic.AddInt64(&f.numReadAt, 1)
+	time.Sleep(f.latency)
+	if err, ok := f.err.Load().(error); ok {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+// Returns the keys and values that a Scan() of a just opened Store
+// visits, with the number of ReadAt's.
+func coldScan(t *testing.T, f *os.File, latency time.Duration, target []byte,
+	opts ScanOptions, limit int) ([]string, int64) {
+	rf := &readCountFile{File: f, latency: latency}
+	s, err := NewStore(rf)
+	if err != nil {
+		t.Fatalf("expected NewStore to work, err: %v", err)
+	}
+	atomic.StoreInt64(&rf.numReadAt, 0)
+	res := []string{}
+	err = s.GetCollection("x").Scan(target, opts, func(i *Item) bool {
+		res = append(res, string(i.Key)+"="+string(i.Val))
+		return len(res) < limit
+	})
+	if err != nil {
+		t.Fatalf("expected Scan to work, err: %v", err)
+	}
+	return res, atomic.LoadInt64(&rf.numReadAt)
+}
+
+func TestScanReadAhead(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	for j := 0; j < 2; j++ {
+		for i := j; i < 2000; i += 2 {
+			x.Set([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("v%d", i)))
+		}
+		if err := s.Flush(); err != nil {
+			t.Fatalf("expected Flush to work, err: %v", err)
+		}
+	}
+
+	tests := []struct {
+		target []byte
+		opts   ScanOptions
+		limit  int
+	}{
+		{nil, ScanOptions{}, 10000},
+		{nil, ScanOptions{WithValue: true}, 10000},
+		{[]byte("0500"), ScanOptions{WithValue: true}, 100},
+		{[]byte("0500"), ScanOptions{WithValue: true, Descend: true}, 10000},
+		{[]byte("1234"), ScanOptions{}, 1},
+		{[]byte("9999"), ScanOptions{}, 10000},
+	}
+	for testi, test := range tests {
+		exp, _ := coldScan(t, f, 0, test.target, test.opts, test.limit)
+		for _, readAhead := range []int{1, 10, 1000} {
+			opts := test.opts
+			opts.ReadAhead = readAhead
+			opts.ReadAheadBytes = 4096
+			got, _ := coldScan(t, f, 0, test.target, opts, test.limit)
+			if !reflect.DeepEqual(exp, got) {
+				t.Errorf("test: %v, readAhead: %v, expected: %v, got: %v",
+					testi, readAhead, exp, got)
+			}
+		}
+	}
+
+	// With slow reads, the walker gets ahead of the visitor, and most
+	// items come from coalesced reads.
+	opts := ScanOptions{WithValue: true}
+	_, numReadAt := coldScan(t, f, 50*time.Microsecond, nil, opts, 200)
+	opts.ReadAhead = 50
+	_, numReadAt2 := coldScan(t, f, 50*time.Microsecond, nil, opts, 200)
+	if numReadAt2 > numReadAt*2/3 {
+		t.Errorf("expected fewer reads with coalescing, got: %v vs %v",
+			numReadAt2, numReadAt)
+	}
+
+	rf := &readCountFile{File: f}
+	s2, _ := NewStore(rf)
+	rf.err.Store(errors.New("read error"))
+	for _, descend := range []bool{false, true} {
+		err := s2.GetCollection("x").Scan([]byte("1000"),
+			ScanOptions{Descend: descend, ReadAhead: 10},
+			func(i *Item) bool { return true })
+		if err == nil {
+			t.Errorf("expected Scan to fail on read errors, descend: %v", descend)
+		}
+	}
+
+	if err := x.Scan(nil, ScanOptions{ReadAhead: -1},
+		func(i *Item) bool { return true }); err == nil {
+		t.Errorf("expected negative ReadAhead to fail")
+	}
+	mem, _ := NewStore(nil)
+	m := mem.SetCollection("m", nil)
+	m.Set([]byte("a"), []byte("A"))
+	n := 0
+	if err := m.Scan(nil, ScanOptions{ReadAhead: 10},
+		func(i *Item) bool { n++; return true }); err != nil || n != 1 {
+		t.Errorf("expected a memory-only Scan to work, n: %v, err: %v", n, err)
+	}
+}
@@ -0,0 +1,124 @@
+package gkvlite
+
+import (
+	"sync/atomic"
+)
+
+// Reports how many bytes of the Store's file are reachable from the
+// current roots (live) versus the total file size.  The rest of the
+// file is garbage that a compaction would reclaim.
+type SpaceUsage struct {
+	Exact     bool  // False when the item and node bytes are estimates.
+	FileSize  int64 // Position of the next write.
+	ItemBytes int64 // Live bytes of item records, including headers.
+	NodeBytes int64 // Live bytes of node records.
+	RootBytes int64 // Bytes of the last root record and any header.
+
+	Collections map[string]*CollectionSpaceUsage
+}
+
+// The live bytes of a single Collection.
+type CollectionSpaceUsage struct {
+	NumItems  uint64 // Includes unflushed items.
+	ItemBytes int64
+	NodeBytes int64
+}
+
+// Returns the number of live bytes in the file.
+func (u *SpaceUsage) LiveBytes() int64 {
+	return u.ItemBytes + u.NodeBytes + u.RootBytes
+}
+
+// Returns the number of garbage bytes in the file.
+func (u *SpaceUsage) DeadBytes() int64 {
+	return u.FileSize - u.LiveBytes()
+}
+
+// Returns the fraction of the file that is garbage, from 0.0 to 1.0.
+func (u *SpaceUsage) DeadRatio() float64 {
+	if u.FileSize <= 0 {
+		return 0.0
+	}
+	return float64(u.DeadBytes()) / float64(u.FileSize)
+}
+
+// Returns the live versus total space usage of the Store's file.
+// When exact is false, the usage is cheaply estimated from the
+// numNodes and numBytes of each collection's root node, which also
+// counts unflushed items.  When exact is true, every persisted node
+// is visited, which may read the entire treap from the file, but not
+// the items.
+func (s *Store) SpaceUsage(exact bool) (*SpaceUsage, error) {
+	res := &SpaceUsage{
+		Exact:       exact,
+		FileSize:    atomic.LoadInt64(&s.size),
+		Collections: map[string]*CollectionSpaceUsage{},
+	}
+	if s.file() == nil {
+		return res, nil
+	}
+	if ci := s.LastCommitInfo(); ci != nil {
+		data, err := s.readRootsAt(ci.Offset)
+		if err != nil {
+			return nil, err
+		}
+		res.RootBytes = int64(len(data) + rootsEndLen)
+		if s.version() >= VERSION_REC {
+			res.RootBytes += int64(recHdrLength)
+		}
+	}
+	res.RootBytes += s.dataStart()
+	coll := *(*map[string]*Collection)(atomic.LoadPointer(&s.coll))
+	for _, name := range collNames(coll) {
+		cu, err := coll[name].spaceUsage(exact)
+		if err != nil {
+			return nil, err
+		}
+		res.Collections[name] = cu
+		res.ItemBytes += cu.ItemBytes
+		res.NodeBytes += cu.NodeBytes
+	}
+	return res, nil
+}
+
+func (t *Collection) spaceUsage(exact bool) (*CollectionSpaceUsage, error) {
+	rnl := t.rootAddRef()
+	defer t.rootDecRef(rnl)
+	res := &CollectionSpaceUsage{}
+	if !exact {
+		nNode, err := rnl.root.read(t.store)
+		if err != nil || rnl.root.isEmpty() || nNode == nil {
+			return res, err
+		}
+		res.NumItems = nNode.numNodes
+		version := t.store.version()
+		res.ItemBytes = int64(nNode.numBytes) +
+			int64(nNode.numNodes)*int64(itemLocHdrLength(version))
+		res.NodeBytes = int64(nNode.numNodes) * int64(nodeLocLength(version))
+		return res, nil
+	}
+	return res, t.spaceUsageVisit(rnl.root, res)
+}
+
+func (t *Collection) spaceUsageVisit(nloc *nodeLoc,
+	res *CollectionSpaceUsage) error {
+	if nloc.isEmpty() {
+		return nil
+	}
+	if loc := nloc.Loc(); !loc.isEmpty() && loc.gen == t.store.gen() {
+		res.NodeBytes += int64(loc.Length)
+	}
+	// Read through a copy, so the treap doesn't hold onto the nodes.
+	nNode, err := (&nodeLoc{}).Copy(nloc).read(t.store)
+	if err != nil || nNode == nil {
+		return err
+	}
+	res.NumItems++
+	if loc := nNode.item.Loc(); !loc.isEmpty() && loc.gen == t.store.gen() {
+		res.ItemBytes += int64(loc.Length)
+	}
+	if err = t.spaceUsageVisit(&nNode.left, res); err != nil {
+		return err
+	}
+	return t.spaceUsageVisit(&nNode.right, res)
+}
@@ -0,0 +1,84 @@
+package gkvlite
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestSpaceUsage(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	s, _ := NewStore(f)
+	u, err := s.SpaceUsage(true)
+	if err != nil || u.FileSize != 0 || u.LiveBytes() != 0 || u.DeadRatio() != 0 {
+		t.Errorf("expected empty space usage, got: %#v, err: %v", u, err)
+	}
+	x := s.SetCollection("x", nil)
+	y := s.SetCollection("y", nil)
+	for i := 0; i < 100; i++ {
+		x.Set([]byte(fmt.Sprintf("%03d", i)), []byte("xxxxxxxxxx"))
+	}
+	y.Set([]byte("a"), []byte("a"))
+	s.Flush()
+
+	for _, exact := range []bool{true, false} {
+		u, err = s.SpaceUsage(exact)
+		if err != nil {
+			t.Errorf("expected SpaceUsage to work, err: %v", err)
+		}
+		if u.DeadBytes() != 0 || u.RootBytes <= 0 {
+			t.Errorf("expected no dead bytes after one Flush, got: %#v", u)
+		}
+		if u.Collections["x"].NumItems != 100 || u.Collections["y"].NumItems != 1 {
+			t.Errorf("unexpected collection space usage: %#v", u.Collections)
+		}
+		if u.Collections["y"].ItemBytes != int64(itemLocHdrLength(VERSION)+2) ||
+			u.Collections["y"].NodeBytes != int64(nodeLocLength(VERSION)) {
+			t.Errorf("unexpected y space usage: %#v", u.Collections["y"])
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		x.Set([]byte(fmt.Sprintf("%03d", i)), []byte("yyyyyyyyyy"))
+	}
+	s.Flush()
+	u, _ = s.SpaceUsage(true)
+	if u.DeadBytes() <= int64(50*(itemLocHdrLength(VERSION)+3+10)) {
+		t.Errorf("expected dead bytes after overwrites, got: %#v", u)
+	}
+	if u.DeadRatio() <= 0.0 || u.DeadRatio() >= 1.0 {
+		t.Errorf("unexpected dead ratio: %v", u.DeadRatio())
+	}
+
+	x.Set([]byte("zzz"), []byte("unflushed"))
+	exact, _ := s.SpaceUsage(true)
+	estimate, _ := s.SpaceUsage(false)
+	if exact.Collections["x"].ItemBytes != u.Collections["x"].ItemBytes {
+		t.Errorf("expected exact to skip the unflushed item, got: %v vs %v",
+			exact.Collections["x"].ItemBytes, u.Collections["x"].ItemBytes)
+	}
+	if estimate.Collections["x"].ItemBytes <= u.Collections["x"].ItemBytes {
+		t.Errorf("expected estimate to count the unflushed item, got: %v vs %v",
+			estimate.Collections["x"].ItemBytes, u.Collections["x"].ItemBytes)
+	}
+
+	// Exact mode reads the nodes without caching them in the treap.
+	s.Flush()
+	s2, _ := NewStore(f)
+	u, err = s2.SpaceUsage(true)
+	if err != nil || u.Collections["x"].NumItems != 101 {
+		t.Errorf("expected reopened space usage, got: %#v, err: %v", u, err)
+	}
+	if s2.GetCollection("x").root.root.Node() != nil {
+		t.Errorf("expected exact SpaceUsage not to cache nodes")
+	}
+
+	mem, _ := NewStore(nil)
+	u, err = mem.SpaceUsage(false)
+	if err != nil || u.LiveBytes() != 0 {
+		t.Errorf("expected memory-only SpaceUsage to be empty, err: %v", err)
+	}
+}
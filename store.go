@@ -5,16 +5,19 @@ package gkvlite
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"reflect"
 	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -23,10 +26,39 @@ type Store struct {
 	// Atomic CAS'ed int64/uint64's must be at the top for 32-bit compatibility.
 	size       int64          // Atomic protected; file size or next write position.
 	nodeAllocs uint64         // Atomic protected; total node allocation stats.
+	dirtyItems int64          // Atomic protected; mutations since the last Flush().
+	dirtyBytes int64          // Atomic protected; key/val bytes of those mutations.
 	coll       unsafe.Pointer // Copy-on-write map[string]*Collection.
-	file       StoreFile      // When nil, we're memory-only or no persistence.
+	lastCommit unsafe.Pointer // *CommitInfo of the last root record; may be nil.
+	files      unsafe.Pointer // Copy-on-write []fileGen, indexed by ploc.gen.
 	callbacks  StoreCallbacks // Optional / may be nil.
 	readOnly   bool           // When true, Flush()'ing is disallowed.
+	header     bool           // When true, the file starts with a header.
+	headerSeq  uint64         // Protected by flushLock; seq of the last written header slot.
+
+	// Held for reading by mutations, so Compact() can exclude them
+	// while switching files.
+	mutLock sync.RWMutex
+
+	flushLock sync.Mutex // Serializes Flush()'es with Compact()'s switch.
+
+	committer   committer      // For CommitAsync().
+	autoFlusher unsafe.Pointer // *AutoFlusher, when started.
+	dirtyColls  int32          // Atomic protected; 1 if collections changed since the last Flush().
+
+	logOpts    unsafe.Pointer // *LogOptions, when in log mode.
+	logLock    sync.Mutex     // Protects logDeletes.
+	logDeletes []logDelete    // Deletes since the last Flush(), in log mode.
+	log        logState       // Protected by flushLock.
+
+	bufferSize int          // Protected by flushLock; see SetFlushBufferSize().
+	wbuf       *writeBuffer // Protected by flushLock; non-nil during a Flush().
+
+	parallelism int // Protected by flushLock; see SetFlushParallelism().
+
+	cache unsafe.Pointer // *memCache, when there's a memory budget.
+
+	alloc *allocator // Free lists, shared with snapshots.
 }
 
 // The StoreFile interface is implemented by os.File.  Application
@@ -70,6 +102,10 @@ type StoreCallbacks struct {
 	ItemValRead func(c *Collection, i *Item,
 		r io.ReaderAt, offset int64, valLength uint32) error
 
+	// Optional callback to sync wherever ItemValWrite wrote, invoked
+	// by FlushEx() with Sync before it syncs the Store's file.
+	ItemValSync func() error
+
 	// Invoked when a Store is reloaded (during NewStoreEx()) from
 	// disk, this callback allows the user to optionally supply a key
 	// comparison func for each collection.  Otherwise, the default is
@@ -79,7 +115,10 @@ type StoreCallbacks struct {
 
 type ItemCallback func(*Collection, *Item) (*Item, error)
 
-const VERSION = uint32(4)
+const VERSION = uint32(7)
+
+// Oldest file format version that can still be read and appended to.
+const VERSION_MIN = uint32(4)
 
 var MAGIC_BEG []byte = []byte("0g1t2r")
 var MAGIC_END []byte = []byte("3e4a5p")
@@ -87,6 +126,70 @@ var MAGIC_END []byte = []byte("3e4a5p")
 var rootsEndLen int = 8 + 4 + 2*len(MAGIC_END)
 var rootsLen int64 = int64(2*len(MAGIC_BEG) + 4 + 4 + rootsEndLen)
 
+// Describes a root record, which is written at the end of every
+// Flush().  The CommitInfo should be treated as immutable.
+type CommitInfo struct {
+	Offset int64             // File offset of the root record.
+	Seq    uint64            // Incremented on every Flush(); starts at 0.
+	Time   time.Time         // Wall-clock time of the Flush().
+	Meta   map[string]string // From FlushWithMeta(); may be nil.
+
+	prev   int64  // Offset of the previous root record, or -1.
+	fileID uint64 // Random identity of the file, or 0 if unknown.
+}
+
+type CommitVisitor func(ci *CommitInfo) bool
+
+// The JSON layout of root records since file format version 5.
+// Earlier versions only held the Colls map.
+type rootsJSON struct {
+	Colls interface{}       `json:"colls"`
+	Prev  int64             `json:"prev"`
+	Seq   uint64            `json:"seq"`
+	Time  time.Time         `json:"time"`
+	Meta  map[string]string `json:"meta,omitempty"`
+	File  uint64            `json:"file,omitempty"` // The fileID.
+}
+
+// A file generation, where a Store's file changes on Compact(), which
+// appends the generation of the new file, so the last one is current.
+type fileGen struct {
+	file    StoreFile // For reads, which may go to a read overlay of base.
+	base    StoreFile
+	version uint32 // File format version.
+}
+
+func newFileGens(file StoreFile, version uint32) unsafe.Pointer {
+	return unsafe.Pointer(&[]fileGen{{file: file, base: file, version: version}})
+}
+
+// Returns the current file, or nil when we're memory-only or no
+// persistence.  The file, generation and format version of a Store
+// are published through its files, so they switch atomically on
+// Compact().
+func (o *Store) file() StoreFile {
+	if files := (*[]fileGen)(atomic.LoadPointer(&o.files)); files != nil {
+		return (*files)[len(*files)-1].base
+	}
+	return nil
+}
+
+// Returns the generation of the current file, used for writes.
+func (o *Store) gen() uint32 {
+	if files := (*[]fileGen)(atomic.LoadPointer(&o.files)); files != nil {
+		return uint32(len(*files) - 1)
+	}
+	return 0
+}
+
+// Returns the file format version used for writes.
+func (o *Store) version() uint32 {
+	if files := (*[]fileGen)(atomic.LoadPointer(&o.files)); files != nil {
+		return (*files)[len(*files)-1].version
+	}
+	return VERSION
+}
+
 // Provide a nil StoreFile for in-memory-only (non-persistent) usage.
 func NewStore(file StoreFile) (*Store, error) {
 	return NewStoreEx(file, StoreCallbacks{})
@@ -95,11 +198,12 @@ func NewStore(file StoreFile) (*Store, error) {
 func NewStoreEx(file StoreFile,
 	callbacks StoreCallbacks) (*Store, error) {
 	coll := make(map[string]*Collection)
-	res := &Store{coll: unsafe.Pointer(&coll), callbacks: callbacks}
+	res := &Store{coll: unsafe.Pointer(&coll), callbacks: callbacks,
+		alloc: &allocator{}}
 	if file == nil || !reflect.ValueOf(file).Elem().IsValid() {
 		return res, nil // Memory-only Store.
 	}
-	res.file = file
+	res.files = newFileGens(file, VERSION)
 	if err := res.readRoots(); err != nil {
 		return nil, err
 	}
@@ -114,6 +218,8 @@ func (s *Store) SetCollection(name string, compare KeyCompare) *Collection {
 	if compare == nil {
 		compare = bytes.Compare
 	}
+	s.mutLock.RLock()
+	defer s.mutLock.RUnlock()
 	for {
 		orig := atomic.LoadPointer(&s.coll)
 		coll := copyColl(*(*map[string]*Collection)(orig))
@@ -127,6 +233,7 @@ func (s *Store) SetCollection(name string, compare KeyCompare) *Collection {
 		coll[name] = cnew
 		if atomic.CompareAndSwapPointer(&s.coll, orig, unsafe.Pointer(&coll)) {
 			cold.closeCollection()
+			atomic.StoreInt32(&s.dirtyColls, 1)
 			return cnew
 		}
 		cnew.closeCollection()
@@ -170,6 +277,8 @@ func collNames(coll map[string]*Collection) []string {
 // you do a Flush().  Invoking RemoveCollection(x) and then
 // SetCollection(x) is a fast way to empty a Collection.
 func (s *Store) RemoveCollection(name string) {
+	s.mutLock.RLock()
+	defer s.mutLock.RUnlock()
 	for {
 		orig := atomic.LoadPointer(&s.coll)
 		coll := copyColl(*(*map[string]*Collection)(orig))
@@ -177,6 +286,9 @@ func (s *Store) RemoveCollection(name string) {
 		delete(coll, name)
 		if atomic.CompareAndSwapPointer(&s.coll, orig, unsafe.Pointer(&coll)) {
 			cold.closeCollection()
+			if cold != nil {
+				atomic.StoreInt32(&s.dirtyColls, 1)
+			}
 			return
 		}
 	}
@@ -194,15 +306,93 @@ func copyColl(orig map[string]*Collection) map[string]*Collection {
 // greater-window-of-data-loss versus higher-performance tradeoff,
 // consider having many mutations (Set()'s & Delete()'s) and then
 // have a less occasional Flush() instead of Flush()'ing after every
-// mutation.  Users may also wish to file.Sync() after a Flush() for
+// mutation.  Users may also wish to use FlushEx() with Sync for
 // extra data-loss protection.
 func (s *Store) Flush() error {
+	return s.FlushEx(FlushOptions{})
+}
+
+// Same as Flush(), but also records the application's metadata (such
+// as a writer id or commit message) in the root record, where it's
+// available afterwards via LastCommitInfo() and VisitCommits().
+func (s *Store) FlushWithMeta(meta map[string]string) error {
+	return s.FlushEx(FlushOptions{Meta: meta})
+}
+
+// Configures FlushEx().
+type FlushOptions struct {
+	Meta map[string]string // See FlushWithMeta().
+
+	// When true, the StoreFile must be a Syncer, and it's synced after
+	// the items and nodes are written, so they're durable before the
+	// root record that points to them, and synced again after the root
+	// record and any header are written.  Calling file.Sync() after a
+	// Flush() instead doesn't order the root record's write after the
+	// other writes, so a crash might leave a root record that points
+	// to unwritten data.
+	Sync bool
+
+	// In log mode (see SetLogMode()), write a checkpoint of the treap
+	// nodes and a root record instead of a log record.
+	Checkpoint bool
+}
+
+// Optionally implemented by a StoreFile, such as by os.File, for
+// FlushEx() with Sync.
+type Syncer interface {
+	Sync() error
+}
+
+// Optionally implemented by a StoreFile, such as by an MmapFile with
+// ZeroCopy, whose bytes can be used in place, so items read from it
+// get Item.Key's and Item.Val's that are its bytes instead of copies.
+type Slicer interface {
+	// Returns the n bytes at off, or nil if they can't be used in
+	// place.
+	Slice(off int64, n int) []byte
+}
+
+// Same as Flush(), but configurable with FlushOptions.
+func (s *Store) FlushEx(opts FlushOptions) error {
 	if s.readOnly {
 		return errors.New("readonly, so cannot Flush()")
 	}
-	if s.file == nil {
+	s.flushLock.Lock() // Before the file, which Compact() may switch.
+	defer s.flushLock.Unlock()
+	if s.file() == nil {
 		return errors.New("no file / in-memory only, so cannot Flush()")
 	}
+	var syncer Syncer
+	if opts.Sync {
+		var ok bool
+		if syncer, ok = s.file().(Syncer); !ok {
+			return errors.New("StoreFile is not a Syncer, so cannot Sync")
+		}
+	}
+	// Reset before taking the roots, so concurrent mutations are never
+	// lost from the dirty counts, at worst counted twice.
+	dirtyItems := atomic.SwapInt64(&s.dirtyItems, 0)
+	dirtyBytes := atomic.SwapInt64(&s.dirtyBytes, 0)
+	dirtyColls := atomic.SwapInt32(&s.dirtyColls, 0)
+	stopBuffer := s.startBuffer()
+	err := s.flush(syncer, opts)
+	if errBuffer := stopBuffer(); err == nil {
+		err = errBuffer
+	}
+	if err != nil {
+		atomic.AddInt64(&s.dirtyItems, dirtyItems)
+		atomic.AddInt64(&s.dirtyBytes, dirtyBytes)
+		if dirtyColls != 0 {
+			atomic.StoreInt32(&s.dirtyColls, 1)
+		}
+	}
+	return err
+}
+
+func (s *Store) flush(syncer Syncer, opts FlushOptions) error {
+	if done, err := s.flushLog(syncer, opts); done || err != nil {
+		return err
+	}
 	coll := *(*map[string]*Collection)(atomic.LoadPointer(&s.coll))
 	rnls := map[string]*rootNodeLoc{}
 	cnames := collNames(coll)
@@ -215,12 +405,86 @@ func (s *Store) Flush() error {
 			coll[name].rootDecRef(rnls[name])
 		}
 	}()
-	for _, name := range cnames {
-		if err := coll[name].write(rnls[name].root); err != nil {
+	if err := s.writeColls(coll, cnames, rnls); err != nil {
+		return err
+	}
+	if err := s.flushBuffer(); err != nil {
+		return err
+	}
+	if syncer != nil {
+		if err := s.syncItems(syncer); err != nil {
+			return err
+		}
+	}
+	if err := s.writeRoots(rnls, opts.Meta); err != nil {
+		return err
+	}
+	s.log.checkpointed(s, coll)
+	if s.header {
+		if syncer != nil { // The root record is durable before the header.
+			if err := syncer.Sync(); err != nil {
+				return err
+			}
+		}
+		if err := s.writeHeader(); err != nil {
 			return err
 		}
 	}
-	return s.writeRoots(rnls)
+	if syncer != nil {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// Syncs the written items, including any values written elsewhere by
+// an ItemValWrite callback.
+func (s *Store) syncItems(syncer Syncer) error {
+	if s.callbacks.ItemValSync != nil {
+		if err := s.callbacks.ItemValSync(); err != nil {
+			return err
+		}
+	}
+	return syncer.Sync()
+}
+
+// Returns information on the last root record that was written or
+// loaded, or nil if there is none.
+func (s *Store) LastCommitInfo() *CommitInfo {
+	return (*CommitInfo)(atomic.LoadPointer(&s.lastCommit))
+}
+
+// Visits the historical root records of the file, from the most
+// recent to the oldest.  Root records from files of version 4 have
+// only an Offset, so they're found by slower, backwards scanning.
+func (s *Store) VisitCommits(visitor CommitVisitor) error {
+	if s.file() == nil {
+		return nil
+	}
+	ci := s.LastCommitInfo()
+	for ci != nil {
+		if !visitor(ci) {
+			return nil
+		}
+		var data []byte
+		var err error
+		offset := ci.prev
+		if s.version() < 5 {
+			offset, data, err = s.scanRoots(ci.Offset)
+		} else if offset >= 0 {
+			data, err = s.readRootsAt(offset)
+		}
+		if err != nil {
+			return err
+		}
+		if offset < 0 {
+			return nil
+		}
+		_, ci, _, err = s.parseRoots(offset, data, false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Reverts the last Flush(), bringing the Store back to its state at
@@ -228,9 +492,11 @@ func (s *Store) Flush() error {
 // if there were no next-to-last Flush().  This call will truncate the
 // Store file.
 func (s *Store) FlushRevert() error {
-	if s.file == nil {
+	if s.file() == nil {
 		return errors.New("no file / in-memory only, so cannot FlushRevert()")
 	}
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
 	orig := atomic.LoadPointer(&s.coll)
 	coll := make(map[string]*Collection)
 	if atomic.CompareAndSwapPointer(&s.coll, orig, unsafe.Pointer(&coll)) {
@@ -248,7 +514,12 @@ func (s *Store) FlushRevert() error {
 	if s.readOnly {
 		return nil
 	}
-	return s.file.Truncate(atomic.LoadInt64(&s.size))
+	if s.header {
+		if err = s.writeHeader(); err != nil {
+			return err
+		}
+	}
+	return s.file().Truncate(atomic.LoadInt64(&s.size))
 }
 
 // Returns a read-only snapshot, including any mutations on the
@@ -258,11 +529,14 @@ func (s *Store) FlushRevert() error {
 func (s *Store) Snapshot() (snapshot *Store) {
 	coll := copyColl(*(*map[string]*Collection)(atomic.LoadPointer(&s.coll)))
 	res := &Store{
-		coll:      unsafe.Pointer(&coll),
-		file:      s.file,
-		size:      atomic.LoadInt64(&s.size),
-		readOnly:  true,
-		callbacks: s.callbacks,
+		coll:       unsafe.Pointer(&coll),
+		lastCommit: atomic.LoadPointer(&s.lastCommit),
+		files:      atomic.LoadPointer(&s.files),
+		size:       atomic.LoadInt64(&s.size),
+		readOnly:   true,
+		callbacks:  s.callbacks,
+		header:     s.header,
+		alloc:      s.alloc, // As the snapshot shares nodes.
 	}
 	for _, name := range collNames(coll) {
 		collOrig := coll[name]
@@ -276,8 +550,57 @@ func (s *Store) Snapshot() (snapshot *Store) {
 	return res
 }
 
+// Returns a read-only snapshot of the Store as of the last root
+// record that was written at or before time t, or nil if there is no
+// such root record.  Unlike Snapshot(), the returned snapshot doesn't
+// include any unflushed mutations.  Root records from files of
+// version 4 have no timestamps, so they're not supported.
+func (s *Store) SnapshotAsOf(t time.Time) (*Store, error) {
+	if s.file() == nil {
+		return nil, errors.New("no file / in-memory only, so cannot SnapshotAsOf()")
+	}
+	if s.version() < 5 {
+		return nil, fmt.Errorf("file version: %v does not record commit times",
+			s.version())
+	}
+	var found *CommitInfo
+	err := s.VisitCommits(func(ci *CommitInfo) bool {
+		if ci.Time.After(t) {
+			return true
+		}
+		found = ci
+		return false
+	})
+	if err != nil || found == nil {
+		return nil, err
+	}
+	return s.snapshotAt(found)
+}
+
+// Returns a read-only snapshot of the Store as of a root record.
+func (s *Store) snapshotAt(ci *CommitInfo) (*Store, error) {
+	data, err := s.readRootsAt(ci.Offset)
+	if err != nil {
+		return nil, err
+	}
+	res := &Store{
+		lastCommit: unsafe.Pointer(ci),
+		files:      atomic.LoadPointer(&s.files),
+		size:       ci.Offset + int64(len(data)+rootsEndLen),
+		readOnly:   true,
+		callbacks:  s.callbacks,
+		alloc:      &allocator{},
+	}
+	coll, _, _, err := res.parseRoots(ci.Offset, data, true)
+	if err != nil {
+		return nil, err
+	}
+	res.coll = unsafe.Pointer(&coll)
+	return res, nil
+}
+
 func (s *Store) Close() {
-	s.file = nil
+	atomic.StorePointer(&s.files, nil)
 	cptr := atomic.LoadPointer(&s.coll)
 	if cptr == nil ||
 		!atomic.CompareAndSwapPointer(&s.coll, cptr, unsafe.Pointer(nil)) {
@@ -344,34 +667,97 @@ func (s *Store) CopyTo(dstFile StoreFile, flushEvery int) (res *Store, err error
 func (s *Store) Stats(out map[string]uint64) {
 	out["fileSize"] = uint64(atomic.LoadInt64(&s.size))
 	out["nodeAllocs"] = atomic.LoadUint64(&s.nodeAllocs)
+	if mc := (*memCache)(atomic.LoadPointer(&s.cache)); mc != nil {
+		mc.m.Lock()
+		out["cachedBytes"] = uint64(mc.bytes)
+		out["evictedNodes"] = mc.numEvictedNodes
+		out["evictedItems"] = mc.numEvictedItems
+		mc.m.Unlock()
+	}
 }
 
-func (o *Store) writeRoots(rnls map[string]*rootNodeLoc) error {
-	sJSON, err := json.Marshal(rnls)
+// Returns a random, non-zero identity for a new file, which its root
+// records carry, so that increments of one file aren't restored onto
+// the backup of another, such as after a Compact().
+func newFileID() (uint64, error) {
+	var b [8]byte
+	for {
+		if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+			return 0, err
+		}
+		if id := binary.BigEndian.Uint64(b[:]); id != 0 {
+			return id, nil
+		}
+	}
+}
+
+func (o *Store) writeRoots(rnls map[string]*rootNodeLoc,
+	meta map[string]string) error {
+	ci := &CommitInfo{Offset: atomic.LoadInt64(&o.size), Meta: meta, prev: -1}
+	var sJSON []byte
+	var err error
+	if o.version() < 5 {
+		if meta != nil {
+			return fmt.Errorf("file version: %v does not support commit"+
+				" metadata; use CopyTo() to upgrade", o.version())
+		}
+		sJSON, err = json.Marshal(rnls)
+	} else {
+		if last := o.LastCommitInfo(); last != nil {
+			ci.prev = last.Offset
+			ci.Seq = last.Seq + 1
+			ci.fileID = last.fileID // Even if 0, from an older release.
+		} else if ci.fileID, err = newFileID(); err != nil {
+			return err
+		}
+		ci.Time = time.Now()
+		sJSON, err = json.Marshal(&rootsJSON{
+			Colls: rnls, Prev: ci.prev, Seq: ci.Seq, Time: ci.Time, Meta: meta,
+			File: ci.fileID,
+		})
+	}
 	if err != nil {
 		return err
 	}
-	offset := atomic.LoadInt64(&o.size)
+	start := ci.Offset
+	var hdr []byte
+	if o.version() >= VERSION_REC {
+		hdr = make([]byte, recHdrLength)
+		ci.Offset += int64(recHdrLength) // The roots follow the record header.
+	}
+	offset := ci.Offset
 	length := 2*len(MAGIC_BEG) + 4 + 4 + len(sJSON) + 8 + 4 + 2*len(MAGIC_END)
-	b := bytes.NewBuffer(make([]byte, length)[:0])
+	if o.version() >= VERSION_CRC {
+		length += 4
+	}
+	if len(hdr) > 0 {
+		putRecHdr(hdr, RecordRoots, uint32(len(hdr)+length))
+	}
+	b := bytes.NewBuffer(make([]byte, len(hdr)+length)[:0])
+	b.Write(hdr)
 	b.Write(MAGIC_BEG)
 	b.Write(MAGIC_BEG)
-	binary.Write(b, binary.BigEndian, uint32(VERSION))
+	binary.Write(b, binary.BigEndian, uint32(o.version()))
 	binary.Write(b, binary.BigEndian, uint32(length))
 	b.Write(sJSON)
+	if o.version() >= VERSION_CRC {
+		binary.Write(b, binary.BigEndian,
+			crc32.Checksum(b.Bytes()[len(hdr)+2*len(MAGIC_BEG):], crcTable))
+	}
 	binary.Write(b, binary.BigEndian, int64(offset))
 	binary.Write(b, binary.BigEndian, uint32(length))
 	b.Write(MAGIC_END)
 	b.Write(MAGIC_END)
-	if _, err := o.file.WriteAt(b.Bytes()[:length], offset); err != nil {
+	if _, err := o.file().WriteAt(b.Bytes(), start); err != nil {
 		return err
 	}
 	atomic.StoreInt64(&o.size, offset+int64(length))
+	atomic.StorePointer(&o.lastCommit, unsafe.Pointer(ci))
 	return nil
 }
 
 func (o *Store) readRoots() error {
-	finfo, err := o.file.Stat()
+	finfo, err := o.file().Stat()
 	if err != nil {
 		return err
 	}
@@ -379,87 +765,229 @@ func (o *Store) readRoots() error {
 	if o.size <= 0 {
 		return nil
 	}
-	return o.readRootsScan(false)
+	ok, err := o.readHeader()
+	if err == nil && !ok {
+		err = o.readRootsScan(o.header)
+	}
+	if err != nil {
+		return err
+	}
+	return o.replayLog(finfo.Size())
 }
 
 func (o *Store) readRootsScan(defaultToEmpty bool) (err error) {
+	end := atomic.LoadInt64(&o.size)
+	for {
+		offset, data, err := o.scanRoots(end)
+		if err != nil {
+			return err
+		}
+		if offset < 0 {
+			if defaultToEmpty {
+				atomic.StoreInt64(&o.size, o.dataStart())
+				atomic.StorePointer(&o.lastCommit, nil)
+				o.setVersion(VERSION)
+				return nil
+			}
+			return errors.New("couldn't find roots; file corrupted or wrong?")
+		}
+		err = o.useRoots(offset, data)
+		if _, ok := err.(*ErrChecksum); ok {
+			// A torn or corrupted root record, so keep scanning.
+			end = offset + int64(len(data)+rootsEndLen) - 1
+			continue
+		}
+		return err
+	}
+}
+
+// Switches the Store to a root record.
+func (o *Store) useRoots(offset int64, data []byte) error {
+	m, ci, version, err := o.parseRoots(offset, data, true)
+	if err != nil {
+		return err
+	}
+	o.setVersion(version)
+	atomic.StoreInt64(&o.size, offset+int64(len(data)+rootsEndLen))
+	atomic.StorePointer(&o.lastCommit, unsafe.Pointer(ci))
+	atomic.StorePointer(&o.coll, unsafe.Pointer(&m))
+	return nil
+}
+
+// Sets the file format version of the current file generation.
+func (o *Store) setVersion(version uint32) {
+	files := *(*[]fileGen)(atomic.LoadPointer(&o.files))
+	if files[len(files)-1].version != version {
+		files = append([]fileGen(nil), files...)
+		files[len(files)-1].version = version
+		atomic.StorePointer(&o.files, unsafe.Pointer(&files))
+	}
+}
+
+// Scans backwards from the end position for the last good root
+// record, returning its offset and its bytes (without the trailing
+// rootsEnd bytes).  The returned offset is -1 if there's no root.
+func (o *Store) scanRoots(end int64) (offset int64, data []byte, err error) {
 	rootsEnd := make([]byte, rootsEndLen)
 	for {
 		for { // Scan backwards for MAGIC_END.
-			if atomic.LoadInt64(&o.size) <= rootsLen {
-				if defaultToEmpty {
-					atomic.StoreInt64(&o.size, 0)
-					return nil
-				}
-				return errors.New("couldn't find roots; file corrupted or wrong?")
+			if end <= rootsLen {
+				return -1, nil, nil
 			}
-			if _, err := o.file.ReadAt(rootsEnd,
-				atomic.LoadInt64(&o.size)-int64(len(rootsEnd))); err != nil {
-				return err
+			if _, err := o.file().ReadAt(rootsEnd,
+				end-int64(len(rootsEnd))); err != nil {
+				return -1, nil, err
 			}
 			if bytes.Equal(MAGIC_END, rootsEnd[8+4:8+4+len(MAGIC_END)]) &&
 				bytes.Equal(MAGIC_END, rootsEnd[8+4+len(MAGIC_END):]) {
 				break
 			}
-			atomic.AddInt64(&o.size, -1) // TODO: optimizations to scan backwards faster.
+			end-- // TODO: optimizations to scan backwards faster.
 		}
 		// Read and check the roots.
-		var offset int64
 		var length uint32
 		endBuf := bytes.NewBuffer(rootsEnd)
 		err = binary.Read(endBuf, binary.BigEndian, &offset)
 		if err != nil {
-			return err
+			return -1, nil, err
 		}
 		if err = binary.Read(endBuf, binary.BigEndian, &length); err != nil {
-			return err
+			return -1, nil, err
 		}
-		if offset >= 0 && offset < atomic.LoadInt64(&o.size)-int64(rootsLen) &&
-			length == uint32(atomic.LoadInt64(&o.size)-offset) {
-			data := make([]byte, atomic.LoadInt64(&o.size)-offset-int64(len(rootsEnd)))
-			if _, err := o.file.ReadAt(data, offset); err != nil {
-				return err
+		if offset >= 0 && offset < end-int64(rootsLen) &&
+			length == uint32(end-offset) {
+			data := make([]byte, end-offset-int64(len(rootsEnd)))
+			if _, err := o.file().ReadAt(data, offset); err != nil {
+				return -1, nil, err
 			}
 			if bytes.Equal(MAGIC_BEG, data[:len(MAGIC_BEG)]) &&
 				bytes.Equal(MAGIC_BEG, data[len(MAGIC_BEG):2*len(MAGIC_BEG)]) {
-				var version, length0 uint32
-				b := bytes.NewBuffer(data[2*len(MAGIC_BEG):])
-				if err = binary.Read(b, binary.BigEndian, &version); err != nil {
-					return err
-				}
-				if err = binary.Read(b, binary.BigEndian, &length0); err != nil {
-					return err
-				}
-				if version != VERSION {
-					return fmt.Errorf("version mismatch: "+
-						"current version: %v != found version: %v", VERSION, version)
-				}
-				if length0 != length {
-					return fmt.Errorf("length mismatch: "+
-						"wanted length: %v != found length: %v", length0, length)
-				}
-				m := make(map[string]*Collection)
-				if err = json.Unmarshal(data[2*len(MAGIC_BEG)+4+4:], &m); err != nil {
-					return err
-				}
-				for collName, t := range m {
-					t.name = collName
-					t.store = o
-					if o.callbacks.KeyCompareForCollection != nil {
-						t.compare = o.callbacks.KeyCompareForCollection(collName)
-					}
-					if t.compare == nil {
-						t.compare = bytes.Compare
-					}
-				}
-				atomic.StorePointer(&o.coll, unsafe.Pointer(&m))
-				return nil
+				return offset, data, nil
 			} // else, perhaps value was unlucky in having MAGIC_END's.
 		} // else, perhaps a gkvlite file was stored as a value.
-		atomic.AddInt64(&o.size, -1) // Roots were wrong, so keep scanning.
+		end-- // Roots were wrong, so keep scanning.
 	}
 }
 
+// Reads the root record that starts at the given offset, such as
+// from a CommitInfo.prev pointer.
+func (o *Store) readRootsAt(offset int64) (data []byte, err error) {
+	hdr := make([]byte, 2*len(MAGIC_BEG)+4+4)
+	if _, err = o.file().ReadAt(hdr, offset); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(MAGIC_BEG, hdr[:len(MAGIC_BEG)]) ||
+		!bytes.Equal(MAGIC_BEG, hdr[len(MAGIC_BEG):2*len(MAGIC_BEG)]) {
+		return nil, fmt.Errorf("missing roots MAGIC_BEG at offset: %v", offset)
+	}
+	length := binary.BigEndian.Uint32(hdr[2*len(MAGIC_BEG)+4:])
+	if int64(length) < rootsLen {
+		return nil, fmt.Errorf("unexpected roots length: %v at offset: %v",
+			length, offset)
+	}
+	data = make([]byte, length)
+	if _, err = o.file().ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+	rootsEnd := data[len(data)-rootsEndLen:]
+	if int64(binary.BigEndian.Uint64(rootsEnd[:8])) != offset ||
+		binary.BigEndian.Uint32(rootsEnd[8:8+4]) != length ||
+		!bytes.Equal(MAGIC_END, rootsEnd[8+4:8+4+len(MAGIC_END)]) ||
+		!bytes.Equal(MAGIC_END, rootsEnd[8+4+len(MAGIC_END):]) {
+		return nil, fmt.Errorf("bad roots end at offset: %v", offset)
+	}
+	return data[:len(data)-rootsEndLen], nil
+}
+
+// Parses root record bytes into collections, unless withColls is
+// false, such as when the caller only wants the CommitInfo.
+func (o *Store) parseRoots(offset int64, data []byte, withColls bool) (
+	m map[string]*Collection, ci *CommitInfo, version uint32, err error) {
+	var length0 uint32
+	b := bytes.NewBuffer(data[2*len(MAGIC_BEG):])
+	if err = binary.Read(b, binary.BigEndian, &version); err != nil {
+		return nil, nil, 0, err
+	}
+	if err = binary.Read(b, binary.BigEndian, &length0); err != nil {
+		return nil, nil, 0, err
+	}
+	if version < VERSION_MIN || version > VERSION {
+		return nil, nil, 0, fmt.Errorf("version mismatch: "+
+			"current version: %v != found version: %v", VERSION, version)
+	}
+	length := uint32(len(data) + rootsEndLen)
+	if length0 != length {
+		return nil, nil, 0, fmt.Errorf("length mismatch: "+
+			"wanted length: %v != found length: %v", length0, length)
+	}
+	if version >= VERSION_REC {
+		hdr := make([]byte, recHdrLength)
+		if offset < int64(recHdrLength) {
+			return nil, nil, 0, &ErrChecksum{Offset: offset, Kind: "roots"}
+		}
+		if _, err = o.file().ReadAt(hdr, offset-int64(recHdrLength)); err != nil {
+			return nil, nil, 0, err
+		}
+		recLength, err := readRecHdr(hdr, RecordRoots, offset, "roots")
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if recLength != uint32(recHdrLength)+length {
+			return nil, nil, 0, &ErrChecksum{Offset: offset, Kind: "roots"}
+		}
+	}
+	jsonEnd := len(data)
+	if version >= VERSION_CRC {
+		jsonEnd -= 4
+		if jsonEnd < 2*len(MAGIC_BEG)+4+4 ||
+			binary.BigEndian.Uint32(data[jsonEnd:]) !=
+				crc32.Checksum(data[2*len(MAGIC_BEG):jsonEnd], crcTable) {
+			return nil, nil, 0, &ErrChecksum{Offset: offset, Kind: "roots"}
+		}
+	}
+	sJSON := data[2*len(MAGIC_BEG)+4+4 : jsonEnd]
+	ci = &CommitInfo{Offset: offset, prev: -1}
+	m = make(map[string]*Collection)
+	if version < 5 {
+		if withColls {
+			err = json.Unmarshal(sJSON, &m)
+		}
+	} else {
+		r := rootsJSON{Colls: &json.RawMessage{}}
+		if withColls {
+			r.Colls = &m
+		}
+		err = json.Unmarshal(sJSON, &r)
+		ci.Seq, ci.Time, ci.Meta, ci.prev = r.Seq, r.Time, r.Meta, r.Prev
+		ci.fileID = r.File
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	for collName, t := range m {
+		t.name = collName
+		t.store = o
+		if loc := t.root.root.Loc(); loc != nil {
+			loc.gen = o.gen()
+		}
+		if o.callbacks.KeyCompareForCollection != nil {
+			t.compare = o.callbacks.KeyCompareForCollection(collName)
+		}
+		if t.compare == nil {
+			t.compare = bytes.Compare
+		}
+	}
+	return m, ci, version, nil
+}
+
+// Returns the file of a given generation.  The current generation's
+// file is the Store's file, and earlier generations are the files
+// from before any Compact(), which might still be read by snapshots
+// or by concurrent readers.
+func (o *Store) fileAt(gen uint32) *fileGen {
+	return &(*(*[]fileGen)(atomic.LoadPointer(&o.files)))[gen]
+}
+
 func (o *Store) ItemAlloc(c *Collection, keyLength uint16) *Item {
 	if o.callbacks.ItemAlloc != nil {
 		return o.callbacks.ItemAlloc(c, keyLength)
@@ -467,6 +995,19 @@ func (o *Store) ItemAlloc(c *Collection, keyLength uint16) *Item {
 	return &Item{Key: make([]byte, keyLength)}
 }
 
+// Like ItemAlloc(), but without an ItemAlloc callback, an Item.Key
+// that's at offset in a Slicer file is used in place, in which case
+// the returned bool is true.
+func (o *Store) itemAllocAt(c *Collection, keyLength uint16,
+	file StoreFile, offset int64) (*Item, bool) {
+	if sl, ok := file.(Slicer); ok && o.callbacks.ItemAlloc == nil {
+		if key := sl.Slice(offset, int(keyLength)); key != nil {
+			return &Item{Key: key}, true
+		}
+	}
+	return o.ItemAlloc(c, keyLength), false
+}
+
 func (o *Store) ItemAddRef(c *Collection, i *Item) {
 	if o.callbacks.ItemAddRef != nil {
 		o.callbacks.ItemAddRef(c, i)
@@ -484,6 +1025,11 @@ func (o *Store) ItemValRead(c *Collection, i *Item,
 	if o.callbacks.ItemValRead != nil {
 		return o.callbacks.ItemValRead(c, i, r, offset, valLength)
 	}
+	if sl, ok := r.(Slicer); ok {
+		if i.Val = sl.Slice(offset, int(valLength)); i.Val != nil {
+			return nil
+		}
+	}
 	i.Val = make([]byte, valLength)
 	_, err := r.ReadAt(i.Val, offset)
 	return err
@@ -496,3 +1042,26 @@ func (o *Store) ItemValWrite(c *Collection, i *Item, w io.WriterAt, offset int64
 	_, err := w.WriteAt(i.Val, offset)
 	return err
 }
+
+// Same as ItemValWrite(), but also returns the checksum of the value
+// bytes that were written, which are read back from the file if the
+// ItemValWrite callback didn't write them sequentially.
+func (o *Store) itemValWriteCRC(c *Collection, i *Item, w io.WriterAt,
+	r io.ReaderAt, offset int64, valLength int) (uint32, error) {
+	if o.callbacks.ItemValWrite == nil {
+		_, err := w.WriteAt(i.Val, offset)
+		return crc32.Checksum(i.Val, crcTable), err
+	}
+	cw := &crcWriterAt{w: w, next: offset, sequential: true}
+	if err := o.callbacks.ItemValWrite(c, i, cw, offset); err != nil {
+		return 0, err
+	}
+	if cw.sequential && cw.next == offset+int64(valLength) {
+		return cw.crc, nil
+	}
+	b := make([]byte, valLength)
+	if _, err := r.ReadAt(b, offset); err != nil {
+		return 0, err
+	}
+	return crc32.Checksum(b, crcTable), nil
+}
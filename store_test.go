@@ -12,6 +12,7 @@ import (
 	"strconv"
 	"sync/atomic"
 	"testing"
+	"time"
 	"unsafe"
 )
 
@@ -848,8 +849,8 @@ func TestStoreFile(t *testing.T) {
 		visitExpectCollection(t, cx, "a", ccTest.expect, nil)
 		if ccTest.fevery > 100 {
 			// Expect file to be more compact when there's less flushing.
-			finfoSrc, _ := ccTest.src.file.Stat()
-			finfoCpy, _ := cc.file.Stat()
+			finfoSrc, _ := ccTest.src.file().Stat()
+			finfoCpy, _ := cc.file().Stat()
 			if finfoSrc.Size() < finfoCpy.Size() {
 				t.Error("%v: expected copy to be smaller / compacted"+
 					"src size: %v, cpy size: %v", ccTestIdx,
@@ -878,8 +879,8 @@ func TestStoreFile(t *testing.T) {
 		visitExpectCollection(t, cx, "a", ccTest.expect, nil)
 		if ccTest.fevery > 100 {
 			// Expect file to be more compact when there's less flushing.
-			finfoSrc, _ := ccTest.src.file.Stat()
-			finfoCpy, _ := cc.file.Stat()
+			finfoSrc, _ := ccTest.src.file().Stat()
+			finfoCpy, _ := cc.file().Stat()
 			if finfoSrc.Size() < finfoCpy.Size() {
 				t.Errorf("%v: expected copy to be smaller / compacted"+
 					"src size: %v, cpy size: %v", ccTestIdx,
@@ -1389,8 +1390,6 @@ func TestJoinWithFileErrors(t *testing.T) {
 }
 
 func TestStoreStats(t *testing.T) {
-	freeNodes = nil
-
 	m := map[string]uint64{}
 	n := map[string]uint64{}
 
@@ -1642,14 +1641,14 @@ func TestCurFreeNodes(t *testing.T) {
 	}
 	x := s.SetCollection("x", bytes.Compare)
 	n := x.mkNode(empty_itemLoc, empty_nodeLoc, empty_nodeLoc, 0, 0)
-	f := allocStats
+	f := s.AllocStats()
 	x.freeNode_unlocked(n, nil)
-	if f.FreeNodes+1 != allocStats.FreeNodes {
+	if f.FreeNodes+1 != s.AllocStats().FreeNodes {
 		t.Errorf("expected freeNodes to increment")
 	}
-	if f.CurFreeNodes+1 != allocStats.CurFreeNodes {
+	if f.CurFreeNodes+1 != s.AllocStats().CurFreeNodes {
 		t.Errorf("expected CurFreeNodes + 1 == allocStats.CurrFreeNodes, got: %v, %v",
-			f.CurFreeNodes+1, allocStats.CurFreeNodes)
+			f.CurFreeNodes+1, s.AllocStats().CurFreeNodes)
 	}
 }
 
@@ -2110,14 +2109,14 @@ func TestDoubleFreeNode(t *testing.T) {
 			t.Errorf("expected c to be 2")
 		}
 	}()
-	withAllocLocks(func() {
-		x.freeNode_unlocked(nil, nil)
-		c++
-		x.freeNode_unlocked(n, nil)
-		c++
-		x.freeNode_unlocked(n, nil)
-		c++
-	})
+	s.alloc.freeNodeLock.Lock()
+	defer s.alloc.freeNodeLock.Unlock()
+	x.freeNode_unlocked(nil, nil)
+	c++
+	x.freeNode_unlocked(n, nil)
+	c++
+	x.freeNode_unlocked(n, nil)
+	c++
 }
 
 func TestDoubleFreeNodeLoc(t *testing.T) {
@@ -2345,13 +2344,13 @@ func TestNodeLocWriteErr(t *testing.T) {
 	rnl := x.rootAddRef()
 
 	writeShouldErr = true
-	if rnl.root.write(s) == nil {
+	if rnl.root.write(s, s.recWriter()) == nil {
 		t.Errorf("expected write node to fail")
 	}
 	writeShouldErr = false
 
 	rnl.root.node = unsafe.Pointer(nil) // Force a nil node.
-	if rnl.root.write(s) != nil {
+	if rnl.root.write(s, s.recWriter()) != nil {
 		t.Errorf("expected write node on nil node to work")
 	}
 }
@@ -2882,3 +2881,152 @@ func BenchmarkRandGet(b *testing.B) {
 		}
 	}
 }
+
+func TestFlushWithMeta(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer os.Remove(fname)
+	s, _ := NewStore(f)
+	if s.LastCommitInfo() != nil {
+		t.Errorf("expected no commit info on empty store")
+	}
+	x := s.SetCollection("x", nil)
+	for i, writer := range []string{"a", "b", "c"} {
+		x.Set([]byte(writer), []byte(writer))
+		if err := s.FlushWithMeta(map[string]string{"writer": writer}); err != nil {
+			t.Errorf("expected FlushWithMeta to work, err: %v", err)
+		}
+		ci := s.LastCommitInfo()
+		if ci == nil || ci.Seq != uint64(i) || ci.Meta["writer"] != writer ||
+			ci.Time.IsZero() {
+			t.Errorf("unexpected commit info: %#v", ci)
+		}
+	}
+	x.Set([]byte("d"), []byte("d"))
+	s.Flush()
+	f.Close()
+
+	f, _ = os.OpenFile(fname, os.O_RDWR, 0666)
+	s, err := NewStore(f)
+	if err != nil {
+		t.Errorf("expected reopen to work, err: %v", err)
+	}
+	ci := s.LastCommitInfo()
+	if ci == nil || ci.Seq != 3 || ci.Meta != nil {
+		t.Errorf("unexpected commit info after reopen: %#v", ci)
+	}
+	var writers []string
+	err = s.VisitCommits(func(ci *CommitInfo) bool {
+		writers = append(writers, ci.Meta["writer"])
+		return true
+	})
+	if err != nil {
+		t.Errorf("expected VisitCommits to work, err: %v", err)
+	}
+	if fmt.Sprintf("%v", writers) != "[ c b a]" {
+		t.Errorf("unexpected commits: %#v", writers)
+	}
+	numVisits := 0
+	s.VisitCommits(func(ci *CommitInfo) bool {
+		numVisits++
+		return false
+	})
+	if numVisits != 1 {
+		t.Errorf("expected VisitCommits to stop early, got: %v", numVisits)
+	}
+	if err = s.FlushRevert(); err != nil {
+		t.Errorf("expected FlushRevert to work, err: %v", err)
+	}
+	ci = s.LastCommitInfo()
+	if ci == nil || ci.Seq != 2 || ci.Meta["writer"] != "c" {
+		t.Errorf("unexpected commit info after FlushRevert: %#v", ci)
+	}
+	x = s.GetCollection("x")
+	x.Set([]byte("e"), []byte("e"))
+	s.Flush()
+	if ci = s.LastCommitInfo(); ci == nil || ci.Seq != 3 {
+		t.Errorf("unexpected commit info after revert and flush: %#v", ci)
+	}
+}
+
+func TestFlushWithMetaVersion4(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer os.Remove(fname)
+	s, _ := NewStore(f)
+	s.setVersion(4)
+	x := s.SetCollection("x", nil)
+	x.Set([]byte("a"), []byte("a"))
+	s.Flush()
+	x.Set([]byte("b"), []byte("b"))
+	s.Flush()
+	f.Close()
+
+	f, _ = os.OpenFile(fname, os.O_RDWR, 0666)
+	s, err := NewStore(f)
+	if err != nil || s.version() != 4 {
+		t.Errorf("expected version 4 reopen to work, err: %v", err)
+	}
+	if err = s.FlushWithMeta(map[string]string{"a": "b"}); err == nil {
+		t.Errorf("expected FlushWithMeta on version 4 to fail")
+	}
+	var offsets []int64
+	s.VisitCommits(func(ci *CommitInfo) bool {
+		offsets = append(offsets, ci.Offset)
+		return true
+	})
+	if len(offsets) != 2 || offsets[0] <= offsets[1] {
+		t.Errorf("unexpected version 4 commits: %#v", offsets)
+	}
+	v, err := s.GetCollection("x").Get([]byte("b"))
+	if err != nil || string(v) != "b" {
+		t.Errorf("expected version 4 read to work, err: %v", err)
+	}
+}
+
+func TestSnapshotAsOf(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer os.Remove(fname)
+	s, _ := NewStore(f)
+	if _, err := s.SnapshotAsOf(time.Now()); err != nil {
+		t.Errorf("expected SnapshotAsOf on empty store to work, err: %v", err)
+	}
+	x := s.SetCollection("x", nil)
+	var times []time.Time
+	for _, k := range []string{"a", "b", "c"} {
+		x.Set([]byte(k), []byte(k))
+		s.Flush()
+		times = append(times, s.LastCommitInfo().Time)
+		time.Sleep(2 * time.Millisecond)
+	}
+	x.Set([]byte("d"), []byte("d")) // Unflushed, so never seen.
+
+	ss, err := s.SnapshotAsOf(times[0].Add(-time.Millisecond))
+	if err != nil || ss != nil {
+		t.Errorf("expected no snapshot before first commit, err: %v", err)
+	}
+	for i, tm := range times {
+		ss, err = s.SnapshotAsOf(tm.Add(time.Millisecond))
+		if err != nil || ss == nil {
+			t.Fatalf("expected SnapshotAsOf to work, err: %v", err)
+		}
+		if ss.LastCommitInfo().Seq != uint64(i) {
+			t.Errorf("expected seq: %v, got: %#v", i, ss.LastCommitInfo())
+		}
+		numItems, _, err := ss.GetCollection("x").GetTotals()
+		if err != nil || numItems != uint64(i+1) {
+			t.Errorf("expected %v items, got: %v, err: %v", i+1, numItems, err)
+		}
+		if err = ss.GetCollection("x").Set([]byte("z"), []byte("z")); err == nil {
+			t.Errorf("expected SnapshotAsOf store to be read only")
+		}
+	}
+	mem, _ := NewStore(nil)
+	if _, err = mem.SnapshotAsOf(time.Now()); err == nil {
+		t.Errorf("expected SnapshotAsOf on memory-only store to fail")
+	}
+}
@@ -0,0 +1,217 @@
+package gkvlite
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+// A StoreFile that loses unsynced writes on a crash(), like an OS
+// page cache, where any subset of the unsynced writes might have
+// reached the disk.
+type faultFile struct {
+	cache      []byte // What reads see.
+	durable    []byte // What survives a crash().
+	pending    []faultWrite
+	writesLeft int // When >= 0, writes and syncs fail after this many writes.
+	numSync    int
+}
+
+type faultWrite struct {
+	p   []byte
+	off int64
+}
+
+var errFault = errors.New("injected fault")
+
+func newFaultFile(durable []byte) *faultFile {
+	return &faultFile{
+		cache:      append([]byte(nil), durable...),
+		durable:    durable,
+		writesLeft: -1,
+	}
+}
+
+func writeBytes(b []byte, p []byte, off int64) []byte {
+	if end := int(off) + len(p); end > len(b) {
+		b = append(b, make([]byte, end-len(b))...)
+	}
+	copy(b[off:], p)
+	return b
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= int64(len(f.cache)) {
+		return 0, errors.New("EOF")
+	}
+	n = copy(p, f.cache[off:])
+	if n < len(p) {
+		return n, errors.New("EOF")
+	}
+	return n, nil
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (n int, err error) {
+	if f.writesLeft == 0 {
+		return 0, errFault
+	}
+	if f.writesLeft > 0 {
+		f.writesLeft--
+	}
+	f.cache = writeBytes(f.cache, p, off)
+	f.pending = append(f.pending,
+		faultWrite{p: append([]byte(nil), p...), off: off})
+	return len(p), nil
+}
+
+func (f *faultFile) Sync() error {
+	if f.writesLeft == 0 {
+		return errFault
+	}
+	f.numSync++
+	f.durable = append([]byte(nil), f.cache...)
+	f.pending = nil
+	return nil
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	return faultFileInfo(len(f.cache)), nil
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	f.cache = f.cache[:size]
+	return f.Sync()
+}
+
+// Returns the durable bytes plus some random subset of the pending
+// writes, where a write might also be torn.
+func (f *faultFile) crash(r *rand.Rand) *faultFile {
+	b := append([]byte(nil), f.durable...)
+	for _, w := range f.pending {
+		switch r.Intn(3) {
+		case 0:
+			b = writeBytes(b, w.p, w.off)
+		case 1:
+			b = writeBytes(b, w.p[:r.Intn(len(w.p)+1)], w.off)
+		}
+	}
+	return newFaultFile(b)
+}
+
+type faultFileInfo int64
+
+func (fi faultFileInfo) Name() string       { return "faultFile" }
+func (fi faultFileInfo) Size() int64        { return int64(fi) }
+func (fi faultFileInfo) Mode() os.FileMode  { return 0666 }
+func (fi faultFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi faultFileInfo) IsDir() bool        { return false }
+func (fi faultFileInfo) Sys() interface{}   { return nil }
+
+func TestFlushSync(t *testing.T) {
+	f := newFaultFile(nil)
+	s, _ := NewStore(f)
+	s.SetCollection("x", nil).Set([]byte("a"), []byte("a"))
+	if err := s.FlushEx(FlushOptions{Sync: true}); err != nil || f.numSync != 2 {
+		t.Errorf("expected FlushEx to sync twice, numSync: %v, err: %v",
+			f.numSync, err)
+	}
+	if len(f.pending) != 0 {
+		t.Errorf("expected no pending writes after FlushEx with Sync")
+	}
+
+	f = newFaultFile(nil)
+	s, _ = NewStoreWithHeader(f, StoreCallbacks{})
+	s.SetCollection("x", nil).Set([]byte("a"), []byte("a"))
+	if err := s.FlushEx(FlushOptions{Sync: true}); err != nil || f.numSync != 4 {
+		t.Errorf("expected FlushEx with header to sync three more times,"+
+			" numSync: %v, err: %v", f.numSync, err)
+	}
+
+	m := &mockfile{stat: func() (os.FileInfo, error) { return faultFileInfo(0), nil }}
+	s, _ = NewStore(m)
+	if err := s.FlushEx(FlushOptions{Sync: true}); err == nil {
+		t.Errorf("expected FlushEx Sync of a non-Syncer to fail")
+	}
+}
+
+// Without Sync, a crash can leave a root record pointing at
+// unwritten nodes and items.
+func TestFlushNoSyncCrash(t *testing.T) {
+	f := newFaultFile(nil)
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 10; i++ {
+		x.Set([]byte(fmt.Sprintf("%d", i)), []byte("v"))
+	}
+	s.Flush()
+	f.pending = f.pending[len(f.pending)-1:] // Only the root record lands.
+	s, err := NewStore(f.crash(rand.New(rand.NewSource(0))).withAllPending())
+	if err != nil {
+		t.Fatalf("expected the root record to be found, err: %v", err)
+	}
+	if r, _ := s.Verify(VerifyOptions{}); r.OK() {
+		t.Errorf("expected problems with a root record but no data")
+	}
+}
+
+// Applies all pending writes to the durable bytes, for tests.
+func (f *faultFile) withAllPending() *faultFile {
+	f.Sync()
+	return f
+}
+
+func TestFlushSyncCrash(t *testing.T) {
+	r := rand.New(rand.NewSource(1234))
+	for _, header := range []bool{false, true} {
+		for writesLeft := 0; writesLeft < 80; writesLeft++ {
+			f := newFaultFile(nil)
+			var s *Store
+			if header {
+				s, _ = NewStoreWithHeader(f, StoreCallbacks{})
+			} else {
+				s, _ = NewStore(f)
+			}
+			x := s.SetCollection("x", nil)
+			committed := 0
+			f.writesLeft = writesLeft
+			for j := 0; j < 10; j++ {
+				for i := 0; i < 5; i++ {
+					x.Set([]byte(fmt.Sprintf("%d-%d", j, i)), []byte(fmt.Sprintf("%d", j)))
+				}
+				if err := s.FlushEx(FlushOptions{Sync: true}); err != nil {
+					break
+				}
+				committed++
+			}
+			crashed := f.crash(r)
+			s, err := NewStore(crashed)
+			if err != nil && committed == 0 && !header {
+				continue // Only garbage, without any root record.
+			}
+			if err != nil {
+				t.Fatalf("expected reopen after crash to work, header: %v,"+
+					" writesLeft: %v, err: %v", header, writesLeft, err)
+			}
+			rep, err := s.Verify(VerifyOptions{Values: true})
+			if err != nil || !rep.OK() {
+				t.Errorf("expected no problems after crash, header: %v,"+
+					" writesLeft: %v, got: %v, err: %v",
+					header, writesLeft, rep.Problems, err)
+			}
+			for j := 0; j < committed; j++ {
+				for i := 0; i < 5; i++ {
+					k := fmt.Sprintf("%d-%d", j, i)
+					v, err := s.GetCollection("x").Get([]byte(k))
+					if err != nil || string(v) != fmt.Sprintf("%d", j) {
+						t.Errorf("expected committed %s after crash, header: %v,"+
+							" writesLeft: %v, got: %s, err: %v",
+							k, header, writesLeft, v, err)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package gkvlite
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync/atomic"
+	"unsafe"
+)
+
+// A ValueLog keeps the item values of Stores in a separate, append-only
+// StoreFile, so item records in a Store's file hold just a reference
+// of the value's offset and length.  Treap traversals and scans
+// without values then touch only the Store's file, and a Compact()
+// copies the references instead of the values.  Use Callbacks() when
+// opening the Store, every time.  A ValueLog only grows; to garbage
+// collect it, copy the live items, such as with VisitItemsAscend() and
+// SetItem(), into a new Store that uses a new ValueLog.
+type ValueLog struct {
+	size int64 // Atomic protected; next write position.
+	file StoreFile
+}
+
+// The length of a reference to a value in a ValueLog, which is the
+// value length of items in the Store's file.
+const valueRefLength = 8 + 4
+
+// A value in a ValueLog, remembered in Item.Transient when an item is
+// read or written, so the value isn't written again.
+type valueRef struct {
+	v      *ValueLog
+	offset int64 // Of the value's record.
+	length uint32
+	val    *byte // The Item.Val that was read or written.
+}
+
+// Returns true if the ref is for the item's current value, as an
+// Item.Copy() with a different Val also copies the Transient field.
+func (ref *valueRef) matches(v *ValueLog, i *Item) bool {
+	if ref == nil || ref.v != v || uint32(len(i.Val)) != ref.length {
+		return false
+	}
+	return len(i.Val) == 0 || ref.val == &i.Val[0]
+}
+
+func newValueRef(v *ValueLog, offset int64, val []byte) *valueRef {
+	ref := &valueRef{v: v, offset: offset, length: uint32(len(val))}
+	if len(val) > 0 {
+		ref.val = &val[0]
+	}
+	return ref
+}
+
+// Value records are [recHdr][value][crc4 of the value].
+const valueRecOverhead = recHdrLength + 4
+
+func NewValueLog(file StoreFile) (*ValueLog, error) {
+	finfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &ValueLog{size: finfo.Size(), file: file}, nil
+}
+
+// Returns the callbacks with the ItemValLength, ItemValWrite,
+// ItemValRead and ItemValSync callbacks replaced by the ValueLog's.
+// The ValueLog uses Item.Transient, so apps shouldn't use it on the
+// Store's items.
+func (v *ValueLog) Callbacks(callbacks StoreCallbacks) StoreCallbacks {
+	callbacks.ItemValLength = v.itemValLength
+	callbacks.ItemValWrite = v.itemValWrite
+	callbacks.ItemValRead = v.itemValRead
+	callbacks.ItemValSync = v.sync
+	return callbacks
+}
+
+// Returns the number of bytes in the ValueLog's file.
+func (v *ValueLog) Size() int64 {
+	return atomic.LoadInt64(&v.size)
+}
+
+func (v *ValueLog) itemValLength(c *Collection, i *Item) int {
+	return valueRefLength
+}
+
+func (v *ValueLog) itemValWrite(c *Collection, i *Item,
+	w io.WriterAt, offset int64) error {
+	ref := (*valueRef)(atomic.LoadPointer(&i.Transient))
+	if !ref.matches(v, i) {
+		if i.Val == nil {
+			return errors.New("ValueLog item without a value")
+		}
+		n := valueRecOverhead + len(i.Val)
+		b := make([]byte, n)
+		pos := putRecHdr(b, RecordValue, uint32(n))
+		pos += copy(b[pos:], i.Val)
+		binary.BigEndian.PutUint32(b[pos:pos+4], crc32.Checksum(i.Val, crcTable))
+		recOffset := atomic.AddInt64(&v.size, int64(n)) - int64(n)
+		if _, err := v.file.WriteAt(b, recOffset); err != nil {
+			return err
+		}
+		ref = newValueRef(v, recOffset, i.Val)
+		// An app's own Transient data is left alone.
+		atomic.CompareAndSwapPointer(&i.Transient, nil, unsafe.Pointer(ref))
+	}
+	b := make([]byte, valueRefLength)
+	binary.BigEndian.PutUint64(b[0:8], uint64(ref.offset))
+	binary.BigEndian.PutUint32(b[8:12], ref.length)
+	_, err := w.WriteAt(b, offset)
+	return err
+}
+
+func (v *ValueLog) itemValRead(c *Collection, i *Item,
+	r io.ReaderAt, offset int64, valLength uint32) error {
+	if valLength != valueRefLength {
+		return fmt.Errorf("unexpected ValueLog reference length: %v", valLength)
+	}
+	b := make([]byte, valueRefLength)
+	if _, err := r.ReadAt(b, offset); err != nil {
+		return err
+	}
+	recOffset := int64(binary.BigEndian.Uint64(b[0:8]))
+	rec := make([]byte, valueRecOverhead+int(binary.BigEndian.Uint32(b[8:12])))
+	if _, err := v.file.ReadAt(rec, recOffset); err != nil {
+		return err
+	}
+	n, err := readRecHdr(rec, RecordValue, recOffset, "value")
+	if err != nil {
+		return err
+	}
+	val := rec[recHdrLength : len(rec)-4]
+	if n != uint32(len(rec)) ||
+		binary.BigEndian.Uint32(rec[len(rec)-4:]) != crc32.Checksum(val, crcTable) {
+		return &ErrChecksum{Offset: recOffset, Kind: "value"}
+	}
+	i.Val = val
+	atomic.CompareAndSwapPointer(&i.Transient, nil,
+		unsafe.Pointer(newValueRef(v, recOffset, val)))
+	return nil
+}
+
+func (v *ValueLog) sync() error {
+	syncer, ok := v.file.(Syncer)
+	if !ok {
+		return errors.New("ValueLog file is not a Syncer, so cannot Sync")
+	}
+	return syncer.Sync()
+}
@@ -0,0 +1,134 @@
+package gkvlite
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func valueLogStore(t *testing.T, f StoreFile, v *ValueLog) *Store {
+	s, err := NewStoreEx(f, v.Callbacks(StoreCallbacks{}))
+	if err != nil {
+		t.Fatalf("expected NewStoreEx with a ValueLog to work, err: %v", err)
+	}
+	return s
+}
+
+func TestValueLog(t *testing.T) {
+	fname, vname := "tmp.test", "tmp.vlog"
+	for _, name := range []string{fname, vname, fname + ".compact"} {
+		os.Remove(name)
+		defer os.Remove(name)
+	}
+	f, _ := os.Create(fname)
+	defer f.Close()
+	vf, _ := os.Create(vname)
+	defer vf.Close()
+	mv := &mockfile{f: vf}
+	v, _ := NewValueLog(mv)
+	s := valueLogStore(t, f, v)
+	x := s.SetCollection("x", nil)
+	val := bytes.Repeat([]byte("v"), 10000)
+	for i := 0; i < 20; i++ {
+		x.Set([]byte(fmt.Sprintf("%02d", i)), append([]byte(fmt.Sprintf("%d", i)), val...))
+	}
+	x.Set([]byte("empty"), []byte{})
+	if err := s.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, err: %v", err)
+	}
+	if s.size >= int64(len(val)) || v.Size() < 20*int64(len(val)) {
+		t.Errorf("expected the values in the ValueLog, sizes: %v, %v", s.size, v.Size())
+	}
+
+	f2, _ := os.Open(fname)
+	defer f2.Close()
+	s2 := valueLogStore(t, f2, v)
+	x2 := s2.GetCollection("x")
+	mv.numReadAt = 0
+	n := 0
+	x2.VisitItemsAscend(nil, false, func(i *Item) bool {
+		n++
+		return true
+	})
+	if n != 21 || mv.numReadAt != 0 {
+		t.Errorf("expected a keys-only scan not to read the ValueLog, n: %v,"+
+			" reads: %v", n, mv.numReadAt)
+	}
+	for i := 0; i < 20; i++ {
+		got, err := x2.Get([]byte(fmt.Sprintf("%02d", i)))
+		if err != nil || !bytes.Equal(got, append([]byte(fmt.Sprintf("%d", i)), val...)) {
+			t.Errorf("expected value %d from the ValueLog, err: %v", i, err)
+		}
+	}
+	if got, err := x2.Get([]byte("empty")); err != nil || got == nil || len(got) != 0 {
+		t.Errorf("expected an empty value, got: %v, err: %v", got, err)
+	}
+	if rep, err := s2.Verify(VerifyOptions{Values: true}); err != nil || !rep.OK() {
+		t.Errorf("expected Verify to work, problems: %v, err: %v", rep.Problems, err)
+	}
+
+	// A changed copy of an item that was read gets its own value.
+	i, _ := x2.GetItem([]byte("00"), true)
+	i = i.Copy()
+	i.Val = []byte("changed")
+	x2.SetItem(i)
+
+	// Compaction copies the references, not the values.
+	size := v.Size()
+	dst, _ := os.Create(fname + ".compact")
+	defer dst.Close()
+	if err := s2.Compact(dst); err != nil {
+		t.Fatalf("expected Compact to work, err: %v", err)
+	}
+	if v.Size() != size+int64(valueRecOverhead+len("changed")) {
+		t.Errorf("expected Compact to write only the changed value, size: %v, was: %v",
+			v.Size(), size)
+	}
+	s3 := valueLogStore(t, dst, v)
+	if got, _ := s3.GetCollection("x").Get([]byte("00")); string(got) != "changed" {
+		t.Errorf("expected the changed value after Compact, got: %q", got)
+	}
+
+	// Garbage collecting by copying into a new ValueLog.
+	gf, _ := NewValueLog(newFaultFile(nil))
+	gs := valueLogStore(t, newFaultFile(nil), gf)
+	gx := gs.SetCollection("x", nil)
+	s3.GetCollection("x").VisitItemsAscend(nil, true, func(i *Item) bool {
+		gx.SetItem(i)
+		return true
+	})
+	if err := gs.Flush(); err != nil {
+		t.Fatalf("expected Flush to the new ValueLog to work, err: %v", err)
+	}
+	if gf.Size() >= v.Size() || gf.Size() < 19*int64(len(val)) {
+		t.Errorf("expected only live values in the new ValueLog, size: %v", gf.Size())
+	}
+}
+
+func TestValueLogErrors(t *testing.T) {
+	vf := newFaultFile(nil)
+	v, _ := NewValueLog(vf)
+	f := newFaultFile(nil)
+	s := valueLogStore(t, f, v)
+	s.SetCollection("x", nil).Set([]byte("a"), []byte("hello"))
+	if err := s.FlushEx(FlushOptions{Sync: true}); err != nil {
+		t.Fatalf("expected FlushEx with Sync to work, err: %v", err)
+	}
+	if vf.numSync != 1 {
+		t.Errorf("expected the ValueLog to be synced, numSync: %v", vf.numSync)
+	}
+	vf.cache[recHdrLength+1] ^= 0xff
+	s2 := valueLogStore(t, f, v)
+	_, err := s2.GetCollection("x").Get([]byte("a"))
+	expectErrChecksum(t, err, 0, "value")
+
+	mv, _ := NewValueLog(&mockfile{stat: func() (os.FileInfo, error) {
+		return faultFileInfo(0), nil
+	}, writeat: func(p []byte, off int64) (int, error) { return len(p), nil }})
+	s = valueLogStore(t, newFaultFile(nil), mv)
+	s.SetCollection("x", nil).Set([]byte("a"), []byte("A"))
+	if err := s.FlushEx(FlushOptions{Sync: true}); err == nil {
+		t.Errorf("expected FlushEx with Sync and a non-Syncer ValueLog to fail")
+	}
+}
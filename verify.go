@@ -0,0 +1,242 @@
+package gkvlite
+
+import (
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Configures Store.Verify().
+type VerifyOptions struct {
+	Collections []string // Collections to verify, or all when empty.
+	Values      bool     // Also read the item values, checking checksums.
+	MaxProblems int      // Stop after this many problems, when > 0.
+
+	// Also check the treap heap property on item priorities.  An item
+	// that replaces another item of the same key takes over its place
+	// in the treap, so the heap property only holds when apps keep the
+	// same Priority for a key, such as a priority from a key hash.
+	Priorities bool
+}
+
+// A violated invariant found by Store.Verify().
+type VerifyProblem struct {
+	Collection string // Empty for problems with the root record.
+	Offset     int64  // File offset of the record, or -1 if not persisted.
+	Key        []byte // Key of the item, when known.
+	Msg        string
+}
+
+func (p VerifyProblem) String() string {
+	return fmt.Sprintf("collection: %q, offset: %v, key: %q, %s",
+		p.Collection, p.Offset, p.Key, p.Msg)
+}
+
+// The result of Store.Verify().
+type VerifyReport struct {
+	NumCollections int
+	NumNodes       uint64 // Nodes that were read, over all collections.
+	Problems       []VerifyProblem
+}
+
+// Returns true when no problems were found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Checks the invariants of the Store's collections, like an fsck: key
+// order under each collection's KeyCompare, optionally the treap heap
+// property on item priorities, numNodes and numBytes against the
+// actual subtrees, plocs within file bounds and readable item headers.  Every problem
+// is reported instead of stopping at the first.  Nodes and items are
+// read into temporary copies, so a Verify() of a large file doesn't
+// fill the Store's memory.  The returned error is only for failures
+// that stop the verification itself.
+func (s *Store) Verify(opts VerifyOptions) (*VerifyReport, error) {
+	v := &verifier{s: s, opts: opts, report: &VerifyReport{},
+		sizes: map[uint32]int64{}}
+	if ci := s.LastCommitInfo(); ci != nil && s.file() != nil {
+		data, err := s.readRootsAt(ci.Offset)
+		if err == nil {
+			_, _, _, err = s.parseRoots(ci.Offset, data, false)
+		}
+		if err != nil {
+			v.problem(ci.Offset, nil, "unreadable roots: %v", err)
+		}
+	}
+	names := opts.Collections
+	if len(names) == 0 {
+		names = s.GetCollectionNames()
+	}
+	for _, name := range names {
+		v.name = name
+		v.t = s.GetCollection(name)
+		if v.t == nil {
+			v.problem(-1, nil, "missing collection")
+			continue
+		}
+		v.report.NumCollections++
+		rnl := v.t.rootAddRef()
+		_, _, _, err := v.visit(rnl.root, nil, nil, -1)
+		v.t.rootDecRef(rnl)
+		if err != nil {
+			return v.report, err
+		}
+	}
+	return v.report, nil
+}
+
+type verifier struct {
+	s      *Store
+	t      *Collection
+	name   string
+	opts   VerifyOptions
+	report *VerifyReport
+	sizes  map[uint32]int64 // Keyed by gen, for files before a Compact().
+}
+
+func (v *verifier) full() bool {
+	return v.opts.MaxProblems > 0 && len(v.report.Problems) >= v.opts.MaxProblems
+}
+
+func (v *verifier) problem(offset int64, key []byte,
+	format string, args ...interface{}) {
+	if !v.full() {
+		v.report.Problems = append(v.report.Problems, VerifyProblem{
+			Collection: v.name,
+			Offset:     offset,
+			Key:        append([]byte(nil), key...),
+			Msg:        fmt.Sprintf(format, args...),
+		})
+	}
+}
+
+// Returns the size of the file of a generation.
+func (v *verifier) fileSize(gen uint32) (int64, error) {
+	if gen == v.s.gen() {
+		return atomic.LoadInt64(&v.s.size), nil
+	}
+	size, ok := v.sizes[gen]
+	if !ok {
+		finfo, err := v.s.fileAt(gen).file.Stat()
+		if err != nil {
+			return 0, err
+		}
+		size = finfo.Size()
+		v.sizes[gen] = size
+	}
+	return size, nil
+}
+
+// Returns true if a ploc is within its file, adding a problem if not.
+func (v *verifier) inBounds(loc *ploc, key []byte, kind string) (bool, error) {
+	size, err := v.fileSize(loc.gen)
+	if err != nil {
+		return false, err
+	}
+	if loc.Offset < 0 || loc.Length == 0 ||
+		loc.Offset+int64(loc.Length) > size {
+		v.problem(loc.Offset, key, "%s ploc length: %v beyond file size: %v",
+			kind, loc.Length, size)
+		return false, nil
+	}
+	return true, nil
+}
+
+// Verifies the subtree at nloc, whose keys must be between lo and hi
+// (exclusive, when non-nil) and whose priorities must be at most
+// maxPriority (when >= 0).  Returns the subtree's actual numNodes and
+// numBytes, where complete is false if some of the subtree couldn't
+// be read, so the counts are undercounts.
+func (v *verifier) visit(nloc *nodeLoc, lo, hi []byte, maxPriority int32) (
+	numNodes, numBytes uint64, complete bool, err error) {
+	if nloc.isEmpty() {
+		return 0, 0, true, nil
+	}
+	if v.full() {
+		return 0, 0, false, nil
+	}
+	offset := int64(-1)
+	if loc := nloc.Loc(); !loc.isEmpty() {
+		offset = loc.Offset
+		ok, err := v.inBounds(loc, nil, "node")
+		if !ok || err != nil {
+			return 0, 0, false, err
+		}
+	}
+	n, err := (&nodeLoc{}).Copy(nloc).read(v.s)
+	if err != nil || n == nil {
+		v.problem(offset, nil, "unreadable node: %v", err)
+		return 0, 0, false, nil
+	}
+	v.report.NumNodes++
+
+	iloc := &n.item
+	i := iloc.Item()
+	fresh := false
+	if loc := iloc.Loc(); !loc.isEmpty() {
+		ok, err := v.inBounds(loc, nil, "item")
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if ok {
+			// Always read a persisted item, even if it's in memory,
+			// to check that the file's copy is readable.
+			i, err = (&itemLoc{loc: unsafe.Pointer(loc)}).read(v.t, v.opts.Values)
+			if err != nil || i == nil {
+				v.problem(loc.Offset, nil, "unreadable item: %v", err)
+			}
+			fresh = i != nil
+		} else {
+			i = nil
+		}
+	}
+	if i == nil {
+		if iloc.Loc().isEmpty() {
+			v.problem(offset, nil, "node without item")
+		}
+		// Without a key, the children are checked against the
+		// parent's bounds instead.
+		numNodes, numBytes, _, err = v.visitChildren(n, lo, lo, hi, hi, maxPriority)
+		return numNodes + 1, numBytes, false, err
+	}
+	if fresh {
+		defer v.s.ItemDecRef(v.t, i)
+	}
+	if lo != nil && v.t.compare(lo, i.Key) >= 0 ||
+		hi != nil && v.t.compare(i.Key, hi) >= 0 {
+		v.problem(offset, i.Key, "key out of order")
+	}
+	if v.opts.Priorities && maxPriority >= 0 && i.Priority > maxPriority {
+		v.problem(offset, i.Key, "priority: %v above parent priority: %v",
+			i.Priority, maxPriority)
+	}
+	numNodes, numBytes, complete, err =
+		v.visitChildren(n, lo, i.Key, i.Key, hi, i.Priority)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	numNodes++
+	numBytes += uint64(iloc.NumBytes(v.t))
+	if complete && (n.numNodes != numNodes || n.numBytes != numBytes) {
+		v.problem(offset, i.Key, "numNodes/numBytes: %v/%v, actual: %v/%v",
+			n.numNodes, n.numBytes, numNodes, numBytes)
+	}
+	return numNodes, numBytes, complete, nil
+}
+
+func (v *verifier) visitChildren(n *node, leftLo, leftHi, rightLo, rightHi []byte,
+	maxPriority int32) (numNodes, numBytes uint64, complete bool, err error) {
+	leftNodes, leftBytes, leftComplete, err :=
+		v.visit(&n.left, leftLo, leftHi, maxPriority)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	rightNodes, rightBytes, rightComplete, err :=
+		v.visit(&n.right, rightLo, rightHi, maxPriority)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return leftNodes + rightNodes, leftBytes + rightBytes,
+		leftComplete && rightComplete, nil
+}
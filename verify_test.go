@@ -0,0 +1,109 @@
+package gkvlite
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	defer f.Close()
+	s, _ := NewStore(f)
+	r, err := s.Verify(VerifyOptions{})
+	if err != nil || !r.OK() || r.NumCollections != 0 {
+		t.Errorf("expected empty Verify to be ok, got: %#v, err: %v", r, err)
+	}
+	x := s.SetCollection("x", nil)
+	s.SetCollection("y", nil).Set([]byte("a"), []byte("a"))
+	for i := 0; i < 100; i++ {
+		x.Set([]byte(fmt.Sprintf("%03d", i)), []byte("x"))
+	}
+	s.Flush()
+	r, err = s.Verify(VerifyOptions{Priorities: true})
+	if err != nil || !r.OK() {
+		t.Errorf("expected Verify of priorities to be ok, got: %#v, err: %v", r, err)
+	}
+	for i := 0; i < 100; i += 3 {
+		x.Set([]byte(fmt.Sprintf("%03d", i)), []byte("xx"))
+	}
+	x.Delete([]byte("050"))
+	r, err = s.Verify(VerifyOptions{Values: true})
+	if err != nil || !r.OK() || r.NumCollections != 2 || r.NumNodes != 100 {
+		t.Errorf("expected Verify to be ok, got: %#v, err: %v", r, err)
+	}
+	r, _ = s.Verify(VerifyOptions{Collections: []string{"y", "z"}})
+	if r.NumCollections != 1 || len(r.Problems) != 1 ||
+		r.Problems[0].Collection != "z" {
+		t.Errorf("expected a missing collection problem, got: %#v", r)
+	}
+}
+
+func TestVerifyProblems(t *testing.T) {
+	s, _ := NewStore(nil)
+	x := s.SetCollection("x", nil)
+	for i := 0; i < 100; i++ {
+		x.Set([]byte(fmt.Sprintf("%03d", i)), []byte("x"))
+	}
+	rnl := x.rootAddRef()
+	root := rnl.root.Node()
+	x.rootDecRef(rnl)
+	// Break the key order, heap and counts invariants in one go.
+	left := root.left.Node()
+	left.item.Item().Key = []byte("zzz")
+	left.item.Item().Priority = root.item.Item().Priority + 1
+	root.numNodes++
+
+	r, err := s.Verify(VerifyOptions{Priorities: true})
+	if err != nil {
+		t.Errorf("expected Verify to work, err: %v", err)
+	}
+	var msgs []string
+	for _, p := range r.Problems {
+		msgs = append(msgs, p.String())
+	}
+	all := strings.Join(msgs, "\n")
+	for _, exp := range []string{"key out of order", "priority", "numNodes"} {
+		if !strings.Contains(all, exp) {
+			t.Errorf("expected problem: %s, got: %s", exp, all)
+		}
+	}
+	r, _ = s.Verify(VerifyOptions{MaxProblems: 1})
+	if len(r.Problems) != 1 {
+		t.Errorf("expected MaxProblems to limit problems, got: %#v", r.Problems)
+	}
+}
+
+func TestVerifyCorruptedFile(t *testing.T) {
+	fname := "tmp.test"
+	os.Remove(fname)
+	defer os.Remove(fname)
+	f, _ := os.Create(fname)
+	s, _ := NewStore(f)
+	x := s.SetCollection("x", nil)
+	x.Set([]byte("a"), []byte("a"))
+	x.Set([]byte("b"), []byte("b"))
+	s.Flush()
+	f.Close()
+	// The first item record written is a's, at offset 0.
+	corruptByte(t, fname, int64(itemLocHdrLength(VERSION)))
+
+	f, _ = os.Open(fname)
+	defer f.Close()
+	s, _ = NewStore(f)
+	r, err := s.Verify(VerifyOptions{})
+	if err != nil || len(r.Problems) != 1 || r.NumNodes != 2 ||
+		r.Problems[0].Offset != 0 ||
+		!strings.Contains(r.Problems[0].Msg, "checksum") {
+		t.Errorf("expected one item checksum problem, got: %#v, err: %v", r, err)
+	}
+	s.size = 10
+	r, _ = s.Verify(VerifyOptions{})
+	if r.OK() || !strings.Contains(r.Problems[0].Msg, "beyond file size") {
+		t.Errorf("expected out of bounds problems, got: %#v", r)
+	}
+}